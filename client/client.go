@@ -25,6 +25,39 @@ import (
 	_ "strconv"
 )
 
+// The imports the client needs beyond the default ones
+import (
+	// Useful for string manipulation and for sorting the names in a directory
+	"sort"
+	"strings"
+
+	// Used for the length in front of padded objects
+	"encoding/binary"
+
+	// Recovery codes are written as hex
+	"encoding/hex"
+
+	// Used to wipe the numbers of private keys from memory
+	"math/big"
+
+	// Used to compress the content of files
+	"bytes"
+	"compress/flate"
+	"io"
+
+	// Used to encode the RSA keys in binary records
+	"crypto/x509"
+
+	// The files of a list are loaded by a few goroutines at once
+	"sync"
+
+	// Leases on files expire after some time
+	"time"
+
+	// Used to merge the users that two sessions stored at the same time
+	"reflect"
+)
+
 // This serves two purposes: it shows you a few useful primitives,
 // and suppresses warnings for imports not being used. It can be
 // safely deleted!
@@ -100,36 +133,190 @@ func someUsefulThings() {
 // (e.g. like the Username attribute) and methods (e.g. like the StoreFile method below).
 const key_length = 16
 
+// In privacy mode every file is split into blocks of the same size and every stored object is padded,
+// so the length of what is stored does not tell how big a file is or how many times it has been appended to
+const private_block_size = 4096      //Bytes of content in every file of a private file
+const private_file_bucket = 8192     //Every file of a private file is padded to this size
+const private_metadata_bucket = 1024 //Everything else is padded to a multiple of this size
+
+// A session of a user. The methods of a session take turns, so one session can be shared between goroutines.
+// The lock is outside of userState, which is replaced every time the session loads the user again
 type User struct {
+	lock *sync.Mutex
+	userState
+}
+
+type userState struct {
 	Username              string
-	Password              []byte //Stored as hash
-	Secret_key            userlib.PKEDecKey
-	Signature_private_key userlib.DSSignKey
+	Root_key              []byte //The keys of the file references of the user are derived from this
+	Namespace_key         []byte //Used together with the filename for the uuid of the file references of the user
+	password_hash         []byte //Only kept in memory so the keys of the user can be derived again
+	Wrapped_keys          []byte //The private keys of the user, sealed with the key encryption key
+	secret_key            userlib.PKEDecKey
+	signature_private_key userlib.DSSignKey
+	Key_version           int                          //Version of secret_key and signature_private_key in the keystore, 0 is the same as 1
+	old_secret_keys       map[int]userlib.PKEDecKey    //Earlier versions of secret_key, only kept to accept pending invitations
+	Password_public_key   userlib.PKEEncKey            //The password slot is encrypted with this, its private key is sealed with the master key
+	Devices               map[string]DeviceEntry       //Devices that have their own slot, by id
+	Recovery_codes        map[string]userlib.PKEEncKey //Public keys of the slots of the recovery codes, by id
+	Contacts              map[string]Contact           //Contacts pinned before the contact book, moved to it the next time someone is pinned
+	Contact_book          bool                         //The contacts are in the contact book, false while they are still in Contacts
+	prekeys               map[uuid.UUID]Prekey         //One-time keys for invitations, forgotten as soon as they are used
+	Prekey_counter        int                          //Counter of the last prekey bundle the user published
 	master_key            []byte
+	account_key           []byte //Random key of the account that the user struct is sealed with, every slot has a copy
+	enc_key               []byte
 	hmac_key              []byte
+	key_encryption_key    []byte            //Derived from the account key, only used to wrap the private keys
+	slot                  string            //The slot this session opened the account with
+	slot_private_key      userlib.PKEDecKey //and the private key of it
+	cache                 *sessionCache     //What this session has loaded before and does not change anymore
+	loaded_user           []byte            //The user as this session loaded or stored it last, see UploadUserdata
+	loaded_account_key    []byte            //and the account key it is sealed with
 	Files_owned           map[uuid.UUID]bool
+	Path_prefixes         map[string]bool //Parts before the first "/" of the flat filenames of the user, no directory can take these names
+	Privacy_mode          bool            //Pad everything this user stores and make new files private
+	Deduplication         bool            //Store the content this user writes as chunks shared between the files of the user
+	Dedup_key             []byte          //The ids, keys and boundaries of the chunks of the user are derived from this
+	legacy_password       []byte          //Password hash and master key of the old key derivation and the namespace key
+	legacy_master_key     []byte          //from before the random salt, only known to sessions opened with the password
+	legacy_namespace_key  []byte          //so the files stored with them can still be found and moved over, see LegacyKeys
+}
+
+// The private keys of a user. They are never stored in the user struct itself but wrapped
+// with a key encryption key of their own, and they are wiped from memory on logout
+type PrivateKeys struct {
+	Secret_key            userlib.PKEDecKey
+	Signature_private_key userlib.DSSignKey
+	Old_secret_keys       map[int]userlib.PKEDecKey
+	Prekeys               map[uuid.UUID]Prekey
+}
+
+// Users stored before the private keys were wrapped have them in the user struct, and users stored
+// before the random salt also have the password hash in it. This is only read from old user structs
+type legacyUserFields struct {
+	Password          []byte
+	Legacy_password   []byte
+	Legacy_master_key []byte
+	PrivateKeys
+}
+
+// How the master key of a user is derived from the password. This is public and stored next to the user,
+// signed with the signature key of the user, so every user has their own random salt and the cost can be raised.
+// Only the number of rounds can change, every round of userlib.Argon2Key uses the same memory and threads
+type PasswordHashing struct {
+	Salt []byte
+	Time uint32 //Rounds of userlib.Argon2Key, each one hashes the result of the one before
+}
+
+// The cost of the password hashing of new users. Users with another number of rounds are moved to this one
+// the next time they log in. A single round is the same as userlib.Argon2Key
+var DefaultPasswordHashing = PasswordHashing{Time: 1}
+
+// A device of a user. It is created on the new device and stays there, it only needs this to log in.
+// Until a session of the user approves it, and after it has been removed, it cannot open the account
+type Device struct {
+	Username    string
+	Id          string
+	Private_key userlib.PKEDecKey
+}
+
+type DeviceEntry struct {
+	Id         string
+	Name       string
+	Public_key userlib.PKEEncKey
+}
+
+// A user this user has shared with or received an invitation from. The fingerprint covers both public keys
+// of the user, if the keystore ever gives different keys for them sharing with them fails
+type Contact struct {
+	Fingerprint    string
+	Key_version    int  //The version of the keys of the user that was pinned, 0 is the same as 1
+	Verified       bool //The fingerprint has been compared with the user out of band
+	Prekey_counter int  //Counter of the newest prekey bundle of the user that was seen, older bundles are replays
+}
+
+// The contacts of a user are stored on their own so the user struct, which is loaded for everything
+// the user does, does not get bigger with every user that files are shared with
+type ContactBook struct {
+	Contacts map[string]Contact
+}
+
+// A user that rotates their keys publishes the fingerprint of the new version signed with the signature key of
+// the version before it, so contacts that pinned an older version can follow the rotation
+type KeyRotation struct {
+	Version     int
+	Fingerprint string
+	Key_id      string //Part of the keystore names of the new keys, picked at random for every rotation
 }
 
 type File struct {
 	Content   []byte
-	Next_uuid uuid.UUID //UUID of the next file in list after this one
+	Next_uuid uuid.UUID        //UUID of the next file in list after this one
+	Chunks    []ChunkReference //Set instead of Content if the content is stored as deduplicated chunks
+}
+
+// A chunk holds content that is stored once for every file of a user that has it. The id and key of a chunk
+// are derived from its content and the dedup key of the user who stored it, so only that user can find it again
+type ChunkReference struct {
+	Pointer uuid.UUID
+	Enc_key []byte
+	Hash    []byte //Hash of the content, checked when the chunk is loaded
+}
+
+// Every chunk has a count of the files that point to it, the chunk is deleted when it reaches zero
+type ChunkRefs struct {
+	Count int
 }
 
 type FileController struct {
-	Start uuid.UUID //UUID of first file
-	End   uuid.UUID //UUID of end of file
+	Start         uuid.UUID //UUID of first file
+	End           uuid.UUID //UUID of end of file
+	Epoch         int       //Increased every time access is lazily revoked
+	Old_enc_keys  [][]byte  //Keys of earlier epochs, oldest first, kept until the old files are re-encrypted
+	Old_hmac_keys [][]byte
+	Old_hashes    map[uuid.UUID][]byte //Hashes of the files still under the keys of earlier epochs, as they were at the revocation
+	Last          uuid.UUID            //UUID of the last file with content, the one before End
+	Private       bool                 //The file is stored in blocks of the same size and everything is padded
+	Sensitive     bool                 //The content of the file is never stored as deduplicated chunks
+	Chunked       bool                 //Some of the files of the list point to chunks
+	Compression   int                  //Algorithm new content of the file is compressed with before it is encrypted
+	Appends       int                  //Number of appends since the list was last stored in one go
+	Index         []ListSegment        //Where the files of the list are, so they can be loaded all at once. Empty for lists stored before
+	Version       int                  //Increased every time the content changes, content cached for another version is loaded again
+}
+
+// The files of a list are at uuids derived from the seed of a segment and their position in it, so the whole list
+// is known from the file controller without following every Next_uuid. A lazy revocation starts a new segment
+// with a seed the revoked users do not know, every other change of the list starts over with a single new one
+type ListSegment struct {
+	Seed  []byte
+	Count int //Number of files with content in the segment, the file after them is the empty tail or a link to the next segment
 }
 
 type FileReferenceOwner struct {
-	Uuid_shared_with        map[string]uuid.UUID
-	Enc_keys_shared_with    map[string][]byte
+	Is_directory            bool                 //The file controller pointer points to a directory instead
+	Uuid_shared_with        map[string]uuid.UUID //The sharing of the file, only set in references stored
+	Enc_keys_shared_with    map[string][]byte    //before it was moved to the FileSharing of the file
 	Hmac_keys_shared_with   map[string][]byte
+	Invitations_shared_with map[string]uuid.UUID
 	File_enc_key            []byte
 	Hmac_key                []byte
 	File_controller_pointer uuid.UUID //UUID for file controller
+	Sharing_stored          bool      //The sharing is in the FileSharing of the file, false while it is still in this struct
+}
+
+// Who the owner shared a file with. It is stored on its own so the filereferenceowner, which is read for
+// everything done with the file, does not get bigger with every user the file is shared with
+type FileSharing struct {
+	Uuid_shared_with        map[string]uuid.UUID
+	Enc_keys_shared_with    map[string][]byte
+	Hmac_keys_shared_with   map[string][]byte
+	Invitations_shared_with map[string]uuid.UUID //Invitations that might not be accepted yet, deleted on revocation
 }
 
 type FileReferencePrimary struct {
+	Is_directory            bool
 	File_enc_key            []byte
 	Hmac_key                []byte
 	File_controller_pointer uuid.UUID
@@ -141,11 +328,72 @@ type FileReferenceSecondary struct {
 	File_reference_primary_pointer uuid.UUID
 }
 
+// A directory is a list of entries that each point to the file controller of a file or to another directory,
+// together with the keys for them. Sharing a directory therefore shares everything under it
+type Directory struct {
+	Entries map[string]DirectoryEntry
+}
+
+type DirectoryEntry struct {
+	Is_directory bool
+	Pointer      uuid.UUID //UUID of the file controller or of the subdirectory
+	Enc_key      []byte
+	Hmac_key     []byte
+}
+
+// Where the file controller (or directory) of a file is and the keys for it,
+// found by following the references of a user. This is never stored
+type FileAccess struct {
+	Controller_uuid uuid.UUID
+	Enc_key         []byte
+	Hmac_key        []byte
+	Is_directory    bool
+}
+
+// An advisory lock on a file. It is stored next to the file controller under keys derived from the keys of the file,
+// so everyone the file is shared with can see who holds it
+type FileLease struct {
+	Holder  string //Username of the user that holds the lease
+	Expires int64  //Unix time in nanoseconds by the clock of the holder, after that anyone can break the lease
+}
+
+// Given when a file is locked by another user
+type ErrLocked struct {
+	Holder  string
+	Expires time.Time
+}
+
+func (err *ErrLocked) Error() string {
+	return "the file is locked by " + err.Holder + " until " + err.Expires.Format(time.RFC3339)
+}
+
 type Invitation struct {
 	FRPdk  []byte
 	FRPhmk []byte
 }
 
+// A one-time key pair for invitations. The public keys are published in a bundle signed by the user,
+// the private key is deleted once an invitation for it is accepted, so invitations in the datastore
+// stay confidential even if the long term secret key leaks later
+type Prekey struct {
+	Public_key  userlib.PKEEncKey
+	Private_key userlib.PKEDecKey
+}
+
+type PrekeyBundle struct {
+	Key_version int //The version of the signature key the bundle is signed with
+	Counter     int //Counts up with every bundle the user publishes
+	Prekeys     map[uuid.UUID]userlib.PKEEncKey
+}
+
+// What the header of an invitation says about the keys it was made with
+type InvitationHeader struct {
+	Sender_version    int
+	Recipient_version int
+	Hybrid            bool      //The invitation is sealed with a key that is encrypted for the recipient, not encrypted directly
+	Prekey_id         uuid.UUID //The prekey of the recipient that was used, uuid.Nil if there was none
+}
+
 // You can add other attributes here if you want! But note that in order for attributes to
 // be included when this struct is serialized to/from JSON, they must be capitalized.
 // On the flipside, if you have an attribute that you want to be able to access from
@@ -162,8 +410,10 @@ func InitUser(Username string, password string) (userdataptr *User, err error) {
 	}
 
 	userdata.Username = Username
-	password_salt := Username + "p"
-	userdata.Password = userlib.Hash([]byte(password + password_salt))
+	userdata.password_hash = userPasswordHash(Username, password)
+	//The keys of the files do not depend on the password, so the password hashing can change without moving them
+	userdata.Root_key = userlib.RandomBytes(16)
+	userdata.Namespace_key = userlib.RandomBytes(16)
 
 	//Create public and private key
 	var pk userlib.PKEEncKey
@@ -172,7 +422,7 @@ func InitUser(Username string, password string) (userdataptr *User, err error) {
 	if err != nil {
 		return nil, errors.New("error in creating RSA key pair")
 	}
-	userdata.Secret_key = sk
+	userdata.secret_key = sk
 
 	//Create digital signature keys
 	var DS_sk userlib.DSSignKey
@@ -181,71 +431,47 @@ func InitUser(Username string, password string) (userdataptr *User, err error) {
 	if err != nil {
 		return nil, errors.New("error in creating RSA key pair for digital signature")
 	}
-	userdata.Signature_private_key = DS_sk
-
-	//Create master key with enough entropy using PBKDF
-	master_key_salt := Username + "k"
-	master_key := userlib.Argon2Key([]byte(userdata.Password), []byte(master_key_salt), key_length)
-	userdata.master_key = master_key
-
-	//Create HMAC key using master key into HBKDF where only 16 bytes are needed as that is
-	//the input size of the key in HMACEval
-	HMAC_key_64, err := userlib.HashKDF(userdata.master_key, []byte("HMAC key for user"))
-	if err != nil {
-		return nil, errors.New("error in generation of mac key for user")
-	}
-
-	HMAC_key := HMAC_key_64[:16]
-	userdata.hmac_key = HMAC_key
+	userdata.signature_private_key = DS_sk
+	userdata.Key_version = 1
 
 	//Check if the user exists
 	user_public_key_keystore := "Public key for:" + Username
-	_, ok := userlib.KeystoreGet(user_public_key_keystore)
+	_, ok := keystoreGet(user_public_key_keystore)
 	if ok {
 		return nil, errors.New("the user already exists")
 	}
 
 	//Put public keys in keystore, both signature and for encryption of invitation
-	err = userlib.KeystoreSet(user_public_key_keystore, pk)
+	err = keystoreSet(user_public_key_keystore, pk)
 	if err != nil {
 		return nil, errors.New("could not put public key into keystore")
 	}
 
 	user_signature_key_keystore := "Signature key for:" + Username
-	err = userlib.KeystoreSet(user_signature_key_keystore, DS_pk)
+	err = keystoreSet(user_signature_key_keystore, DS_pk)
 	if err != nil {
 		return nil, errors.New("could not put public key for signature into keystore")
 	}
 
-	//Now put the userdata into datastore where it is also encrypted
-	//Use a hash of the Username as UUID
-	//The UUID needs a 16 byte slice so use the first 16 bytes of the hash for the UUID
-	b := userlib.Hash([]byte(Username))[:16]
-	user_UUID, err := uuid.FromBytes(b)
-	if err != nil {
-		return nil, errors.New("could not create a new value for an instance in the datastore for the user")
-	}
 	//Make a file owned and add to userdata
 	userdata.Files_owned = make(map[uuid.UUID]bool)
-	//Turn the data into JSON
-	user_bytes, err := json.Marshal(userdata)
+	userdata.Devices = make(map[string]DeviceEntry)
+	userdata.prekeys = make(map[uuid.UUID]Prekey)
+	err = addPrekeys(&userdata, initial_prekeys)
 	if err != nil {
-		return nil, errors.New("could not Marshal the userdata into bytes")
+		return nil, err
 	}
-
-	//Encrypt it
-	iv := userlib.RandomBytes(16)
-	user_bytes_encrypted := userlib.SymEnc(master_key, iv, user_bytes)
-
-	//Then MAC it (64 bytes)
-	HMAC, err := userlib.HMACEval(HMAC_key, user_bytes_encrypted)
+	//Create the account key that seals the userdata and the password slot for it,
+	//the private key of the slot is sealed with the master key from a random salt
+	err = createAccount(&userdata)
 	if err != nil {
-		return nil, errors.New("could not append the HMAC to userdata")
+		return nil, errors.New("could not store the userdata")
+	}
+	//The prekeys are only published once their private keys are stored
+	err = publishPrekeys(&userdata)
+	if err != nil {
+		return nil, err
 	}
-	user_bytes_encrypted_MAC := append(user_bytes_encrypted, HMAC...)
-
-	//Store it
-	userlib.DatastoreSet(user_UUID, user_bytes_encrypted_MAC)
 
 	return &userdata, nil
 }
@@ -256,1001 +482,1012 @@ func GetUser(Username string, password string) (userdataptr *User, err error) {
 
 	//Update userdata value with given Username and password
 	userdata.Username = Username
-	password_salt := Username + "p"
-	userdata.Password = userlib.Hash([]byte(password + password_salt))
+	password_hash := userPasswordHash(Username, password)
 
 	//Check whether user exists using the Keystore
 	user_public_key_keystore := "Public key for:" + Username
-	_, ok := userlib.KeystoreGet(user_public_key_keystore)
+	_, ok := keystoreGet(user_public_key_keystore)
 	if !ok {
 		return nil, errors.New("the user does not exists")
 	}
 
 	//Finds the UUID
-	b := userlib.Hash([]byte(Username))[:16]
-	user_UUID, err := uuid.FromBytes(b)
+	user_UUID, err := userUUID(Username)
 	if err != nil {
 		return nil, errors.New("could find the user in the datastore")
 	}
 
-	//Retrieve data
-	userdata_bytes_encrypted_mac, ok := userlib.DatastoreGet(user_UUID)
+	//Users created before the labeled key derivation are still stored under the old uuid and keys
+	_, ok = datastoreGet(user_UUID)
 	if !ok {
-		return nil, errors.New("no data found for that UUID")
+		return migrateLegacyUser(Username, password)
 	}
 
-	//Splice HMAC and the encrypted json data
-	userdata_bytes_encrypted := userdata_bytes_encrypted_mac[:len(userdata_bytes_encrypted_mac)-64]
-	HMAC := userdata_bytes_encrypted[len(userdata_bytes_encrypted):]
-
-	//Compute the HMAC on the encrypted json data to check integrity
-	//Need to compute HMAC key
-
-	//Recompute master key with enough entropy using PBKDF
-	master_key_salt := Username + "k"
-	master_key := userlib.Argon2Key([]byte(userdata.Password), []byte(master_key_salt), key_length)
-	userdata.master_key = master_key
-
-	//Recompute HMAC key using master key into HBKDF where only 16 bytes are needed as that is
-	//the input size of the key in HMACEval
-	HMAC_key_64, err := userlib.HashKDF(userdata.master_key, []byte("HMAC key for user"))
+	//Find the salt and cost of the user, users stored before the random salt do not have them yet
+	hashing, found, err := LoadPasswordHashing(Username)
 	if err != nil {
-		return nil, errors.New("error in generation of mac key for user")
+		return nil, err
 	}
-
-	HMAC_key := HMAC_key_64[:16]
-
-	//Check if this HMAC_key computes the same HMAC as the one stored in datastore
-	new_HMAC, err := userlib.HMACEval(HMAC_key, userdata_bytes_encrypted)
-	if err != nil {
-		return nil, errors.New("could not compute the HMAC using the new HMAC key")
+	if !found {
+		hashing = legacyPasswordHashing(Username)
 	}
 
-	equal := userlib.HMACEqual(HMAC, new_HMAC)
-	if equal {
-		return nil, errors.New("hmac tag is wrong, integrity of userdata not verified")
+	//Recompute master key with enough entropy using PBKDF
+	master_key, err := deriveMasterKey(password_hash, hashing)
+	if err != nil {
+		return nil, errors.New("error in generation of keys for user")
 	}
 
-	//We can now decrypt the data as the HMAC is verified
-	userdata_bytes := userlib.SymDec(master_key, userdata_bytes_encrypted)
-
-	//Unmarshal the userdata
-	err = json.Unmarshal(userdata_bytes, userdataptr)
+	//Users stored before the account key do not have a password slot yet
+	password_key_uuid, err := passwordKeyUUID(Username)
 	if err != nil {
 		return nil, err
 	}
-
-	return userdataptr, nil
-}
-
-func (userdata *User) StoreFile(filename string, content []byte) (err error) {
-
-	//We first need to update the userdata with the proper hmac key and master key as this is stored
-	//Use helper function for this
-	userdata, err = getUserdata(userdata)
-	if err != nil {
-		return err
+	_, ok = datastoreGet(password_key_uuid)
+	if !ok {
+		return migratePasswordUser(Username, password_hash, master_key)
 	}
-	//First check if the file exists
 
-	//To do this we need to compute the UUID
-	//Password is already stores as a hash
-	var file_uuid_bytes []byte
-	file_uuid_bytes = append(file_uuid_bytes, userlib.Hash([]byte(userdata.Username))...)
-	file_uuid_bytes = append(file_uuid_bytes, userdata.Password...)
-	file_uuid_bytes = append(file_uuid_bytes, userlib.Hash([]byte(filename))...)
-	file_uuid, err := uuid.FromBytes(userlib.Hash(file_uuid_bytes)[:16])
+	//Open the private key of the password slot, this checks the integrity which fails if the password is wrong
+	private_key, err := openPasswordKey(Username, master_key)
 	if err != nil {
-		return err
+		return nil, errors.New("wrong password or the integrity of userdata is not verified")
 	}
-	//Check if file exists
-	datastore_file_content, ok := userlib.DatastoreGet(file_uuid)
-
-	//Create the encryption key
-	encryption_key_64, err := userlib.HashKDF(userdata.master_key, []byte("Encryption key for file"+filename))
+	//Open the account through the password slot and retrieve the data
+	err = openUserdata(userdataptr, password_slot, private_key)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	encryption_key := encryption_key_64[:16]
-	//Create the HMAC key
-	hmac_key_64, err := userlib.HashKDF(userdata.master_key, []byte("HMAC key for file"+filename))
+	userdata.master_key = master_key
+	userdata.password_hash = password_hash
+	err = loadLegacyKeys(userdataptr)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	hmac_key := hmac_key_64[:16]
-
-	//If the file does not exist
-	if !ok {
-		//Update the userdata with the new file owned
-		uuid_check, err := uuid.FromBytes(userlib.Hash([]byte(filename))[:16])
-		if err != nil {
-			return err
-		}
-		userdata.Files_owned[uuid_check] = true
-		//Upload the new userdata to the datastore using helper function
-		err = UploadUserdata(userdata)
-		if err != nil {
-			return err
-		}
-
-		//Create all the new structs needed for creating a file and the keys
-		//needed to encrypt file and filecontroller
-		var file_reference_owner FileReferenceOwner
 
-		//Keys for file encryption and HMAC
-		file_reference_owner.File_enc_key = userlib.RandomBytes(16)
-		file_reference_owner.Hmac_key = userlib.RandomBytes(16)
-		//The new file's UUID
-		file_reference_owner.File_controller_pointer = uuid.New()
-
-		//The sharing functionality
-		//Create a map for sharing of the UUID, HMAC_keys and Encryption keys to people with access
-		file_reference_owner.Uuid_shared_with = make(map[string]uuid.UUID)
-		file_reference_owner.Hmac_keys_shared_with = make(map[string][]byte)
-		file_reference_owner.Enc_keys_shared_with = make(map[string][]byte)
-
-		//Turn filereferenceowner to bytes and encrypt and then mac
-		file_reference_owner_bytes, err := json.Marshal(file_reference_owner)
-		if err != nil {
-			return err
-		}
-
-		//Encrypt
-		iv := userlib.RandomBytes(16)
-		file_reference_owner_bytes_encrypted := userlib.SymEnc(encryption_key, iv, file_reference_owner_bytes)
-
-		//MAC
-		filereferenceowner_HMAC, err := userlib.HMACEval(hmac_key, file_reference_owner_bytes_encrypted)
-		if err != nil {
-			return err
-		}
-		file_reference_owner_bytes_encrypted_HMAC := append(file_reference_owner_bytes_encrypted, filereferenceowner_HMAC...)
-
-		//Store filereferenceowner in datastore with Frombytes(username + password + filename) as uuid
-		userlib.DatastoreSet(file_uuid, file_reference_owner_bytes_encrypted_HMAC)
-
-		//Now we can create the file and the file controller
-		var file File
-		var file_controller FileController
-
-		file_controller.Start = uuid.New()
-		file_controller.End = uuid.New()
-
-		file.Content = content
-		file.Next_uuid = file_controller.End
-
-		//Now the we have a file controller keeping track of where the file linked lists starts and ends
-		//We then store the filecontroller at the uuid referenced by the filereferenceowner
-
-		//Marshal file controller
-		file_controller_bytes, err := json.Marshal(file_controller)
-		if err != nil {
-			return err
-		}
-		//Encrypt file controller
-		iv = userlib.RandomBytes(16)
-		file_controller_bytes_encrypted := userlib.SymEnc(file_reference_owner.File_enc_key, iv, file_controller_bytes)
-		//HMAC it
-		file_controller_bytes_HMAC, err := userlib.HMACEval(file_reference_owner.Hmac_key, file_controller_bytes_encrypted)
-		if err != nil {
-			return err
-		}
-		file_controller_bytes_encrypted_HMAC := append(file_controller_bytes_encrypted, file_controller_bytes_HMAC...)
-		//Store in datastore
-		userlib.DatastoreSet(file_reference_owner.File_controller_pointer, file_controller_bytes_encrypted_HMAC)
-
-		//Now we store the file at the UUID referenced by file_controller.Start
-		//Marshall it
-		file_bytes, err := json.Marshal(file)
-		if err != nil {
-			return err
-		}
-		//Encrypt it using filereferenceowner key
-		iv = userlib.RandomBytes(16)
-		file_bytes_encrypted := userlib.SymEnc(file_reference_owner.File_enc_key, iv, file_bytes)
-		//HMAC it
-		file_bytes_HMAC, err := userlib.HMACEval(file_reference_owner.Hmac_key, file_bytes_encrypted)
-		if err != nil {
-			return err
-		}
-		file_bytes_encrypted_HMAC := append(file_bytes_encrypted, file_bytes_HMAC...)
-		//Send the file to the datastore at the uuid of file_controller.start
-		userlib.DatastoreSet(file_controller.Start, file_bytes_encrypted_HMAC)
-
-		//Finally, add an empty file to the end of the linked list (file_controller.End)
-		var empty_file File
-
-		//Marshall it
-		empty_file_bytes, err := json.Marshal(empty_file)
-		if err != nil {
-			return err
-		}
-		//Encrypt it
-		iv = userlib.RandomBytes(16)
-		empty_file_bytes_encrypted := userlib.SymEnc(file_reference_owner.File_enc_key, iv, empty_file_bytes)
-		//HMAC it
-		empty_file_bytes_HMAC, err := userlib.HMACEval(file_reference_owner.Hmac_key, empty_file_bytes_encrypted)
+	//Move the user to the current cost if it is not using it yet
+	if !hashing.sameCost(DefaultPasswordHashing) {
+		err = setPasswordHashing(userdataptr, userdata.slot_private_key)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		empty_file_bytes_encrypted_HMAC := append(empty_file_bytes_encrypted, empty_file_bytes_HMAC...)
-		//Store it in datastore at file_controller.End uuid
-		userlib.DatastoreSet(file_controller.End, empty_file_bytes_encrypted_HMAC)
-
-		return nil
 	}
-	//For when the file already exists
-	//If the user owns the file
-	uuid_check, err := uuid.FromBytes(userlib.Hash([]byte(filename))[:16])
-	if err != nil {
-		return err
-	}
-	owns_file := userdata.Files_owned[uuid_check]
-	if owns_file {
-		var file_reference_owner FileReferenceOwner
-		var file_controller FileController
-
-		//We want to now access the filereference owner to see where our filecontroller is
-		//Need to first check integrity of filereferenceowner using valid mac helper function
-		if !ValidHMAC(hmac_key, datastore_file_content) {
-			return errors.New("the integrity of the FileReferenceOwner of this file has been compromised")
-		}
-		//As it is integral we can load the filereference owner from datastore_file_content
-		datastore_file_content_encrypted := datastore_file_content[:len(datastore_file_content)-64]
-		//Decrypt it
-		datastore_file_content_decrypted := userlib.SymDec(encryption_key, datastore_file_content_encrypted)
-		//Unmarshal it
-		err := json.Unmarshal(datastore_file_content_decrypted, &file_reference_owner)
-		if err != nil {
-			return err
-		}
-		//Load the file controller
-		file_controller_bytes_with_HMAC, ok := userlib.DatastoreGet(file_reference_owner.File_controller_pointer)
-		if !ok {
-			return errors.New("something wrong with accessing file controller")
-		}
-		//Check HMAC of file controller
-		if !ValidHMAC(file_reference_owner.Hmac_key, file_controller_bytes_with_HMAC) {
-			return errors.New("the integrity of the file controller is compromised")
-		}
-		//Decrypt it
-		file_controller_bytes_encrypted := file_controller_bytes_with_HMAC[:len(file_controller_bytes_with_HMAC)-64]
-		file_controller_bytes_decrypted := userlib.SymDec(file_reference_owner.File_enc_key, file_controller_bytes_encrypted)
-		//Demarshal it
-		err = json.Unmarshal(file_controller_bytes_decrypted, &file_controller)
-		if err != nil {
-			return err
-		}
-
-		//Now we know where the start and end of the linked file is
-		//The idea is to create a new file and update the start attribute in the file controller
-		//The empty end of the previous file list can be discarded as there are no requirement that this should be deleted
-
-		//Now we create the new start and end to the linked list of files
-		var start_file File
-		var end_file File
-		start_file.Content = content
-		//Add the next file as a random new uuid
-		start_file.Next_uuid = uuid.New()
-		//Update the file_controller with the new tail
-		file_controller.End = start_file.Next_uuid
-		//Store the new file at the beginning of the list as told in the file_controller.start
-		//Marshal
-		start_file_bytes, err := json.Marshal(start_file)
-		if err != nil {
-			return err
-		}
-		//Encrypt
-		iv := userlib.RandomBytes(16)
-		start_file_bytes_encrypted := userlib.SymEnc(file_reference_owner.File_enc_key, iv, start_file_bytes)
-		//HMAC
-		start_file_bytes_HMAC, err := userlib.HMACEval(file_reference_owner.Hmac_key, start_file_bytes_encrypted)
-		if err != nil {
-			return err
-		}
-		start_file_bytes_encrypted_HMAC := append(start_file_bytes_encrypted, start_file_bytes_HMAC...)
-		//Store it at file_controller_start
-		userlib.DatastoreSet(file_controller.Start, start_file_bytes_encrypted_HMAC)
 
-		//Do the same for the empty tail
-		//Marshal
-		end_file_bytes, err := json.Marshal(end_file)
-		if err != nil {
-			return err
-		}
-		//Encrypt
-		iv = userlib.RandomBytes(16)
-		end_file_bytes_encrypted := userlib.SymEnc(file_reference_owner.File_enc_key, iv, end_file_bytes)
-		//HMAC
-		end_file_bytes_HMAC, err := userlib.HMACEval(file_reference_owner.Hmac_key, end_file_bytes_encrypted)
-		if err != nil {
-			return err
-		}
-		end_file_bytes_encrypted_HMAC := append(end_file_bytes_encrypted, end_file_bytes_HMAC...)
-		//Store it at file_controller_end or file_starts next uuid
-		userlib.DatastoreSet(start_file.Next_uuid, end_file_bytes_encrypted_HMAC)
+	return userdataptr, nil
+}
 
-		return nil
+// Function to move a user that was stored sealed with keys from the master key over to an account key
+// with a password slot. Users stored before the random salt also derived the keys of their files from the
+// master key and password hash, so those are kept
+func migratePasswordUser(Username string, password_hash []byte, master_key []byte) (userdataptr *User, err error) {
+	var userdata User
+	user_UUID, err := userUUID(Username)
+	if err != nil {
+		return nil, err
 	}
-	//If the user does not own the file
-	//We now take advantage of our filereferenceprimary and filereferencesecondary structs
-	var file_reference_primary FileReferencePrimary
-	var file_reference_secondary FileReferenceSecondary
-	var file_controller FileController
-	//We first open the filereferencesecondary file
-	//This would be at the UUID inputted when calling store file
-	//That is: FromBytes(username+password+filename)
-	//This is already loaded
-	//Check HMAC
-	if !ValidHMAC(hmac_key, datastore_file_content) {
-		return errors.New("integrity of the filereferencesecondary is compromised")
+	enc_key, err := DeriveKey(master_key, label_user_encryption_key)
+	if err != nil {
+		return nil, err
 	}
-	//If HMAC is valid decrypt and then demarshal
-	//Decrypt using the key used to encrypt the filereferencesecondary upon sharing
-	datastore_file_content_encrypted := datastore_file_content[:len(datastore_file_content)-64]
-	datastore_file_content_decrypted := userlib.SymDec(encryption_key, datastore_file_content_encrypted)
-	//Demarshal
-	err = json.Unmarshal(datastore_file_content_decrypted, &file_reference_secondary)
+	hmac_key, err := DeriveKey(master_key, label_user_hmac_key)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	//Now we can open the filereferenceprimary from the filereferencesecondary
-	file_reference_primary_bytes_encrypted_HMAC, ok := userlib.DatastoreGet(file_reference_secondary.File_reference_primary_pointer)
+	sealed, ok := datastoreGet(user_UUID)
 	if !ok {
-		return errors.New("not able to retrieve the filereferenceprimary file from filereferencesecondary file")
+		return nil, errors.New("wrong password or the integrity of userdata is not verified")
 	}
-	//Check the HMCA of the file_reference_primary
-	if !ValidHMAC(file_reference_secondary.Hmac_key, file_reference_primary_bytes_encrypted_HMAC) {
-		return errors.New("the integrity of the filereferenceprimary is compromised")
+	userdata_bytes, sealed, err := openStored(user_UUID, enc_key, hmac_key, sealed)
+	if err != nil {
+		return nil, errors.New("wrong password or the integrity of userdata is not verified")
 	}
-	//Decrypt it
-	file_reference_primary_bytes_encrypted := file_reference_primary_bytes_encrypted_HMAC[:len(file_reference_primary_bytes_encrypted_HMAC)-64]
-	file_reference_primary_bytes_decrypted := userlib.SymDec(file_reference_secondary.File_Reference_Primary_enc_key, file_reference_primary_bytes_encrypted)
-	//Unmarshal
-	err = json.Unmarshal(file_reference_primary_bytes_decrypted, &file_reference_primary)
+	legacy, err := unmarshalLegacyUserdata(userdata_bytes, &userdata)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	//We now have access to the filereferenceprimary which gives access to the file controller and the encryption key and hmac key
-	//We can now load the file controller
-	file_controller_bytes_encrypted_HMAC, ok := userlib.DatastoreGet(file_reference_primary.File_controller_pointer)
-	if !ok {
-		return errors.New("could not retrieve file controller from filereferenceprimary")
+	userdata.password_hash = password_hash
+	if userdata.Root_key == nil {
+		//The namespace key was the password hash, the references under it are moved to a random one when they are used
+		userdata.Root_key = master_key
+		userdata.Namespace_key = userlib.RandomBytes(16)
+		userdata.legacy_namespace_key = legacy.Password
 	}
-	//Check the HMAC
-	if !ValidHMAC(file_reference_primary.Hmac_key, file_controller_bytes_encrypted_HMAC) {
-		return errors.New("the integrity of the file controller has been compromised")
+	if userdata.Files_owned == nil {
+		userdata.Files_owned = make(map[uuid.UUID]bool)
 	}
-	//Decrypt
-	file_controller_bytes_encrypted := file_controller_bytes_encrypted_HMAC[:len(file_controller_bytes_encrypted_HMAC)-64]
-	file_controller_bytes_decrypted := userlib.SymDec(file_reference_primary.File_enc_key, file_controller_bytes_encrypted)
-	//Unmarshal
-	err = json.Unmarshal(file_controller_bytes_decrypted, &file_controller)
+	//The user is stored over the old one, unless another session moved it over first
+	userdata.loaded_user = sealed
+	err = createAccount(&userdata)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return &userdata, nil
+}
 
-	//Now we have access to the file controller and can store the new content
-	var start_file File
-	var end_file File
-	start_file.Content = content
-	start_file.Next_uuid = uuid.New()
-	//Update the end of the file list
-	file_controller.End = start_file.Next_uuid
-
-	//Store the start file
-	//Marshal
-	start_file_bytes, err := json.Marshal(start_file)
+// Function to move a user stored with the old key derivation over to the labeled one.
+// The old password hash and master key are sealed with the new master key, so the files of the user
+// can be moved over the first time they are used
+func migrateLegacyUser(Username string, password string) (userdataptr *User, err error) {
+	var userdata User
+	legacy_password := legacyPasswordHash(Username, password)
+	legacy_master_key, legacy_hmac_key, err := legacyUserKeys(Username, legacy_password)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	//Encrypt
-	iv := userlib.RandomBytes(16)
-	start_file_bytes_encrypted := userlib.SymEnc(file_reference_primary.File_enc_key, iv, start_file_bytes)
-	//Add HMAC
-	start_file_bytes_HMAC, err := userlib.HMACEval(file_reference_primary.Hmac_key, start_file_bytes_encrypted)
+	legacy_user_UUID, err := legacyUserUUID(Username)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	start_file_bytes_encrypted_HMAC := append(start_file_bytes_encrypted, start_file_bytes_HMAC...)
-	//Store in datastore
-	userlib.DatastoreSet(file_controller.Start, start_file_bytes_encrypted_HMAC)
-
-	//Do the same for the empty tail
-	//Marshal
-	end_file_bytes, err := json.Marshal(end_file)
+	userdata_bytes, err := RetrieveFromDatastore(legacy_user_UUID, legacy_master_key, legacy_hmac_key)
 	if err != nil {
-		return err
+		return nil, errors.New("wrong password or the integrity of userdata is not verified")
 	}
-	//Encrypt
-	iv = userlib.RandomBytes(16)
-	end_file_bytes_encrypted := userlib.SymEnc(file_reference_primary.File_enc_key, iv, end_file_bytes)
-	//HMAC
-	end_file_bytes_HMAC, err := userlib.HMACEval(file_reference_primary.Hmac_key, end_file_bytes_encrypted)
+	_, err = unmarshalLegacyUserdata(userdata_bytes, &userdata)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	end_file_bytes_encrypted_HMAC := append(end_file_bytes_encrypted, end_file_bytes_HMAC...)
-	//Store it at file_controller_end or file_starts next uuid
-	userlib.DatastoreSet(start_file.Next_uuid, end_file_bytes_encrypted_HMAC)
-
-	return nil
-}
-
-//Might have to reupload file controller to datastore, not sure yet
 
-func (userdata *User) AppendToFile(filename string, content []byte) error {
-	//Update the user to get the master key and hmac key
-	userdata, err := getUserdata(userdata)
-	if err != nil {
-		return err
+	//Store the user under the new uuid and keys with a random salt and remove the old one
+	userdata.password_hash = userPasswordHash(Username, password)
+	userdata.Root_key = userlib.RandomBytes(16)
+	userdata.Namespace_key = userlib.RandomBytes(16)
+	userdata.legacy_password = legacy_password
+	userdata.legacy_master_key = legacy_master_key
+	if userdata.Files_owned == nil {
+		userdata.Files_owned = make(map[uuid.UUID]bool)
 	}
-	//Get the uuid of the file
-	var file_uuid_bytes []byte
-	file_uuid_bytes = append(file_uuid_bytes, userlib.Hash([]byte(userdata.Username))...)
-	file_uuid_bytes = append(file_uuid_bytes, userdata.Password...)
-	file_uuid_bytes = append(file_uuid_bytes, userlib.Hash([]byte(filename))...)
-	file_uuid, err := uuid.FromBytes(userlib.Hash(file_uuid_bytes)[:16])
+	err = createAccount(&userdata)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	datastoreDelete(legacy_user_UUID)
+	return &userdata, nil
+}
 
-	//Create the hmac and encryption key using masterkey
-	//Check if file exists
-	datastore_file_content, ok := userlib.DatastoreGet(file_uuid)
-	if !ok {
-		return errors.New("the file does not exist in the namespace of the user")
-	}
+func (userdata *User) StoreFile(filename string, content []byte) (err error) {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
 
-	//Create the encryption key
-	encryption_key_64, err := userlib.HashKDF(userdata.master_key, []byte("Encryption key for file"+filename))
+	//We first need to update the userdata with the proper hmac key and master key as this is stored
+	//Use helper function for this
+	userdata, err = getUserdata(userdata)
 	if err != nil {
 		return err
 	}
-	encryption_key := encryption_key_64[:16]
-	//Create the HMAC key
-	hmac_key_64, err := userlib.HashKDF(userdata.master_key, []byte("HMAC key for file"+filename))
+	//Files inside a directory are entries of the directory and not in the namespace of the user
+	parent, directory, name, is_path, err := getParentDirectory(userdata, filename)
 	if err != nil {
 		return err
 	}
-	hmac_key := hmac_key_64[:16]
-
-	//Append if owner
-	uuid_check, err := uuid.FromBytes(userlib.Hash([]byte(filename))[:16])
-	if err != nil {
-		return err
-	}
-	owns_file := userdata.Files_owned[uuid_check]
-	if owns_file {
-		//Since it is owned the user can get the file controller from an filereferenceowner struct
-		var file_reference_owner FileReferenceOwner
-		//Check HMAC
-		if !ValidHMAC(hmac_key, datastore_file_content) {
-			return errors.New("the integrity of the filereferenceowner has been compromised")
-		}
-		//Decrypt
-		datastore_file_content_encrypted := datastore_file_content[:len(datastore_file_content)-64]
-		datastore_file_content_decrypted := userlib.SymDec(encryption_key, datastore_file_content_encrypted)
-		//Unmarshal
-		err := json.Unmarshal(datastore_file_content_decrypted, &file_reference_owner)
-		if err != nil {
-			return err
-		}
-		//We can now access the filecontroller
-		var file_controller FileController
-		file_controller_bytes_encrypted_HMAC, ok := userlib.DatastoreGet(file_reference_owner.File_controller_pointer)
+	if is_path {
+		entry, ok := directory.Entries[name]
 		if !ok {
-			return errors.New("could not find the file controller")
-		}
-		//Check hmac and decrypt
-		//Check HMAC
-		if !ValidHMAC(file_reference_owner.Hmac_key, file_controller_bytes_encrypted_HMAC) {
-			return errors.New("the integrity of the filereferenceowner has been compromised")
+			//A new file in the directory gets its own file controller and keys
+			entry.Pointer = uuid.New()
+			entry.Enc_key = userlib.RandomBytes(16)
+			entry.Hmac_key = userlib.RandomBytes(16)
+			err = StoreNewFileList(entry.Pointer, entry.Enc_key, entry.Hmac_key, content, userdata.Privacy_mode, dedupKey(userdata))
+			if err != nil {
+				return err
+			}
+			existing, found, err := addDirectoryEntry(parent, name, entry, metadataBucket(userdata.Privacy_mode))
+			if err != nil || !found {
+				return err
+			}
+			//Another session stored something under the name first, the new file is deleted again and
+			//what is there is overwritten instead
+			err = deleteFileList(entry.Pointer, entry.Enc_key, entry.Hmac_key)
+			if err != nil {
+				return err
+			}
+			entry = existing
 		}
-		//Decrypt
-		file_controller_bytes_encrypted := file_controller_bytes_encrypted_HMAC[:len(file_controller_bytes_encrypted_HMAC)-64]
-		file_controller_bytes_decrypted := userlib.SymDec(file_reference_owner.File_enc_key, file_controller_bytes_encrypted)
-		//Unmarshal
-		err = json.Unmarshal(file_controller_bytes_decrypted, &file_controller)
-		if err != nil {
-			return err
+		if entry.Is_directory {
+			return errors.New("cannot store a file where there is a directory")
 		}
+		return OverwriteFileList(entry.Pointer, entry.Enc_key, entry.Hmac_key, content, dedupKey(userdata), userdata.Username)
+	}
+	//First check if the file exists
 
-		//Now we have access to the file uuid and can append the contents
-		var append_file File
-		var end_file File
-		append_file.Content = content
-		append_file.Next_uuid = uuid.New()
-
-		//Finally realized that i need helper functions to download and post to datastore
-		//Post start file to datastore at the next uuid
-		err = SendToDatastore(file_controller.End, file_reference_owner.File_enc_key, file_reference_owner.Hmac_key, append_file)
-		if err != nil {
-			return errors.New("could not append")
-		}
+	//To do this we need to compute the UUID, this also gives the keys of the reference
+	file_uuid, encryption_key, hmac_key, err := getFileReference(userdata, filename)
+	if err != nil {
+		return err
+	}
+	//Check if file exists
+	_, ok := datastoreGet(file_uuid)
 
-		//Update the file controller with the new tail
-		file_controller.End = append_file.Next_uuid
-		err = SendToDatastore(file_reference_owner.File_controller_pointer, file_reference_owner.File_enc_key, file_reference_owner.Hmac_key, file_controller)
+	//If the file already exists we find the file controller, whether we own the file or not,
+	//and replace the list of files it points to
+	if ok {
+		access, err := getFileAccess(userdata, filename)
 		if err != nil {
-			return errors.New("could not store new filecontroller")
+			return err
 		}
-		//Store empty file for next file when next append is done
-		err = SendToDatastore(append_file.Next_uuid, file_reference_owner.File_enc_key, file_reference_owner.Hmac_key, end_file)
-		if err != nil {
-			return errors.New("could not store end file to datastore")
+		if access.Is_directory {
+			return errors.New("cannot store a file where there is a directory")
 		}
-		return nil
+		return OverwriteFileList(access.Controller_uuid, access.Enc_key, access.Hmac_key, content, dedupKey(userdata), userdata.Username)
 	}
-	//If the file is not owned by the user
-	//Access the filereferencesecondary first
-	//Initialize structs
-	var file_reference_secondary FileReferenceSecondary
-	var file_reference_primary FileReferencePrimary
-	var file_controller FileController
 
-	//Load file reference secondary
-	file_reference_secondary_bytes, err := RetrieveFromDatastore(file_uuid, encryption_key, hmac_key)
+	//If the file does not exist
+	//Update the userdata with the new file owned
+	uuid_check, err := ownedFileID(filename)
 	if err != nil {
 		return err
 	}
-	err = json.Unmarshal(file_reference_secondary_bytes, &file_reference_secondary)
+	userdata.Files_owned[uuid_check] = true
+	addPathPrefix(userdata, filename)
+	//Upload the new userdata to the datastore using helper function
+	err = UploadUserdata(userdata)
 	if err != nil {
 		return err
 	}
 
-	//Now we can load the file reference primary
-	file_reference_primary_bytes, err := RetrieveFromDatastore(file_reference_secondary.File_reference_primary_pointer, file_reference_secondary.File_Reference_Primary_enc_key, file_reference_secondary.Hmac_key)
-	if err != nil {
-		return err
-	}
-	err = json.Unmarshal(file_reference_primary_bytes, &file_reference_primary)
-	if err != nil {
-		return err
-	}
+	//Create all the new structs needed for creating a file and the keys
+	//needed to encrypt file and filecontroller
+	var file_reference_owner FileReferenceOwner
 
-	//Now load the file controller
-	file_controller_bytes, err := RetrieveFromDatastore(file_reference_primary.File_controller_pointer, file_reference_primary.File_enc_key, file_reference_primary.Hmac_key)
-	if err != nil {
-		return err
-	}
-	err = json.Unmarshal(file_controller_bytes, &file_controller)
+	//Keys for file encryption and HMAC
+	file_reference_owner.File_enc_key = userlib.RandomBytes(16)
+	file_reference_owner.Hmac_key = userlib.RandomBytes(16)
+	//The new file's UUID
+	file_reference_owner.File_controller_pointer = uuid.New()
+	//Who the file is shared with is stored in a FileSharing once it is shared
+
+	//Store filereferenceowner in datastore with Frombytes(username + password + filename) as uuid
+	err = SendToDatastorePadded(file_uuid, encryption_key, hmac_key, file_reference_owner, metadataBucket(userdata.Privacy_mode))
 	if err != nil {
 		return err
 	}
 
-	//Now we can do the same procedure as if you were the owner
-	//Now we have access to the file uuid and can append the contents
-	var append_file File
-	var end_file File
-	append_file.Content = content
-	append_file.Next_uuid = uuid.New()
+	//Now we can create the file and the file controller keeping track of where the linked list of files starts and ends
+	return StoreNewFileList(file_reference_owner.File_controller_pointer, file_reference_owner.File_enc_key, file_reference_owner.Hmac_key, content, userdata.Privacy_mode, dedupKey(userdata))
+}
 
-	//Post start file to datastore at the next uuid
-	err = SendToDatastore(file_controller.End, file_reference_primary.File_enc_key, file_reference_primary.Hmac_key, append_file)
+func (userdata *User) AppendToFile(filename string, content []byte) error {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
+	//Update the user to get the master key and hmac key
+	userdata, err := getUserdata(userdata)
 	if err != nil {
-		return errors.New("could not append")
+		return err
 	}
-
-	//Update the file controller with the new tail
-	file_controller.End = append_file.Next_uuid
-	err = SendToDatastore(file_reference_primary.File_controller_pointer, file_reference_primary.File_enc_key, file_reference_primary.Hmac_key, file_controller)
+	//Find the file controller, whether we own the file, it is shared with us or it is in a directory
+	access, err := getFileAccess(userdata, filename)
 	if err != nil {
-		return errors.New("could not store new filecontroller")
+		return err
 	}
-	//Store empty file for next file when next append is done
-	err = SendToDatastore(append_file.Next_uuid, file_reference_primary.File_enc_key, file_reference_primary.Hmac_key, end_file)
-	if err != nil {
-		return errors.New("could not store end file to datastore")
+	if access.Is_directory {
+		return errors.New("cannot append to a directory")
 	}
-
-	return nil
+	return AppendToFileList(access.Controller_uuid, access.Enc_key, access.Hmac_key, content, dedupKey(userdata), userdata.Username)
 }
 
 func (userdata *User) LoadFile(filename string) (content []byte, err error) {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
+	return userdata.loadFile(filename)
+}
+
+// The caller holds the lock of the session
+func (userdata *User) loadFile(filename string) (content []byte, err error) {
 	//Update the userdata and check the hmac
 	userdata, err = getUserdata(userdata)
 	if err != nil {
 		return nil, err
 	}
-	//Compute the uuid of the file
-	var file_uuid_bytes []byte
-	file_uuid_bytes = append(file_uuid_bytes, userlib.Hash([]byte(userdata.Username))...)
-	file_uuid_bytes = append(file_uuid_bytes, userdata.Password...)
-	file_uuid_bytes = append(file_uuid_bytes, userlib.Hash([]byte(filename))...)
-	file_uuid, err := uuid.FromBytes(userlib.Hash(file_uuid_bytes)[:16])
+	//Find the file controller, whether we own the file, it is shared with us or it is in a directory
+	access, err := getFileAccess(userdata, filename)
 	if err != nil {
 		return nil, err
 	}
-
-	//Create the hmac and encryption key using masterkey
-
-	//Create the encryption key
-	encryption_key_64, err := userlib.HashKDF(userdata.master_key, []byte("Encryption key for file"+filename))
-	if err != nil {
-		return nil, err
+	if access.Is_directory {
+		return nil, errors.New("cannot load a directory, use ListDir instead")
 	}
-	encryption_key := encryption_key_64[:16]
-	//Create the HMAC key
-	hmac_key_64, err := userlib.HashKDF(userdata.master_key, []byte("HMAC key for file"+filename))
+	//Load the file controller
+	file_controller, sealed, err := loadFileController(access.Controller_uuid, access.Enc_key, access.Hmac_key)
 	if err != nil {
 		return nil, err
 	}
-	hmac_key := hmac_key_64[:16]
-
-	//If the user is the owner of the file
-	uuid_check, err := uuid.FromBytes(userlib.Hash([]byte(filename))[:16])
+	//We now have the file controller and can start loading all the parts of the file,
+	//whatever this session loaded before and has not changed since is not loaded again
+	content, err = loadFileListCached(userdata.cache, access.Controller_uuid, file_controller, access.Enc_key, access.Hmac_key)
 	if err != nil {
 		return nil, err
 	}
-	owns_file := userdata.Files_owned[uuid_check]
-	if owns_file {
-		//Retrieve the filereferenceowner
-		var file_reference_owner FileReferenceOwner
-		var file_controller FileController
-
-		file_reference_owner_bytes, err := RetrieveFromDatastore(file_uuid, encryption_key, hmac_key)
-		if err != nil {
-			return nil, err
-		}
-		//Unmarshal
-		err = json.Unmarshal(file_reference_owner_bytes, &file_reference_owner)
-		if err != nil {
-			return nil, err
-		}
-		//We now have access to the file controller, load it
-		file_controller_bytes, err := RetrieveFromDatastore(file_reference_owner.File_controller_pointer, file_reference_owner.File_enc_key, file_reference_owner.Hmac_key)
-		if err != nil {
-			return nil, err
-		}
-		err = json.Unmarshal(file_controller_bytes, &file_controller)
-		if err != nil {
-			return nil, err
-		}
-		//We now have the file controller and can start loading all the parts of the file
-		//to see if there are more files in the list
-		var has_next bool
-		var content []byte
-		var next_uuid uuid.UUID
-		next_uuid = file_controller.Start
-		has_next = true
-		for has_next {
-			var file File
-			current_file_bytes, err := RetrieveFromDatastore(next_uuid, file_reference_owner.File_enc_key, file_reference_owner.Hmac_key)
-			if err != nil {
-				return nil, err
-			}
-			err = json.Unmarshal(current_file_bytes, &file)
-			if err != nil {
-				return nil, err
-			}
-			content = append(content, file.Content...)
-			//Check if that was the end of the list
-			if file.Next_uuid == uuid.Nil {
-				has_next = false
-				break
-			}
-			next_uuid = file.Next_uuid
-		}
-		return content, err
+	//A file that has been appended to many times is compacted while the content is at hand anyway,
+	//so appending stays cheap and loading does not get slower with every append. Private files already
+	//fill whole blocks, and storing all of them at once would tell how many appends there were.
+	//The error is not given: until the file controller is replaced compactFileList takes back whatever it stored
+	//when it fails, and after that only deleting the old list can fail. The file can be loaded either way
+	if file_controller.Appends >= compaction_threshold && !file_controller.Private {
+		_ = compactFileList(access.Controller_uuid, file_controller, sealed, access.Enc_key, access.Hmac_key, content, dedupKey(userdata))
 	}
-	//If the user is not the owner of the file
-	var file_reference_secondary FileReferenceSecondary
-	var file_reference_primary FileReferencePrimary
-	var file_controller FileController
+	return content, nil
+}
 
-	//Load file reference secondary
-	file_reference_secondary_bytes, err := RetrieveFromDatastore(file_uuid, encryption_key, hmac_key)
+// Rewrites the list of a file that has been appended to many times as few large files.
+// Everyone with access can keep using the file, the file controller stays where it is
+func (userdata *User) CompactFile(filename string) error {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
+	//Update the userdata
+	userdata, err := getUserdata(userdata)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	err = json.Unmarshal(file_reference_secondary_bytes, &file_reference_secondary)
+	access, err := getFileAccess(userdata, filename)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	//Now we can load the file reference primary
-	file_reference_primary_bytes, err := RetrieveFromDatastore(file_reference_secondary.File_reference_primary_pointer, file_reference_secondary.File_Reference_Primary_enc_key, file_reference_secondary.Hmac_key)
+	if access.Is_directory {
+		return errors.New("cannot compact a directory")
+	}
+	file_controller, sealed, err := loadFileController(access.Controller_uuid, access.Enc_key, access.Hmac_key)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	err = json.Unmarshal(file_reference_primary_bytes, &file_reference_primary)
+	err = checkFileLease(access, userdata.Username)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	content, err := LoadFileList(file_controller, access.Enc_key, access.Hmac_key)
+	if err != nil {
+		return err
 	}
+	return compactFileList(access.Controller_uuid, file_controller, sealed, access.Enc_key, access.Hmac_key, content, dedupKey(userdata))
+}
 
-	//Now load the file controller
-	file_controller_bytes, err := RetrieveFromDatastore(file_reference_primary.File_controller_pointer, file_reference_primary.File_enc_key, file_reference_primary.Hmac_key)
+// Locks a file for ttl, locking it again renews the lease. While the lease is held everything of other users
+// that changes the file fails with ErrLocked. The lock is advisory, everyone the file is shared with can read and break it,
+// and a lease that has expired is broken by whoever finds it
+func (userdata *User) LockFile(filename string, ttl time.Duration) error {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
+	//Update the userdata
+	userdata, err := getUserdata(userdata)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	err = json.Unmarshal(file_controller_bytes, &file_controller)
+	if ttl <= 0 {
+		return errors.New("a lease has to last for some time")
+	}
+	access, err := getFileAccess(userdata, filename)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	//We now have the file controller and can start loading all the parts of the file
-	//to see if there are more files in the list
-	var has_next bool
-	var content1 []byte
-	var next_uuid uuid.UUID
-	next_uuid = file_controller.Start
-	has_next = true
-	for has_next {
-		var file File
-		current_file_bytes, err := RetrieveFromDatastore(next_uuid, file_reference_primary.File_enc_key, file_reference_primary.Hmac_key)
+	if access.Is_directory {
+		return errors.New("only files can be locked")
+	}
+	//If another user takes the lease at the same time only one of them gets it
+	for attempt := 0; attempt < commit_attempts; attempt++ {
+		lease, sealed, err := loadFileLease(access)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		err = json.Unmarshal(current_file_bytes, &file)
-		if err != nil {
-			return nil, err
+		if lease != nil && lease.Holder != userdata.Username {
+			return lease.locked()
 		}
-		content1 = append(content1, file.Content...)
-		//Check if that was the end of the list
-		if file.Next_uuid == uuid.Nil {
-			has_next = false
-			break
+		lease = &FileLease{Holder: userdata.Username, Expires: time.Now().Add(ttl).UnixNano()}
+		err = storeFileLease(access, lease, sealed, metadataBucket(userdata.Privacy_mode))
+		if err == nil {
+			//Changes of others that checked the lease before it was taken cannot be committed anymore
+			return touchFileController(access)
+		}
+		if err != err_concurrent_change {
+			return err
 		}
-		next_uuid = file.Next_uuid
 	}
+	return err_concurrent_change
+}
 
-	return content1, err
+// Function to store a file controller again as it is. Everyone who loaded it before has to load it again
+// before committing a change
+func touchFileController(access FileAccess) (err error) {
+	for attempt := 0; attempt < commit_attempts; attempt++ {
+		var file_controller FileController
+		var sealed []byte
+		file_controller, sealed, err = loadFileController(access.Controller_uuid, access.Enc_key, access.Hmac_key)
+		if err != nil {
+			return err
+		}
+		err = commitFileController(access.Controller_uuid, access.Enc_key, access.Hmac_key, file_controller, sealed)
+		if err != err_concurrent_change {
+			return err
+		}
+	}
+	return err
 }
 
-func (userdata *User) CreateInvitation(filename string, recipientUsername string) (
-	invitationPtr uuid.UUID, err error) {
-	//Update the user as per usual
-	userdata, err = getUserdata(userdata)
+// Gives up the lease on a file before it expires
+func (userdata *User) UnlockFile(filename string) error {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
+	//Update the userdata
+	userdata, err := getUserdata(userdata)
 	if err != nil {
-		return uuid.Nil, err
+		return err
 	}
-	//First we find either the filereferenceowner or filereferencesecondary
-	//This depends on whether the sharer is the owner or not
-	//Compute the uuid of the file
-	var file_uuid_bytes []byte
-	file_uuid_bytes = append(file_uuid_bytes, userlib.Hash([]byte(userdata.Username))...)
-	file_uuid_bytes = append(file_uuid_bytes, userdata.Password...)
-	file_uuid_bytes = append(file_uuid_bytes, userlib.Hash([]byte(filename))...)
-	file_uuid, err := uuid.FromBytes(userlib.Hash(file_uuid_bytes)[:16])
+	access, err := getFileAccess(userdata, filename)
 	if err != nil {
-		return uuid.Nil, err
+		return err
+	}
+	if access.Is_directory {
+		return errors.New("only files can be locked")
+	}
+	for attempt := 0; attempt < commit_attempts; attempt++ {
+		lease, sealed, err := loadFileLease(access)
+		if err != nil {
+			return err
+		}
+		if lease == nil {
+			return errors.New("the file is not locked")
+		}
+		if lease.Holder != userdata.Username {
+			return lease.locked()
+		}
+		err = storeFileLease(access, nil, sealed, 0)
+		if err != err_concurrent_change {
+			return err
+		}
 	}
+	return err_concurrent_change
+}
 
-	//We then compute the hmac key of the file and the encryption key of the file
-	//Create the encryption key
-	encryption_key_64, err := userlib.HashKDF(userdata.master_key, []byte("Encryption key for file"+filename))
+// Where the lease of a file is stored
+func fileLeaseLocation(access FileAccess) (lease_uuid uuid.UUID, lease_encryption_key []byte, lease_hmac_key []byte, err error) {
+	lease_uuid, err = DeriveUUID(label_file_lease_uuid, access.Controller_uuid[:])
 	if err != nil {
-		return uuid.Nil, err
+		return lease_uuid, nil, nil, err
 	}
-	encryption_key := encryption_key_64[:16]
-	//Create the HMAC key
-	hmac_key_64, err := userlib.HashKDF(userdata.master_key, []byte("HMAC key for file"+filename))
+	lease_encryption_key, err = DeriveKey(access.Enc_key, label_file_lease_encryption_key)
 	if err != nil {
-		return uuid.Nil, err
+		return lease_uuid, nil, nil, err
 	}
-	hmac_key := hmac_key_64[:16]
-
-	//we now retrieve the content of the filereferenceowner or filereferencesecondary
-	//If the user owns the file
-	uuid_check, err := uuid.FromBytes(userlib.Hash([]byte(filename))[:16])
+	lease_hmac_key, err = DeriveKey(access.Hmac_key, label_file_lease_hmac_key)
 	if err != nil {
-		return uuid.Nil, err
+		return lease_uuid, nil, nil, err
 	}
-	owns_file := userdata.Files_owned[uuid_check]
-	var invitation Invitation
-	if owns_file {
-		//Retrieve the filereferenceowner
-		var file_reference_owner FileReferenceOwner
-		var new_file_reference_primary FileReferencePrimary
+	return lease_uuid, lease_encryption_key, lease_hmac_key, nil
+}
 
-		file_reference_owner_bytes, err := RetrieveFromDatastore(file_uuid, encryption_key, hmac_key)
-		if err != nil {
-			return uuid.Nil, err
+// Function to load the lease of a file together with the sealed bytes it is stored as, nil if the file is not locked.
+// A lease that has expired is broken here
+func loadFileLease(access FileAccess) (lease *FileLease, sealed []byte, err error) {
+	lease_uuid, lease_encryption_key, lease_hmac_key, err := fileLeaseLocation(access)
+	if err != nil {
+		return nil, nil, err
+	}
+	for attempt := 0; attempt < commit_attempts; attempt++ {
+		sealed, ok := datastoreGet(lease_uuid)
+		if !ok {
+			return nil, nil, nil
 		}
-		//Unmarshal
-		err = json.Unmarshal(file_reference_owner_bytes, &file_reference_owner)
+		lease_bytes, err := openSealed(lease_uuid, lease_encryption_key, lease_hmac_key, sealed)
 		if err != nil {
-			return uuid.Nil, err
+			return nil, nil, err
 		}
-		//Create a new filereferenceprimary
-		//This has all the same information as is in the filereferenceowner
-		new_file_reference_primary.File_controller_pointer = file_reference_owner.File_controller_pointer
-		new_file_reference_primary.File_enc_key = file_reference_owner.File_enc_key
-		new_file_reference_primary.Hmac_key = file_reference_owner.Hmac_key
-
-		//Create the encryption keys for this filereferenceprimary
-		file_reference_primary_encryption_key := userlib.RandomBytes(16)
-		file_reference_primary_hmac_key_64, err := userlib.HashKDF(file_reference_primary_encryption_key, []byte("hmac key from encryption key of new filereferenceprimary"))
-		file_reference_primary_hmac_key := file_reference_primary_hmac_key_64[:16]
+		lease = &FileLease{}
+		err = UnmarshalObject(lease_bytes, lease)
 		if err != nil {
-			return uuid.Nil, err
+			return nil, nil, err
 		}
-		//Create the uuid of the new file reference primary
-		new_file_reference_primary_uuid, err := uuid.FromBytes(userlib.Hash(file_reference_primary_encryption_key)[:16])
-		if err != nil {
-			return uuid.Nil, err
+		if time.Now().UnixNano() < lease.Expires {
+			return lease, sealed, nil
 		}
-		//Check if the person already has access
-		_, ok := file_reference_owner.Uuid_shared_with[recipientUsername]
-		if ok {
-			return uuid.Nil, errors.New("this user already has access")
+		//Unless someone has just taken the lease again it is gone now
+		if datastoreCompareAndSwap(lease_uuid, sealed, nil) {
+			return nil, nil, nil
 		}
-		//Now we store all this information in the filereferenceowner shared with
-		file_reference_owner.Uuid_shared_with[recipientUsername] = new_file_reference_primary_uuid
-		file_reference_owner.Enc_keys_shared_with[recipientUsername] = file_reference_primary_encryption_key
-		file_reference_owner.Hmac_keys_shared_with[recipientUsername] = file_reference_primary_hmac_key
+	}
+	return nil, nil, err_concurrent_change
+}
 
-		//Send this to the datastore
-		//Send the filereferenceowner back to the same place
-		err = SendToDatastore(file_uuid, encryption_key, hmac_key, file_reference_owner)
+// Function to store the lease of a file, or remove it if lease is nil, if it is still stored as sealed
+func storeFileLease(access FileAccess, lease *FileLease, sealed []byte, bucket_size int) error {
+	lease_uuid, lease_encryption_key, lease_hmac_key, err := fileLeaseLocation(access)
+	if err != nil {
+		return err
+	}
+	var new_sealed []byte
+	if lease != nil {
+		lease_bytes, err := MarshalObject(*lease)
 		if err != nil {
-			return uuid.Nil, err
+			return err
 		}
-		//Send the new filereferenceprimary to the new uuid created
-		err = SendToDatastore(new_file_reference_primary_uuid, file_reference_primary_encryption_key, file_reference_primary_hmac_key, new_file_reference_primary)
+		new_sealed, err = sealBytes(lease_uuid, lease_encryption_key, lease_hmac_key, lease_bytes, bucket_size)
 		if err != nil {
-			return uuid.Nil, err
+			return err
 		}
-		//Now we can create the invitation
-		invitation_uuid := uuid.New()
-		invitation.FRPdk = file_reference_primary_encryption_key
-		invitation.FRPhmk = file_reference_primary_hmac_key
+	}
+	if !datastoreCompareAndSwap(lease_uuid, sealed, new_sealed) {
+		return err_concurrent_change
+	}
+	return nil
+}
 
-		//Then we need to encrypt it and also sign it
-		invitation_bytes, err := json.Marshal(invitation)
-		if err != nil {
-			return uuid.Nil, err
+// Function to check that no other user holds the lease of a file before it is changed. It is checked every time
+// after the file controller is loaded for the change. LockFile stores the file controller again after it takes the
+// lease, so if the lease is taken after the check the change cannot be committed and the lease is checked again
+func checkFileLease(access FileAccess, username string) error {
+	lease, _, err := loadFileLease(access)
+	if err != nil {
+		return err
+	}
+	if lease != nil && lease.Holder != username {
+		return lease.locked()
+	}
+	return nil
+}
+
+// Function to move the lease of a file along with its file controller. A lease of a user that loses access is dropped
+func moveFileLease(old_access FileAccess, new_access FileAccess, revoked []string, bucket_size int) error {
+	lease, sealed, err := loadFileLease(old_access)
+	if err != nil || lease == nil {
+		return err
+	}
+	err = storeFileLease(old_access, nil, sealed, 0)
+	if err != nil {
+		return err
+	}
+	for _, username := range revoked {
+		if lease.Holder == username {
+			return nil
 		}
-		//Now we fetch the public key of the recipient
-		user_uuid := "Public key for:" + recipientUsername
-		recipient_public_key, ok := userlib.KeystoreGet(user_uuid)
-		if !ok {
-			return uuid.Nil, errors.New("the recipient does not exist")
+	}
+	return storeFileLease(new_access, lease, nil, bucket_size)
+}
+
+func (lease *FileLease) locked() error {
+	return &ErrLocked{Holder: lease.Holder, Expires: time.Unix(0, lease.Expires)}
+}
+
+// Creates a new directory. A path without a "/" creates a directory in the namespace of the user
+// that can be shared like a file, otherwise the directory is created inside its parent directory
+func (userdata *User) Mkdir(path string) error {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
+	//Update the userdata
+	userdata, err := getUserdata(userdata)
+	if err != nil {
+		return err
+	}
+	var new_directory Directory
+	new_directory.Entries = make(map[string]DirectoryEntry)
+
+	parent, directory, name, is_path, err := getParentDirectory(userdata, path)
+	if err != nil {
+		return err
+	}
+	if is_path {
+		_, ok := directory.Entries[name]
+		if ok {
+			return errors.New("there is already a file or directory with that name")
 		}
-		//Encrypt it
-		invitation_bytes_encrypted, err := userlib.PKEEnc(recipient_public_key, invitation_bytes)
+		var entry DirectoryEntry
+		entry.Is_directory = true
+		entry.Pointer = uuid.New()
+		entry.Enc_key = userlib.RandomBytes(16)
+		entry.Hmac_key = userlib.RandomBytes(16)
+		err = SendToDatastorePadded(entry.Pointer, entry.Enc_key, entry.Hmac_key, new_directory, metadataBucket(userdata.Privacy_mode))
 		if err != nil {
-			return uuid.Nil, err
+			return err
+		}
+		//Another session might have added the name in the meantime
+		_, found, err := addDirectoryEntry(parent, name, entry, metadataBucket(userdata.Privacy_mode))
+		if err == nil && found {
+			err = errors.New("there is already a file or directory with that name")
 		}
-		//Sign it
-		invitation_bytes_encrypted_signature, err := userlib.DSSign(userdata.Signature_private_key, invitation_bytes_encrypted)
 		if err != nil {
-			return uuid.Nil, err
+			//Nothing points to the new directory
+			datastoreDelete(entry.Pointer)
 		}
-		//Append signature
-		invitation_bytes_encrypted_signed := append(invitation_bytes_encrypted, invitation_bytes_encrypted_signature...)
-		//Store it
-		userlib.DatastoreSet(invitation_uuid, invitation_bytes_encrypted_signed)
-
-		return invitation_uuid, err
+		return err
+	}
+	if strings.Contains(path, "/") {
+		return errors.New("the parent directory does not exist")
+	}
+	//Flat files named like "path/..." could not be found anymore once path is a directory
+	if userdata.Path_prefixes[path] {
+		return errors.New("there are already files whose names start with " + path + "/")
 	}
 
-	//If the sharer is not the owner
-	if !owns_file {
-		//We now instead find the filereferencesecondary at the file uuid
-		//This is used to access the filereferenceprimary
-		var file_reference_secondary FileReferenceSecondary
-		var file_reference_primary FileReferencePrimary
+	//A directory at the top is owned exactly like a file, the filereferenceowner just points to a directory
+	file_uuid, encryption_key, hmac_key, err := getFileReference(userdata, path)
+	if err != nil {
+		return err
+	}
+	_, ok := datastoreGet(file_uuid)
+	if ok {
+		return errors.New("there is already a file or directory with that name")
+	}
+
+	//Update the userdata with the new directory owned
+	uuid_check, err := ownedFileID(path)
+	if err != nil {
+		return err
+	}
+	userdata.Files_owned[uuid_check] = true
+	err = UploadUserdata(userdata)
+	if err != nil {
+		return err
+	}
+
+	var file_reference_owner FileReferenceOwner
+	file_reference_owner.Is_directory = true
+	file_reference_owner.File_enc_key = userlib.RandomBytes(16)
+	file_reference_owner.Hmac_key = userlib.RandomBytes(16)
+	file_reference_owner.File_controller_pointer = uuid.New()
+	err = SendToDatastorePadded(file_uuid, encryption_key, hmac_key, file_reference_owner, metadataBucket(userdata.Privacy_mode))
+	if err != nil {
+		return err
+	}
+	return SendToDatastorePadded(file_reference_owner.File_controller_pointer, file_reference_owner.File_enc_key, file_reference_owner.Hmac_key, new_directory, metadataBucket(userdata.Privacy_mode))
+}
+
+// Function to remember the part of a flat filename before the first "/", so Mkdir does not hide the file
+// behind a directory of that name. Gives whether the userdata changed and has to be uploaded
+func addPathPrefix(userdata *User, filename string) bool {
+	if !strings.Contains(filename, "/") {
+		return false
+	}
+	prefix := strings.SplitN(filename, "/", 2)[0]
+	if userdata.Path_prefixes[prefix] {
+		return false
+	}
+	if userdata.Path_prefixes == nil {
+		userdata.Path_prefixes = make(map[string]bool)
+	}
+	userdata.Path_prefixes[prefix] = true
+	return true
+}
+
+// Lists the names in a directory in sorted order. Names of subdirectories end with a "/"
+func (userdata *User) ListDir(path string) (names []string, err error) {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
+	//Update the userdata
+	userdata, err = getUserdata(userdata)
+	if err != nil {
+		return nil, err
+	}
+	access, err := getFileAccess(userdata, path)
+	if err != nil {
+		return nil, err
+	}
+	if !access.Is_directory {
+		return nil, errors.New("that is a file and not a directory")
+	}
+	directory, err := LoadDirectory(access)
+	if err != nil {
+		return nil, err
+	}
+	names = make([]string, 0, len(directory.Entries))
+	for name, entry := range directory.Entries {
+		if entry.Is_directory {
+			name = name + "/"
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (userdata *User) CreateInvitation(filename string, recipientUsername string) (
+	invitationPtr uuid.UUID, err error) {
+	//Sharing with a single user is just a batch of one
+	invitations, err := userdata.CreateInvitations(filename, []string{recipientUsername})
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return invitations[recipientUsername], nil
+}
 
-		file_reference_secondary_bytes, err := RetrieveFromDatastore(file_uuid, encryption_key, hmac_key)
+// Shares a file with many recipients at once. The filereferenceowner (or filereferencesecondary)
+// is only loaded and stored a single time no matter how many recipients there are
+func (userdata *User) CreateInvitations(filename string, recipientUsernames []string) (
+	invitationPtrs map[string]uuid.UUID, err error) {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
+	//Update the user as per usual
+	userdata, err = getUserdata(userdata)
+	if err != nil {
+		return nil, err
+	}
+	//Check all the recipients before anything is changed in the datastore
+	//so a bad recipient in the middle of the list does not leave a half shared file
+	//Only files and directories at the top of the namespace of the user can be shared
+	_, _, _, is_path, err := getParentDirectory(userdata, filename)
+	if err != nil {
+		return nil, err
+	}
+	if is_path {
+		return nil, errors.New("only files and directories at the top can be shared")
+	}
+	recipient_public_keys := make(map[string]userlib.PKEEncKey)
+	recipient_key_versions := make(map[string]int)
+	for _, recipient := range recipientUsernames {
+		_, duplicate := recipient_public_keys[recipient]
+		if duplicate {
+			return nil, errors.New("the same recipient was given more than once")
+		}
+		//The keys are checked against the contact book so a swapped key is noticed
+		recipient_key_version, recipient_public_key, _, err := pinnedPublicKeys(userdata, recipient)
 		if err != nil {
-			return uuid.Nil, err
+			return nil, err
 		}
-		//Unmarshal
-		err = json.Unmarshal(file_reference_secondary_bytes, &file_reference_secondary)
+		recipient_public_keys[recipient] = recipient_public_key
+		recipient_key_versions[recipient] = recipient_key_version
+	}
+	//First we find either the filereferenceowner or filereferencesecondary
+	//This depends on whether the sharer is the owner or not
+	//Compute the uuid of the file together with the encryption key and hmac key of the reference
+	file_uuid, encryption_key, hmac_key, err := getFileReference(userdata, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	//we now retrieve the content of the filereferenceowner or filereferencesecondary
+	//If the user owns the file
+	uuid_check, err := ownedFileID(filename)
+	if err != nil {
+		return nil, err
+	}
+	owns_file := userdata.Files_owned[uuid_check]
+	invitationPtrs = make(map[string]uuid.UUID)
+	//If sharing fails part of the way, the references and invitations that were already stored
+	//point to nothing anyone will use, so they are deleted again, and the recipients are taken
+	//out of the sharing again if they were put in it
+	var stored_uuids []uuid.UUID
+	sent_invitations := make(map[string]uuid.UUID)
+	var shared func()
+	defer func() {
 		if err != nil {
-			return uuid.Nil, err
+			for _, stored_uuid := range stored_uuids {
+				datastoreDelete(stored_uuid)
+			}
+			for recipient, invitation_uuid := range sent_invitations {
+				deleteInvitation(recipient, invitation_uuid)
+			}
+			if shared != nil {
+				shared()
+			}
 		}
+	}()
+	if owns_file {
+		//Retrieve the filereferenceowner
+		var file_reference_owner FileReferenceOwner
 
-		//Load the filereferenceprimary
-		file_reference_primary_bytes, err := RetrieveFromDatastore(file_reference_secondary.File_reference_primary_pointer, file_reference_secondary.File_Reference_Primary_enc_key, file_reference_secondary.Hmac_key)
+		file_reference_owner_bytes, err := RetrieveFromDatastore(file_uuid, encryption_key, hmac_key)
 		if err != nil {
-			return uuid.Nil, err
+			return nil, err
 		}
 		//Unmarshal
-		err = json.Unmarshal(file_reference_primary_bytes, &file_reference_primary)
+		err = UnmarshalObject(file_reference_owner_bytes, &file_reference_owner)
 		if err != nil {
-			return uuid.Nil, err
+			return nil, err
 		}
-
-		//Create the invitation
-		invitation_uuid := uuid.New()
-		invitation.FRPdk = file_reference_secondary.File_Reference_Primary_enc_key
-		invitation.FRPhmk = file_reference_secondary.Hmac_key
-
-		//Then we need to encrypt it and also sign it
-		invitation_bytes, err := json.Marshal(invitation)
+		//Who the file is shared with is stored on its own
+		sharing, err := loadFileSharing(file_uuid, encryption_key, file_reference_owner)
 		if err != nil {
-			return uuid.Nil, err
+			return nil, err
 		}
-		//Now we fetch the public key of the recipient
-		user_uuid := "Public key for:" + recipientUsername
-		recipient_public_key, ok := userlib.KeystoreGet(user_uuid)
-		if !ok {
-			return uuid.Nil, errors.New("the recipient does not exist")
+		//Check if any of the recipients already has access
+		for _, recipient := range recipientUsernames {
+			_, ok := sharing.Uuid_shared_with[recipient]
+			if ok {
+				return nil, errors.New("this user already has access")
+			}
 		}
-		//Encrypt it
-		invitation_bytes_encrypted, err := userlib.PKEEnc(recipient_public_key, invitation_bytes)
-		if err != nil {
-			return uuid.Nil, err
+		added := FileSharing{
+			Uuid_shared_with:        make(map[string]uuid.UUID),
+			Enc_keys_shared_with:    make(map[string][]byte),
+			Hmac_keys_shared_with:   make(map[string][]byte),
+			Invitations_shared_with: make(map[string]uuid.UUID),
 		}
-		//Sign it
-		invitation_bytes_encrypted_signature, err := userlib.DSSign(userdata.Signature_private_key, invitation_bytes_encrypted)
+		for _, recipient := range recipientUsernames {
+			//Create a new filereferenceprimary for every recipient
+			//This has all the same information as is in the filereferenceowner
+			var new_file_reference_primary FileReferencePrimary
+			new_file_reference_primary.Is_directory = file_reference_owner.Is_directory
+			new_file_reference_primary.File_controller_pointer = file_reference_owner.File_controller_pointer
+			new_file_reference_primary.File_enc_key = file_reference_owner.File_enc_key
+			new_file_reference_primary.Hmac_key = file_reference_owner.Hmac_key
+
+			//Create the encryption keys for this filereferenceprimary
+			file_reference_primary_encryption_key := userlib.RandomBytes(16)
+			file_reference_primary_hmac_key, err := DeriveKey(file_reference_primary_encryption_key, label_primary_hmac_key)
+			if err != nil {
+				return nil, err
+			}
+			//Create the uuid of the new file reference primary
+			new_file_reference_primary_uuid, err := DeriveUUID(label_primary_uuid, file_reference_primary_encryption_key)
+			if err != nil {
+				return nil, err
+			}
+			//Now we store all this information in the sharing of the file
+			added.Uuid_shared_with[recipient] = new_file_reference_primary_uuid
+			added.Enc_keys_shared_with[recipient] = file_reference_primary_encryption_key
+			added.Hmac_keys_shared_with[recipient] = file_reference_primary_hmac_key
+
+			//Send the new filereferenceprimary to the new uuid created
+			err = SendToDatastorePadded(new_file_reference_primary_uuid, file_reference_primary_encryption_key, file_reference_primary_hmac_key, new_file_reference_primary, metadataBucket(userdata.Privacy_mode))
+			if err != nil {
+				return nil, err
+			}
+			stored_uuids = append(stored_uuids, new_file_reference_primary_uuid)
+			//Now we can create the invitation
+			var invitation Invitation
+			invitation.FRPdk = file_reference_primary_encryption_key
+			invitation.FRPhmk = file_reference_primary_hmac_key
+			invitation_uuid, err := SendInvitation(userdata, recipient, recipient_public_keys[recipient], recipient_key_versions[recipient], invitation)
+			if err != nil {
+				return nil, err
+			}
+			sent_invitations[recipient] = invitation_uuid
+			invitationPtrs[recipient] = invitation_uuid
+			//The invitation is remembered so it can be deleted if the recipient is revoked before accepting
+			added.Invitations_shared_with[recipient] = invitation_uuid
+		}
+		//Add the recipients to the sharing, only once for the whole batch. The filereferenceowner is only
+		//stored again if the sharing was still in it
+		sharing_stored := file_reference_owner.Sharing_stored
+		err = updateFileSharing(file_uuid, encryption_key, &file_reference_owner, added, nil, metadataBucket(userdata.Privacy_mode))
 		if err != nil {
-			return uuid.Nil, err
+			return nil, err
 		}
-		//Append signature
-		invitation_bytes_encrypted_signed := append(invitation_bytes_encrypted, invitation_bytes_encrypted_signature...)
-		//Store it
-		userlib.DatastoreSet(invitation_uuid, invitation_bytes_encrypted_signed)
+		shared = func() {
+			//If this fails too the recipients stay in the sharing, revoking them deletes what is left
+			_ = updateFileSharing(file_uuid, encryption_key, &file_reference_owner, FileSharing{}, recipientUsernames, metadataBucket(userdata.Privacy_mode))
+		}
+		if !sharing_stored {
+			err = SendToDatastorePadded(file_uuid, encryption_key, hmac_key, file_reference_owner, metadataBucket(userdata.Privacy_mode))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return invitationPtrs, nil
+	}
+
+	//If the sharer is not the owner
+	//We now instead find the filereferencesecondary at the file uuid
+	//This is used to access the filereferenceprimary
+	var file_reference_secondary FileReferenceSecondary
+	var file_reference_primary FileReferencePrimary
+
+	file_reference_secondary_bytes, err := RetrieveFromDatastore(file_uuid, encryption_key, hmac_key)
+	if err != nil {
+		return nil, err
+	}
+	//Unmarshal
+	err = UnmarshalObject(file_reference_secondary_bytes, &file_reference_secondary)
+	if err != nil {
+		return nil, err
+	}
+
+	//Load the filereferenceprimary, this fails if our access has been revoked
+	file_reference_primary_bytes, err := RetrieveFromDatastore(file_reference_secondary.File_reference_primary_pointer, file_reference_secondary.File_Reference_Primary_enc_key, file_reference_secondary.Hmac_key)
+	if err != nil {
+		return nil, err
+	}
+	//Unmarshal
+	err = UnmarshalObject(file_reference_primary_bytes, &file_reference_primary)
+	if err != nil {
+		return nil, err
+	}
 
-		return invitation_uuid, err
+	//Every recipient gets an invitation to the same filereferenceprimary as us
+	for _, recipient := range recipientUsernames {
+		var invitation Invitation
+		invitation.FRPdk = file_reference_secondary.File_Reference_Primary_enc_key
+		invitation.FRPhmk = file_reference_secondary.Hmac_key
+		invitation_uuid, err := SendInvitation(userdata, recipient, recipient_public_keys[recipient], recipient_key_versions[recipient], invitation)
+		if err != nil {
+			return nil, err
+		}
+		sent_invitations[recipient] = invitation_uuid
+		invitationPtrs[recipient] = invitation_uuid
 	}
-	return uuid.Nil, err
+	return invitationPtrs, nil
 }
 
 func (userdata *User) AcceptInvitation(senderUsername string, invitationPtr uuid.UUID, filename string) error {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
 	var invitation Invitation
 	//Update userdata
 	userdata, err := getUserdata(userdata)
 	if err != nil {
 		return err
 	}
+	//Shared files can only be accepted at the top of the namespace of the user
+	_, _, _, is_path, err := getParentDirectory(userdata, filename)
+	if err != nil {
+		return err
+	}
+	if is_path {
+		return errors.New("an invitation cannot be accepted inside a directory")
+	}
 	//Check if the user already has access to the file
 	//This will also return an error if the user has been revoked
 	//Compute the uuid of the file
-	var file_uuid_bytes []byte
-	file_uuid_bytes = append(file_uuid_bytes, userlib.Hash([]byte(userdata.Username))...)
-	file_uuid_bytes = append(file_uuid_bytes, userdata.Password...)
-	file_uuid_bytes = append(file_uuid_bytes, userlib.Hash([]byte(filename))...)
-	file_uuid, err := uuid.FromBytes(userlib.Hash(file_uuid_bytes)[:16])
+	file_uuid, encryption_key, hmac_key, err := getFileReference(userdata, filename)
 	if err != nil {
 		return err
 	}
-	_, ok := userlib.DatastoreGet(file_uuid)
+	_, ok := datastoreGet(file_uuid)
 	if ok {
 		return errors.New("the user already has access to that file")
 	}
 	//Compute the authenticity of the invitation
-	//Find the public signature key of the sender
-	user_signature_key_keystore := "Signature key for:" + senderUsername
-	senders_public_sign_key, ok := userlib.KeystoreGet(user_signature_key_keystore)
-	if !ok {
-		return errors.New("there were no signature key for the sender")
+	//The keys of the sender are checked against the contact book, this also follows key rotations of the sender
+	sender_key_version, _, _, err := pinnedPublicKeys(userdata, senderUsername)
+	if err != nil {
+		return err
 	}
 	//retrieve the invitation
-	invitation_bytes_encrypted_signed, ok := userlib.DatastoreGet(invitationPtr)
+	invitation_bytes_encrypted_signed, ok := datastoreGet(invitationPtr)
 	if !ok {
 		return errors.New("could not find the invitation")
 	}
+	//The signature is the last 256 bytes
+	if len(invitation_bytes_encrypted_signed) <= 256 {
+		return errors.New("the invitation is too short")
+	}
 	invitation_signature := invitation_bytes_encrypted_signed[len(invitation_bytes_encrypted_signed)-256:]
-	//Check the signature
 	invitation_bytes_encrypted := invitation_bytes_encrypted_signed[:len(invitation_bytes_encrypted_signed)-256]
+	//Find which keys were used
+	header, header_bytes, invitation_body, err := parseInvitationHeader(invitation_bytes_encrypted)
+	if err != nil {
+		return err
+	}
+	if header.Sender_version > sender_key_version {
+		return errors.New("the invitation was signed with a key the sender does not have")
+	}
+	//Check the signature, the header is signed too
+	_, senders_public_sign_key, err := publicKeysAt(senderUsername, header.Sender_version)
+	if err != nil {
+		return err
+	}
 	err = userlib.DSVerify(senders_public_sign_key, invitation_bytes_encrypted, invitation_signature)
 	if err != nil {
 		return err
 	}
-	//Decrypt
-	invitation_bytes, err := userlib.PKEDec(userdata.Secret_key, invitation_bytes_encrypted)
+	//Decrypt with the version of our key it was encrypted for and the prekey
+	invitation_bytes, err := openInvitation(userdata, header, header_bytes, invitation_body)
 	if err != nil {
 		return err
 	}
 	//Unmarshal
-	err = json.Unmarshal(invitation_bytes, &invitation)
+	err = UnmarshalObject(invitation_bytes, &invitation)
 	if err != nil {
 		return err
 	}
+	//The prekey is forgotten right away, nobody can decrypt the invitation after this
+	if header.Prekey_id != uuid.Nil {
+		err = consumePrekey(userdata, header.Prekey_id)
+		if err != nil {
+			return err
+		}
+	}
 	//If the sharer is not someone that owns the file the file might have been revoked
 	//This also checks if someone that the file has been shared with twice but then revoked can accept it or not
 	//Therefore, we check if the filereferenceprimary still exists
 	//The uuid is the uuid for the new filereferenceprimary created in the accept invitation
-	file_reference_owner_uuid, err := uuid.FromBytes(userlib.Hash(invitation.FRPdk)[:16])
+	file_reference_primary_uuid, err := DeriveUUID(label_primary_uuid, invitation.FRPdk)
 	if err != nil {
 		return err
 	}
-	_, ok = userlib.DatastoreGet(file_reference_owner_uuid)
+	_, ok = datastoreGet(file_reference_primary_uuid)
+	if !ok {
+		//Invitations sent before the labeled key derivation point to a filereferenceprimary at the old uuid
+		file_reference_primary_uuid, err = uuid.FromBytes(userlib.Hash(invitation.FRPdk)[:16])
+		if err != nil {
+			return err
+		}
+		_, ok = datastoreGet(file_reference_primary_uuid)
+	}
 	if !ok {
 		return errors.New("the sender's access has been revoked or your access has been revoked")
 	}
@@ -1259,50 +1496,67 @@ func (userdata *User) AcceptInvitation(senderUsername string, invitationPtr uuid
 	var file_reference_secondary FileReferenceSecondary
 	file_reference_secondary.File_Reference_Primary_enc_key = invitation.FRPdk
 	file_reference_secondary.Hmac_key = invitation.FRPhmk
-	file_reference_secondary.File_reference_primary_pointer, err = uuid.FromBytes(userlib.Hash(invitation.FRPdk)[:16])
-	if err != nil {
-		return err
+	file_reference_secondary.File_reference_primary_pointer = file_reference_primary_uuid
+	//A flat filename with a "/" keeps a directory from taking the part before it
+	if addPathPrefix(userdata, filename) {
+		err = UploadUserdata(userdata)
+		if err != nil {
+			return err
+		}
 	}
 	//We now have everything that we need to get access to the file and can store our filereferenceprimary
-	//Create the encryption key
-	encryption_key_64, err := userlib.HashKDF(userdata.master_key, []byte("Encryption key for file"+filename))
-	if err != nil {
-		return err
-	}
-	encryption_key := encryption_key_64[:16]
-	//Create the HMAC key
-	hmac_key_64, err := userlib.HashKDF(userdata.master_key, []byte("HMAC key for file"+filename))
-	if err != nil {
-		return err
-	}
-	hmac_key := hmac_key_64[:16]
-	//Marshal it
-	file_reference_secondary_bytes, err := json.Marshal(file_reference_secondary)
-	if err != nil {
-		return err
-	}
-	//Encrypt it
-	iv := userlib.RandomBytes(16)
-	file_reference_secondary_bytes_encrypted := userlib.SymEnc(encryption_key, iv, file_reference_secondary_bytes)
-	//Hmac it
-	file_reference_secondary_hmac, err := userlib.HMACEval(hmac_key, file_reference_secondary_bytes_encrypted)
+	//Store it
+	err = SendToDatastorePadded(file_uuid, encryption_key, hmac_key, file_reference_secondary, metadataBucket(userdata.Privacy_mode))
 	if err != nil {
 		return err
 	}
-	file_reference_secondary_bytes_encrypted_hmac := append(file_reference_secondary_bytes_encrypted, file_reference_secondary_hmac...)
-	//Store it
-	userlib.DatastoreSet(file_uuid, file_reference_secondary_bytes_encrypted_hmac)
+	userdata.cache.addReference(file_uuid, file_reference_secondary)
+	//The invitation is not needed anymore once it has been accepted
+	datastoreDelete(invitationPtr)
 	return nil
 }
 
 func (userdata *User) RevokeAccess(filename string, recipientUsername string) error {
+	//Revoking a single user is just a batch of one
+	return userdata.RevokeMany(filename, []string{recipientUsername})
+}
+
+// Revokes many users at once. The file is only re-encrypted and the remaining
+// filereferenceprimaries only rewritten a single time for the whole batch.
+// A batch that fails leaves every recipient with access, unless only deleting the old file failed
+func (userdata *User) RevokeMany(filename string, recipientUsernames []string) error {
+	return userdata.revokeMany(filename, recipientUsernames, false)
+}
+
+// Lazy version of RevokeAccess. Only the file controller is moved to a new epoch key,
+// the old files stay encrypted under the old keys until ReencryptFile or the next StoreFile
+func (userdata *User) RevokeAccessLazy(filename string, recipientUsername string) error {
+	return userdata.revokeMany(filename, []string{recipientUsername}, true)
+}
+
+// Lazy version of RevokeMany
+func (userdata *User) RevokeManyLazy(filename string, recipientUsernames []string) error {
+	return userdata.revokeMany(filename, recipientUsernames, true)
+}
+
+func (userdata *User) revokeMany(filename string, recipientUsernames []string, lazy bool) error {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
+	//A name given more than once is only revoked once
+	recipientUsernames = uniqueNames(recipientUsernames)
 	//Update the userdata
 	userdata, err := getUserdata(userdata)
 	if err != nil {
 		return err
 	}
+	//Compute the uuid and the keys of the filereferenceowner
+	//This is done first as it also moves over references stored under the old key derivation
+	file_uuid, encryption_key, hmac_key, err := getFileReference(userdata, filename)
+	if err != nil {
+		return err
+	}
 	//Check if the user owns the file
-	uuid_check, err := uuid.FromBytes(userlib.Hash([]byte(filename))[:16])
+	uuid_check, err := ownedFileID(filename)
 	if err != nil {
 		return err
 	}
@@ -1310,285 +1564,5062 @@ func (userdata *User) RevokeAccess(filename string, recipientUsername string) er
 	if !owns_file {
 		return errors.New("you cannot revoke access as you are not the owner of this file")
 	}
-	//Before anything else, download all the old content while it is possible
-	content, err := userdata.LoadFile(filename)
-	if err != nil {
-		return err
-	}
-	//Compute the uuid
-	var file_uuid_bytes []byte
-	file_uuid_bytes = append(file_uuid_bytes, userlib.Hash([]byte(userdata.Username))...)
-	file_uuid_bytes = append(file_uuid_bytes, userdata.Password...)
-	file_uuid_bytes = append(file_uuid_bytes, userlib.Hash([]byte(filename))...)
-	file_uuid, err := uuid.FromBytes(userlib.Hash(file_uuid_bytes)[:16])
-	if err != nil {
-		return err
-	}
 	var file_reference_owner FileReferenceOwner
-	//Compute hmac key and encryption key of the filereferenceowner
-	//Create the encryption key
-	encryption_key_64, err := userlib.HashKDF(userdata.master_key, []byte("Encryption key for file"+filename))
+	//Open filerefernceowner
+	file_reference_owner_bytes, err := RetrieveFromDatastore(file_uuid, encryption_key, hmac_key)
 	if err != nil {
 		return err
 	}
-	encryption_key := encryption_key_64[:16]
-	//Create the HMAC key
-	hmac_key_64, err := userlib.HashKDF(userdata.master_key, []byte("HMAC key for file"+filename))
+	//Unmarshal it
+	err = UnmarshalObject(file_reference_owner_bytes, &file_reference_owner)
 	if err != nil {
 		return err
 	}
-	hmac_key := hmac_key_64[:16]
-	//Open filerefernceowner
-	file_reference_owner_bytes, err := RetrieveFromDatastore(file_uuid, encryption_key, hmac_key)
+	//We now have access to the filereferenceowner struct for the file and who it is shared with
+	sharing, err := loadFileSharing(file_uuid, encryption_key, file_reference_owner)
 	if err != nil {
 		return err
 	}
-	//Unmarshal it
-	err = json.Unmarshal(file_reference_owner_bytes, &file_reference_owner)
-	if err != nil {
-		return err
+	//Check if the user shared the file directly with every person before deleting anything
+	for _, recipient := range recipientUsernames {
+		_, ok := sharing.Uuid_shared_with[recipient]
+		if !ok {
+			return errors.New("the file is not directly shared with that user or not shared at all")
+		}
 	}
-	//We now have access to the filereferenceowner struct for the file
-	//Check if the user shared the file directly with the person
-	_, ok := file_reference_owner.Uuid_shared_with[recipientUsername]
-	if !ok {
-		return errors.New("the file is not directly shared with that user or not shared at all")
-	}
-	//Now we delete the filereferenceprimary associated with this user
-	old_file_reference_primary_uuid := file_reference_owner.Uuid_shared_with[recipientUsername]
-	userlib.DatastoreDelete(old_file_reference_primary_uuid)
-	//Delete all the information for the user in the shared with attributes
-	delete(file_reference_owner.Enc_keys_shared_with, recipientUsername)
-	delete(file_reference_owner.Hmac_keys_shared_with, recipientUsername)
-	delete(file_reference_owner.Uuid_shared_with, recipientUsername)
-	//Relocate and encrypt the file with new hmac and encryption keys
-
-	new_file_controller_uuid := uuid.New()
-	new_file_reference_primary_hmac_key := userlib.RandomBytes(16)
-	new_file_reference_primary_encryption_key := userlib.RandomBytes(16)
-
-	//We now update all the other people that should still have access to it with the new FRP
-	for i, element := range file_reference_owner.Uuid_shared_with {
-		var new_file_reference_primary FileReferencePrimary
-		//Retrieve old filereferenceprimary
-		old_file_reference_primary_bytes, err := RetrieveFromDatastore(file_reference_owner.Uuid_shared_with[i], file_reference_owner.Enc_keys_shared_with[i], file_reference_owner.Hmac_keys_shared_with[i])
+	if file_reference_owner.Is_directory && lazy {
+		return errors.New("directories cannot be revoked lazily")
+	}
+	//Everything that can fail is done before anyone with access sees a change. The content, the old file controller
+	//and the filereferenceprimaries of everyone who keeps access are loaded first and the new file controller
+	//(or directory) is stored at new uuids. Only then is everyone moved over, which only stores what is already
+	//loaded, and the old objects nobody uses anymore are deleted. A failure before that changes nothing for anyone,
+	//a failure while deleting the old objects is given but every recipient has been revoked by then
+	//Download all the old content while it is possible. This is not needed when revoking lazily as the old files
+	//are kept where they are, and directories are moved one entry at a time
+	var content []byte
+	if !lazy && !file_reference_owner.Is_directory {
+		content, err = userdata.loadFile(filename)
 		if err != nil {
 			return err
 		}
-		err = json.Unmarshal(old_file_reference_primary_bytes, &new_file_reference_primary)
+	}
+	revoked := make(map[string]bool)
+	for _, recipient := range recipientUsernames {
+		revoked[recipient] = true
+	}
+	//Load the filereferenceprimaries of everyone that should still have access to it
+	remaining := make(map[string]FileReferencePrimary)
+	for recipient, primary_uuid := range sharing.Uuid_shared_with {
+		if revoked[recipient] {
+			continue
+		}
+		var file_reference_primary FileReferencePrimary
+		file_reference_primary_bytes, err := RetrieveFromDatastore(primary_uuid, sharing.Enc_keys_shared_with[recipient], sharing.Hmac_keys_shared_with[recipient])
 		if err != nil {
 			return err
 		}
-		new_file_reference_primary.File_enc_key = new_file_reference_primary_encryption_key
-		new_file_reference_primary.Hmac_key = new_file_reference_primary_hmac_key
-		new_file_reference_primary.File_controller_pointer = new_file_controller_uuid
-		err = SendToDatastore(file_reference_owner.Uuid_shared_with[i], file_reference_owner.Enc_keys_shared_with[i], file_reference_owner.Hmac_keys_shared_with[i], new_file_reference_primary)
+		err = UnmarshalObject(file_reference_primary_bytes, &file_reference_primary)
 		if err != nil {
 			return err
 		}
-		_ = element
+		remaining[recipient] = file_reference_primary
 	}
+	//Relocate and encrypt the file with new hmac and encryption keys
+	new_file_controller_uuid := uuid.New()
+	new_file_reference_primary_hmac_key := userlib.RandomBytes(16)
+	new_file_reference_primary_encryption_key := userlib.RandomBytes(16)
+	old_access := FileAccess{Controller_uuid: file_reference_owner.File_controller_pointer, Enc_key: file_reference_owner.File_enc_key, Hmac_key: file_reference_owner.Hmac_key}
+	new_access := FileAccess{Controller_uuid: new_file_controller_uuid, Enc_key: new_file_reference_primary_encryption_key, Hmac_key: new_file_reference_primary_hmac_key}
+	cleanup := &revocationCleanup{old_uuids: []uuid.UUID{file_reference_owner.File_controller_pointer}}
 
-	//Now we need to create a new file controller at the new uuid we previously created
+	//Now we need to create a new file controller (or directory) at the new uuid we previously created
 	var new_file_controller FileController
-	//Get the old filecontroller
-	old_file_controller, err := RetrieveFromDatastore(file_reference_owner.File_controller_pointer, file_reference_owner.File_enc_key, file_reference_owner.Hmac_key)
-	if err != nil {
-		return err
-	}
-	err = json.Unmarshal(old_file_controller, &new_file_controller)
-	if err != nil {
-		return err
-	}
-	//Store the start of the old files to update new files and delete old ones
-	old_start_uuid := new_file_controller.Start
-	//Create new start and end
-	new_file_controller.Start = uuid.New()
-	new_file_controller.End = uuid.New()
-	//Store it
-	err = SendToDatastore(new_file_controller_uuid, new_file_reference_primary_encryption_key, new_file_reference_primary_hmac_key, new_file_controller)
-	if err != nil {
-		return err
-	}
-
-	//Create the new files using the old content
-	if err != nil {
-		return err
-	}
-	var start_file File
-	var end_file File
-	start_file.Content = content
-	start_file.Next_uuid = new_file_controller.End
-
-	//Store the new file
-	err = SendToDatastore(new_file_controller.Start, new_file_reference_primary_encryption_key, new_file_reference_primary_hmac_key, start_file)
-	if err != nil {
-		return err
-	}
-	err = SendToDatastore(new_file_controller.End, new_file_reference_primary_encryption_key, new_file_reference_primary_hmac_key, end_file)
-	if err != nil {
-		return err
-	}
-
-	//Now we use the old_start_uuid to delete all the old files
-	var has_next bool
-	has_next = true
-	next_uuid := old_start_uuid
-	for has_next {
-		var file File
-		current_file_bytes, err := RetrieveFromDatastore(next_uuid, file_reference_owner.File_enc_key, file_reference_owner.Hmac_key)
+	if file_reference_owner.Is_directory {
+		//Every file and directory under the directory is copied to a new uuid under new keys
+		err = rekeyDirectory(old_access, new_access, userdata.Privacy_mode, cleanup)
 		if err != nil {
 			return err
 		}
-		err = json.Unmarshal(current_file_bytes, &file)
+	} else {
+		//The lease on the file moves along with the file controller, it is loaded now so it is known to be fine
+		_, _, err = loadFileLease(old_access)
 		if err != nil {
 			return err
 		}
-		userlib.DatastoreDelete(next_uuid)
-		//Check if that was the end of the list
-		if file.Next_uuid == uuid.Nil {
-			has_next = false
-			break
+		cleanup.leases = append(cleanup.leases, leaseMove{old_access: old_access, new_access: new_access})
+		//Get the old filecontroller
+		old_file_controller, err := RetrieveFromDatastore(file_reference_owner.File_controller_pointer, file_reference_owner.File_enc_key, file_reference_owner.Hmac_key)
+		if err != nil {
+			return err
+		}
+		err = UnmarshalObject(old_file_controller, &new_file_controller)
+		if err != nil {
+			return err
+		}
+		if lazy {
+			//The old files are left as they are, the keys for them are remembered in the new file controller
+			//which is encrypted with the new key that the revoked users never get
+			//The revoked users still know the old keys, so a file is only opened with them if it is exactly
+			//what it was when they were revoked
+			new_file_controller.Old_hashes, err = oldFileHashes(new_file_controller, file_reference_owner.File_enc_key, file_reference_owner.Hmac_key)
+			if err != nil {
+				return err
+			}
+			new_file_controller.Epoch++
+			new_file_controller.Old_enc_keys = append(new_file_controller.Old_enc_keys, file_reference_owner.File_enc_key)
+			new_file_controller.Old_hmac_keys = append(new_file_controller.Old_hmac_keys, file_reference_owner.Hmac_key)
+			//The revoked users know the uuid of the empty tail, so everything appended from now on goes
+			//to a new tail that they do not know. The old tail becomes an empty link to the new one
+			var link_file File
+			var end_file File
+			link_file.Next_uuid = uuid.New()
+			if len(new_file_controller.Index) > 0 {
+				segment := ListSegment{Seed: userlib.RandomBytes(16)}
+				new_file_controller.Index = append(new_file_controller.Index, segment)
+				link_file.Next_uuid, err = fileListUUID(segment.Seed, 0)
+				if err != nil {
+					return err
+				}
+			}
+			err = storeFile(new_file_controller.End, new_file_reference_primary_encryption_key, new_file_reference_primary_hmac_key, link_file, new_file_controller.Private, compression_none)
+			if err != nil {
+				return err
+			}
+			err = storeFile(link_file.Next_uuid, new_file_reference_primary_encryption_key, new_file_reference_primary_hmac_key, end_file, new_file_controller.Private, compression_none)
+			if err != nil {
+				return err
+			}
+			new_file_controller.End = link_file.Next_uuid
+			err = SendToDatastorePadded(new_file_controller_uuid, new_file_reference_primary_encryption_key, new_file_reference_primary_hmac_key, new_file_controller, metadataBucket(new_file_controller.Private))
+			if err != nil {
+				return err
+			}
+		} else {
+			err = reencryptFileList(file_reference_owner.File_enc_key, file_reference_owner.Hmac_key, new_file_controller, content, new_file_controller_uuid, new_file_reference_primary_encryption_key, new_file_reference_primary_hmac_key, cleanup)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	//We now update all the other people that should still have access to it with the new FRP
+	for recipient, file_reference_primary := range remaining {
+		file_reference_primary.File_enc_key = new_file_reference_primary_encryption_key
+		file_reference_primary.Hmac_key = new_file_reference_primary_hmac_key
+		file_reference_primary.File_controller_pointer = new_file_controller_uuid
+		err = SendToDatastorePadded(sharing.Uuid_shared_with[recipient], sharing.Enc_keys_shared_with[recipient], sharing.Hmac_keys_shared_with[recipient], file_reference_primary, metadataBucket(userdata.Privacy_mode))
+		if err != nil {
+			return err
+		}
+	}
+	for _, recipient := range recipientUsernames {
+		//Now we delete the filereferenceprimary associated with this user
+		cleanup.old_uuids = append(cleanup.old_uuids, sharing.Uuid_shared_with[recipient])
+		//An invitation that was never accepted is deleted too, it points to the deleted filereferenceprimary
+		invitation_uuid, ok := sharing.Invitations_shared_with[recipient]
+		if ok {
+			deleteInvitation(recipient, invitation_uuid)
 		}
-		next_uuid = file.Next_uuid
 	}
-	//We finally also need to delete filecontroller
-	userlib.DatastoreDelete(file_reference_owner.File_controller_pointer)
 	//Update with the new one
 	file_reference_owner.File_controller_pointer = new_file_controller_uuid
 	file_reference_owner.File_enc_key = new_file_reference_primary_encryption_key
 	file_reference_owner.Hmac_key = new_file_reference_primary_hmac_key
 
+	//Store it and take the revoked users out of the sharing
+	err = updateFileSharing(file_uuid, encryption_key, &file_reference_owner, FileSharing{}, recipientUsernames, metadataBucket(userdata.Privacy_mode))
+	if err != nil {
+		return err
+	}
+	err = SendToDatastorePadded(file_uuid, encryption_key, hmac_key, file_reference_owner, metadataBucket(userdata.Privacy_mode))
+	if err != nil {
+		return err
+	}
+	//We finally also need to delete the old filecontroller and everything else nobody uses anymore
+	return cleanup.finish(recipientUsernames, metadataBucket(userdata.Privacy_mode))
+}
+
+// What is left of a revocation once everyone who keeps access uses the new file controller. Nobody uses
+// the old objects anymore then, so nothing here can undo the revocation
+type revocationCleanup struct {
+	old_uuids  []uuid.UUID      //Old file controllers, directories, files of the lists and filereferenceprimaries
+	old_chunks []ChunkReference //Chunks the old lists pointed to
+	leases     []leaseMove
+}
+
+type leaseMove struct {
+	old_access FileAccess
+	new_access FileAccess
+}
+
+// Function to move the leases and delete the old objects. Everything is tried, the first error is given
+func (cleanup *revocationCleanup) finish(revoked []string, bucket_size int) (err error) {
+	for _, move := range cleanup.leases {
+		move_err := moveFileLease(move.old_access, move.new_access, revoked, bucket_size)
+		if err == nil {
+			err = move_err
+		}
+	}
+	for _, old_uuid := range cleanup.old_uuids {
+		datastoreDelete(old_uuid)
+	}
+	release_err := releaseChunks(cleanup.old_chunks)
+	if err == nil {
+		err = release_err
+	}
+	return err
+}
+
+// Function to drop the names that are given more than once, keeping the first of each
+func uniqueNames(names []string) (unique []string) {
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			unique = append(unique, name)
+		}
+	}
+	return unique
+}
+
+// Stores the content as a fresh list of files under the new keys. The old list is only deleted in the cleanup,
+// it is loaded first so everything that can go wrong with it does so before anything is stored
+func reencryptFileList(old_encryption_key []byte, old_hmac_key []byte, new_file_controller FileController, content []byte,
+	new_file_controller_uuid uuid.UUID, new_encryption_key []byte, new_hmac_key []byte, cleanup *revocationCleanup) (err error) {
+	old_uuids, old_chunks, err := listFiles(new_file_controller, old_encryption_key, old_hmac_key)
+	if err != nil {
+		return err
+	}
+	//Create the new files using the old content from a new start
+	err = newFileList(&new_file_controller)
+	if err != nil {
+		return err
+	}
+	new_file_controller.Last, new_file_controller.End, err = storeFileList(nil, []uuid.UUID{new_file_controller.Start}, lastSegment(&new_file_controller), new_encryption_key, new_hmac_key, content, new_file_controller.Private, nil, new_file_controller.Compression)
+	if err != nil {
+		return err
+	}
+	//The content is stored in the new files themselves, the revoked users know the keys of the chunks
+	new_file_controller.Chunked = false
+	//All the files are re-encrypted under the new key
+	new_file_controller.Old_enc_keys = nil
+	new_file_controller.Old_hmac_keys = nil
+	new_file_controller.Old_hashes = nil
+	new_file_controller.Appends = 0
 	//Store it
-	err = SendToDatastore(file_uuid, encryption_key, hmac_key, file_reference_owner)
+	err = SendToDatastorePadded(new_file_controller_uuid, new_encryption_key, new_hmac_key, new_file_controller, metadataBucket(new_file_controller.Private))
 	if err != nil {
 		return err
 	}
+	//All the old files and the chunks they point to are released once nobody uses them anymore
+	cleanup.old_uuids = append(cleanup.old_uuids, old_uuids...)
+	cleanup.old_chunks = append(cleanup.old_chunks, old_chunks...)
 	return nil
 }
 
-func UploadUserdata(userdata *User) (err error) {
-	//Now put the userdata into datastore where it is also encrypted
-	//Use a hash of the Username as UUID
-	//The UUID needs a 16 byte slice so use the first 16 bytes of the hash for the UUID
-	b := userlib.Hash([]byte(userdata.Username))[:16]
-	user_UUID, err := uuid.FromBytes(b)
+// Re-encrypts every file in the list that is still encrypted under the key of an earlier epoch,
+// which finishes a lazy revocation. Any user with access to the file can do this
+func (userdata *User) ReencryptFile(filename string) error {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
+	//Update the userdata
+	userdata, err := getUserdata(userdata)
 	if err != nil {
-		return nil
+		return err
+	}
+	access, err := getFileAccess(userdata, filename)
+	if err != nil {
+		return err
+	}
+	if access.Is_directory {
+		return errors.New("cannot re-encrypt a directory")
+	}
+	//If another session changes the file at the same time everything stored here is taken back and done again
+	for attempt := 0; attempt < commit_attempts; attempt++ {
+		err = reencryptFile(access, userdata.Username)
+		if err != err_concurrent_change {
+			return err
+		}
 	}
+	return err
+}
 
-	//Turn the data into JSON
-	user_bytes, err := json.Marshal(userdata)
+func reencryptFile(access FileAccess, username string) error {
+	file_controller_uuid := access.Controller_uuid
+	file_enc_key := access.Enc_key
+	file_hmac_key := access.Hmac_key
+	file_controller, sealed, err := loadFileController(file_controller_uuid, file_enc_key, file_hmac_key)
+	if err != nil {
+		return err
+	}
+	err = checkFileLease(access, username)
 	if err != nil {
+		return err
+	}
+	//Nothing to do if no revocation has been done lazily since the last re-encryption
+	if len(file_controller.Old_enc_keys) == 0 {
 		return nil
 	}
+	//Walk the list and store every file again at the same uuid under the current key,
+	//but only if it is still what was read
+	writes := newPendingWrites()
+	next_uuid := file_controller.Start
+	for {
+		writes.expect(next_uuid)
+		file, err := RetrieveFileFromDatastore(next_uuid, file_controller, file_enc_key, file_hmac_key)
+		if err == nil {
+			err = writes.storeFile(next_uuid, file_enc_key, file_hmac_key, file, file_controller.Private, file_controller.Compression)
+		}
+		if err != nil {
+			writes.undo()
+			return err
+		}
+		//Check if that was the end of the list
+		if file.Next_uuid == uuid.Nil {
+			break
+		}
+		next_uuid = file.Next_uuid
+	}
+	//The old keys can now be forgotten
+	file_controller.Old_enc_keys = nil
+	file_controller.Old_hmac_keys = nil
+	file_controller.Old_hashes = nil
+	file_controller.Version++
+	err = commitFileController(file_controller_uuid, file_enc_key, file_hmac_key, file_controller, sealed)
+	if err != nil {
+		writes.undo()
+	}
+	return err
+}
 
-	//Encrypt it
-	iv := userlib.RandomBytes(16)
-	user_bytes_encrypted := userlib.SymEnc(userdata.master_key, iv, user_bytes)
-
-	//Then MAC it (64 bytes)
-	HMAC, err := userlib.HMACEval(userdata.hmac_key, user_bytes_encrypted)
+// Turns privacy mode on or off. In privacy mode everything the user stores is padded, and the files
+// the user creates from then on are private, which every user with access to them follows
+func (userdata *User) SetPrivacyMode(enabled bool) error {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
+	//Update the userdata
+	userdata, err := getUserdata(userdata)
 	if err != nil {
-		return nil
+		return err
 	}
-	user_bytes_encrypted_MAC := append(user_bytes_encrypted, HMAC...)
+	userdata.Privacy_mode = enabled
+	return UploadUserdata(userdata)
+}
 
-	//Store it
-	userlib.DatastoreSet(user_UUID, user_bytes_encrypted_MAC)
+// Turns deduplication on or off. With it on, the content this user stores is split into chunks at boundaries
+// that depend on the content, and a chunk that any file of the user already has is not stored again.
+// Private files and files marked as sensitive are never deduplicated
+func (userdata *User) SetDeduplication(enabled bool) error {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
+	//Update the userdata
+	userdata, err := getUserdata(userdata)
+	if err != nil {
+		return err
+	}
+	userdata.Deduplication = enabled
+	if enabled && userdata.Dedup_key == nil {
+		userdata.Dedup_key = userlib.RandomBytes(16)
+	}
+	return UploadUserdata(userdata)
+}
 
-	return nil
+// Marks a file as sensitive or not. Deduplication tells whoever watches the datastore that two files share content,
+// so the content of a sensitive file is always stored in the file itself. Marking a file as sensitive stores the
+// chunks it has as part of the file again
+func (userdata *User) SetSensitive(filename string, sensitive bool) error {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
+	//Update the userdata
+	userdata, err := getUserdata(userdata)
+	if err != nil {
+		return err
+	}
+	access, err := getFileAccess(userdata, filename)
+	if err != nil {
+		return err
+	}
+	if access.Is_directory {
+		return errors.New("only files can be marked as sensitive")
+	}
+	//If another session changes the file at the same time the file is marked again on top of what it did
+	for attempt := 0; attempt < commit_attempts; attempt++ {
+		err = setSensitive(access, sensitive, userdata.Username)
+		if err != err_concurrent_change {
+			return err
+		}
+	}
+	return err
 }
 
-// Function to calculate hmac key and masterkey and to check the integrity of the user
-func getUserdata(userdata *User) (updated_userdata *User, err error) {
-	updated_userdata = userdata
-	//Creating the masterkey
-	master_key_salt := userdata.Username + "k"
-	master_key := userlib.Argon2Key([]byte(userdata.Password), []byte(master_key_salt), key_length)
-	userdata.master_key = master_key
+func setSensitive(access FileAccess, sensitive bool, username string) error {
+	file_controller, sealed, err := loadFileController(access.Controller_uuid, access.Enc_key, access.Hmac_key)
+	if err != nil {
+		return err
+	}
+	err = checkFileLease(access, username)
+	if err != nil {
+		return err
+	}
+	file_controller.Sensitive = sensitive
+	if !sensitive || !file_controller.Chunked {
+		return commitFileController(access.Controller_uuid, access.Enc_key, access.Hmac_key, file_controller, sealed)
+	}
+	//The chunks are stored in the files of a new list, which is only used if nobody changed the file since it was loaded
+	content, err := LoadFileList(file_controller, access.Enc_key, access.Hmac_key)
+	if err != nil {
+		return err
+	}
+	return compactFileList(access.Controller_uuid, file_controller, sealed, access.Enc_key, access.Hmac_key, content, nil)
+}
 
-	//Create the hmac key
-	Hmac_key_64, err := userlib.HashKDF(master_key, []byte("HMAC key for user"))
+// Turns compression of a file on or off for everyone with access to it. The content already stored is
+// stored again with the new setting. Private files are never compressed, their blocks are padded anyway
+func (userdata *User) SetCompression(filename string, enabled bool) error {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
+	//Update the userdata
+	userdata, err := getUserdata(userdata)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	access, err := getFileAccess(userdata, filename)
+	if err != nil {
+		return err
+	}
+	if access.Is_directory {
+		return errors.New("only files can be compressed")
+	}
+	//The content is loaded again every time, so what another session appends at the same time is stored with it
+	for attempt := 0; attempt < commit_attempts; attempt++ {
+		err = setCompression(access, enabled, dedupKey(userdata), userdata.Username)
+		if err != err_concurrent_change {
+			return err
+		}
 	}
-	hmac_key := Hmac_key_64[:16]
+	return err
+}
 
-	//Find the user in the datastore
-	uuid, err := uuid.FromBytes(userlib.Hash([]byte(userdata.Username))[:16])
+func setCompression(access FileAccess, enabled bool, dedup_key []byte, username string) error {
+	file_controller, sealed, err := loadFileController(access.Controller_uuid, access.Enc_key, access.Hmac_key)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	stored_user_w_hmac, ok := userlib.DatastoreGet(uuid)
-	if !ok {
-		return nil, errors.New("unable to find the user in datastore")
+	err = checkFileLease(access, username)
+	if err != nil {
+		return err
 	}
-	//Check the hmac
-	if !ValidHMAC(hmac_key, stored_user_w_hmac) {
-		return nil, errors.New("the integrity of the user has been compromised")
+	if file_controller.Private {
+		return errors.New("private files are not compressed")
 	}
-	//If hmac is correct we can update the userdata and send this back
-	stored_user_bytes_encrypted := stored_user_w_hmac[:len(stored_user_w_hmac)-64]
-	stored_user_bytes_decrypted := userlib.SymDec(master_key, stored_user_bytes_encrypted)
-	//Unmarshal and place into the updates userdata
-	err = json.Unmarshal(stored_user_bytes_decrypted, &updated_userdata)
+	content, err := LoadFileList(file_controller, access.Enc_key, access.Hmac_key)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	file_controller.Compression = compression_none
+	if enabled {
+		file_controller.Compression = compression_deflate
 	}
+	return compactFileList(access.Controller_uuid, file_controller, sealed, access.Enc_key, access.Hmac_key, content, dedup_key)
+}
 
-	updated_userdata.hmac_key = hmac_key
-	updated_userdata.master_key = master_key
+// The dedup key of the user if the content the user stores should be deduplicated
+func dedupKey(userdata *User) []byte {
+	if !userdata.Deduplication {
+		return nil
+	}
+	return userdata.Dedup_key
+}
 
-	return updated_userdata, nil
+func UploadUserdata(userdata *User) (err error) {
+	//Now put the userdata into datastore where it is also encrypted
+	//The UUID is derived from the Username
+	user_UUID, err := userUUID(userdata.Username)
+	if err != nil {
+		return err
+	}
+	//It is only stored if no other session stored it since this session loaded it, otherwise the changes
+	//of this session are made again on what the other session stored
+	for attempt := 0; attempt < commit_attempts; attempt++ {
+		//The private keys are wrapped on their own first
+		err = wrapPrivateKeys(userdata)
+		if err != nil {
+			return err
+		}
+		userdata_bytes, err := MarshalObject(userdata)
+		if err != nil {
+			return err
+		}
+		//Seal it and store it, padded in privacy mode
+		sealed, err := sealBytes(user_UUID, userdata.enc_key, userdata.hmac_key, userdata_bytes, metadataBucket(userdata.Privacy_mode))
+		if err != nil {
+			return err
+		}
+		if datastoreCompareAndSwap(user_UUID, userdata.loaded_user, sealed) {
+			userdata.loaded_user = sealed
+			userdata.loaded_account_key = userdata.account_key
+			return nil
+		}
+		err = mergeUserdata(userdata, user_UUID)
+		if err != nil {
+			return err
+		}
+	}
+	return err_concurrent_change
 }
 
-func ValidHMAC(hmac_key []byte, content_with_HMAC []byte) (valid bool) {
-	hmac := content_with_HMAC[len(content_with_HMAC)-64:]
-	content := content_with_HMAC[0 : len(content_with_HMAC)-64]
+// Function to make the changes this session made to the user since it loaded it again on the user another session
+// stored in the meantime. Maps get the changes of both sessions, other fields the value of this session if it changed
+// them. Two sessions that rotate the keys at the same time or a session that changed the account key cannot be merged
+func mergeUserdata(userdata *User, user_UUID uuid.UUID) error {
+	if userdata.loaded_user == nil || userdata.loaded_account_key == nil {
+		return errors.New("the user has been stored by another session")
+	}
+	base, _, err := openStoredUser(user_UUID, userdata.loaded_account_key, userdata.loaded_user)
+	if err != nil {
+		return err
+	}
+	sealed, ok := datastoreGet(user_UUID)
+	if !ok {
+		return errors.New("the integrity of the user has been compromised")
+	}
+	//This session might have changed the account key itself
+	account_key := userdata.account_key
+	theirs, stored, err := openStoredUser(user_UUID, account_key, sealed)
+	if err != nil && !bytes.Equal(account_key, userdata.loaded_account_key) {
+		account_key = userdata.loaded_account_key
+		theirs, stored, err = openStoredUser(user_UUID, account_key, sealed)
+	}
+	if err != nil {
+		return errors.New("the account key has been changed by another session, log in again")
+	}
+	if keyVersion(userdata.Key_version) == keyVersion(base.Key_version) {
+		userdata.Key_version = theirs.Key_version
+		userdata.secret_key = theirs.secret_key
+		userdata.signature_private_key = theirs.signature_private_key
+	} else if keyVersion(theirs.Key_version) != keyVersion(base.Key_version) {
+		return errors.New("the keys of the user have been rotated by another session at the same time")
+	}
+	mergeValue(&userdata.Root_key, base.Root_key, theirs.Root_key)
+	mergeValue(&userdata.Namespace_key, base.Namespace_key, theirs.Namespace_key)
+	mergeValue(&userdata.old_secret_keys, base.old_secret_keys, theirs.old_secret_keys)
+	mergeValue(&userdata.Password_public_key, base.Password_public_key, theirs.Password_public_key)
+	mergeValue(&userdata.Devices, base.Devices, theirs.Devices)
+	mergeValue(&userdata.Recovery_codes, base.Recovery_codes, theirs.Recovery_codes)
+	mergeValue(&userdata.Contacts, base.Contacts, theirs.Contacts)
+	mergeValue(&userdata.Contact_book, base.Contact_book, theirs.Contact_book)
+	mergeValue(&userdata.prekeys, base.prekeys, theirs.prekeys)
+	mergeValue(&userdata.Files_owned, base.Files_owned, theirs.Files_owned)
+	mergeValue(&userdata.Path_prefixes, base.Path_prefixes, theirs.Path_prefixes)
+	mergeValue(&userdata.Privacy_mode, base.Privacy_mode, theirs.Privacy_mode)
+	mergeValue(&userdata.Deduplication, base.Deduplication, theirs.Deduplication)
+	mergeValue(&userdata.Dedup_key, base.Dedup_key, theirs.Dedup_key)
+	//Both sessions published prekeys, the next bundle has to come after both
+	if theirs.Prekey_counter > userdata.Prekey_counter {
+		userdata.Prekey_counter = theirs.Prekey_counter
+	}
+	userdata.loaded_user = stored
+	userdata.loaded_account_key = account_key
+	return nil
+}
 
-	hmac_content, err := userlib.HMACEval(hmac_key, content)
+// Function to set what mine points to to theirs, unless this session changed it from base. For a map only
+// the entries this session added, changed or removed are changed in theirs
+func mergeValue(mine interface{}, base interface{}, theirs interface{}) {
+	mine_value := reflect.ValueOf(mine).Elem()
+	base_value := reflect.ValueOf(base)
+	theirs_value := reflect.ValueOf(theirs)
+	if mine_value.Kind() != reflect.Map {
+		if reflect.DeepEqual(mine_value.Interface(), base) {
+			mine_value.Set(theirs_value)
+		}
+		return
+	}
+	merged := reflect.MakeMap(mine_value.Type())
+	for _, key := range theirs_value.MapKeys() {
+		merged.SetMapIndex(key, theirs_value.MapIndex(key))
+	}
+	for _, key := range base_value.MapKeys() {
+		if !mine_value.MapIndex(key).IsValid() {
+			merged.SetMapIndex(key, reflect.Value{})
+		}
+	}
+	for _, key := range mine_value.MapKeys() {
+		value := mine_value.MapIndex(key)
+		base_entry := base_value.MapIndex(key)
+		if !base_entry.IsValid() || !reflect.DeepEqual(base_entry.Interface(), value.Interface()) {
+			merged.SetMapIndex(key, value)
+		}
+	}
+	mine_value.Set(merged)
+}
+
+// Changes the password of the user. The password slot gets a new key pair and the account key is changed,
+// so sessions opened with the old password cannot use the account anymore. This session continues with the new password
+func (userdata *User) ChangePassword(new_password string) error {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
+	//Update the userdata
+	userdata, err := getUserdata(userdata)
 	if err != nil {
-		return false
+		return err
 	}
-	valid = userlib.HMACEqual(hmac, hmac_content)
-	return valid
+	//Only a session opened with the password has the old keys, they would be lost with the old master key
+	if userdata.master_key == nil {
+		legacy_uuid, err := DeriveUUID(label_legacy_keys_uuid, []byte(userdata.Username))
+		if err != nil {
+			return err
+		}
+		_, ok := datastoreGet(legacy_uuid)
+		if ok {
+			return errors.New("files of the user are still stored with the old keys, log in with the password to change it")
+		}
+	}
+	return changePassword(userdata, new_password)
 }
 
-// Function to send an object to datastore
-func SendToDatastore(uuid uuid.UUID, encryption_key []byte, hmac_key []byte, object interface{}) (err error) {
-	//marshall it
-	object_bytes, err := json.Marshal(object)
+func changePassword(userdata *User, new_password string) (err error) {
+	public_key, private_key, err := userlib.PKEKeyGen()
 	if err != nil {
 		return err
 	}
-	//Encrypt it
-	iv := userlib.RandomBytes(16)
-	object_bytes_encrypted := userlib.SymEnc(encryption_key, iv, object_bytes)
-	//HMAC it
-	hmac, err := userlib.HMACEval(hmac_key, object_bytes_encrypted)
+	userdata.password_hash = userPasswordHash(userdata.Username, new_password)
+	userdata.Password_public_key = public_key
+	userdata.slot = password_slot
+	userdata.slot_private_key = private_key
+	err = rotateAccountKey(userdata)
 	if err != nil {
 		return err
 	}
-	object_bytes_encrypted_HMAC := append(object_bytes_encrypted, hmac...)
-	//Send to datastore
-	userlib.DatastoreSet(uuid, object_bytes_encrypted_HMAC)
-	return nil
+	return setPasswordHashing(userdata, private_key)
 }
 
-// Function to retrieve an object from datastore
-func RetrieveFromDatastore(uuid uuid.UUID, encryption_key []byte, hmac_key []byte) (object_bytes []byte, err error) {
-	object_bytes_encrypted_HMAC, ok := userlib.DatastoreGet(uuid)
-	if !ok {
-		return nil, errors.New("could not find the object in the datastore")
+// Like InitUser, but also creates recovery codes that can be printed and kept somewhere safe
+func InitUserWithRecovery(Username string, password string, count int) (userdataptr *User, codes []string, err error) {
+	userdataptr, err = InitUser(Username, password)
+	if err != nil {
+		return nil, nil, err
 	}
-	//Check hmac
-	if !ValidHMAC(hmac_key, object_bytes_encrypted_HMAC) {
-		return nil, errors.New("integrity of object has been compromised")
+	codes, err = userdataptr.CreateRecoveryCodes(count)
+	if err != nil {
+		return nil, nil, err
+	}
+	return userdataptr, codes, nil
+}
+
+// Creates new recovery codes for the user, the codes the user had before stop working.
+// Every code is a slot of its own and can be used once with RecoverAccount
+func (userdata *User) CreateRecoveryCodes(count int) (codes []string, err error) {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
+	//Update the userdata
+	userdata, err = getUserdata(userdata)
+	if err != nil {
+		return nil, err
+	}
+	if count <= 0 {
+		return nil, errors.New("at least one recovery code is needed")
+	}
+	//Remove the old codes
+	had_codes := len(userdata.Recovery_codes) > 0
+	for id := range userdata.Recovery_codes {
+		err = deleteRecoveryCode(userdata, id)
+		if err != nil {
+			return nil, err
+		}
 	}
-	object_bytes_encrypted := object_bytes_encrypted_HMAC[:len(object_bytes_encrypted_HMAC)-64]
-	//decrypt
-	object_bytes_decrypted := userlib.SymDec(encryption_key, object_bytes_encrypted)
+	userdata.Recovery_codes = make(map[string]userlib.PKEEncKey)
+	for i := 0; i < count; i++ {
+		code := userlib.RandomBytes(16)
+		id := recoveryCodeID(code)
+		public_key, private_key, err := userlib.PKEKeyGen()
+		if err != nil {
+			return nil, err
+		}
+		//Seal the private key of the slot with keys from the code
+		recovery_key_uuid, enc_key, hmac_key, err := recoveryKeyLocation(userdata.Username, code)
+		if err != nil {
+			return nil, err
+		}
+		err = SendToDatastore(recovery_key_uuid, enc_key, hmac_key, private_key)
+		if err != nil {
+			return nil, err
+		}
+		err = storeAccountSlot(userdata, recoverySlot(id), public_key, userdata.account_key)
+		if err != nil {
+			return nil, err
+		}
+		userdata.Recovery_codes[id] = public_key
+		codes = append(codes, formatRecoveryCode(code))
+	}
+	//Anyone that used an old code could know the account key
+	if had_codes {
+		return codes, rotateAccountKey(userdata)
+	}
+	return codes, UploadUserdata(userdata)
+}
 
-	return object_bytes_decrypted, nil
+// Opens the account of a user with a recovery code and sets a new password. The code is used up,
+// and the account key is changed so sessions opened with the old password cannot use the account anymore
+func RecoverAccount(Username string, code string, new_password string) (userdataptr *User, err error) {
+	code_bytes, err := parseRecoveryCode(code)
+	if err != nil {
+		return nil, err
+	}
+	recovery_key_uuid, enc_key, hmac_key, err := recoveryKeyLocation(Username, code_bytes)
+	if err != nil {
+		return nil, err
+	}
+	private_key_bytes, err := RetrieveFromDatastore(recovery_key_uuid, enc_key, hmac_key)
+	if err != nil {
+		return nil, errors.New("the recovery code is not valid or has been used")
+	}
+	var private_key userlib.PKEDecKey
+	err = json.Unmarshal(private_key_bytes, &private_key)
+	if err != nil {
+		return nil, err
+	}
+	var userdata User
+	userdata.Username = Username
+	id := recoveryCodeID(code_bytes)
+	err = openUserdata(&userdata, recoverySlot(id), private_key)
+	if err != nil {
+		return nil, errors.New("the recovery code is not valid or has been used")
+	}
+	err = deleteRecoveryCode(&userdata, id)
+	if err != nil {
+		return nil, err
+	}
+	delete(userdata.Recovery_codes, id)
+	err = changePassword(&userdata, new_password)
+	if err != nil {
+		return nil, err
+	}
+	return &userdata, nil
+}
+
+// Function to delete the slot of a recovery code and the private key for it
+func deleteRecoveryCode(userdata *User, id string) error {
+	err := deleteAccountSlot(userdata.Username, recoverySlot(id))
+	if err != nil {
+		return err
+	}
+	recovery_key_uuid, err := DeriveUUID(label_recovery_key_uuid, []byte(userdata.Username), []byte(id))
+	if err != nil {
+		return err
+	}
+	datastoreDelete(recovery_key_uuid)
+	return nil
+}
+
+// The id of a recovery code, it does not tell anything about the code
+func recoveryCodeID(code []byte) string {
+	return hex.EncodeToString(DeriveBytes(label_recovery_code_id, code)[:8])
+}
+
+// Function to compute where the private key of the slot of a recovery code is and the keys it is sealed with.
+// The code is random so no Argon2 is needed
+func recoveryKeyLocation(Username string, code []byte) (recovery_key_uuid uuid.UUID, enc_key []byte, hmac_key []byte, err error) {
+	recovery_key_uuid, err = DeriveUUID(label_recovery_key_uuid, []byte(Username), []byte(recoveryCodeID(code)))
+	if err != nil {
+		return recovery_key_uuid, nil, nil, err
+	}
+	enc_key, err = DeriveKey(code, label_recovery_key_encryption_key)
+	if err != nil {
+		return recovery_key_uuid, nil, nil, err
+	}
+	hmac_key, err = DeriveKey(code, label_recovery_key_hmac_key)
+	if err != nil {
+		return recovery_key_uuid, nil, nil, err
+	}
+	return recovery_key_uuid, enc_key, hmac_key, nil
+}
+
+// Recovery codes are printed as 8 groups of 4 hex characters
+func formatRecoveryCode(code []byte) string {
+	return formatHexGroups(code)
+}
+
+func formatHexGroups(value []byte) string {
+	encoded := hex.EncodeToString(value)
+	var groups []string
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:i+4])
+	}
+	return strings.Join(groups, "-")
+}
+
+// Function to read a recovery code back, the dashes, spaces and case do not matter
+func parseRecoveryCode(code string) (code_bytes []byte, err error) {
+	cleaned := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	code_bytes, err = hex.DecodeString(cleaned)
+	if err != nil || len(code_bytes) != key_length {
+		return nil, errors.New("the recovery code is not valid")
+	}
+	return code_bytes, nil
+}
+
+// Shows the fingerprint of the keys of another user, to compare with what that user sees in MyFingerprint.
+// The keys are pinned if this is the first time the user is used
+func (userdata *User) GetFingerprint(username string) (fingerprint string, verified bool, err error) {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
+	//Update the userdata
+	userdata, err = getUserdata(userdata)
+	if err != nil {
+		return "", false, err
+	}
+	_, _, _, err = pinnedPublicKeys(userdata, username)
+	if err != nil {
+		return "", false, err
+	}
+	contacts, err := loadContacts(userdata)
+	if err != nil {
+		return "", false, err
+	}
+	contact := contacts[username]
+	return contact.Fingerprint, contact.Verified, nil
+}
+
+// The fingerprint of the keys of this user, for other users to compare with
+func (userdata *User) MyFingerprint() (fingerprint string, err error) {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
+	public_key, verify_key, err := publicKeysAt(userdata.Username, keyVersion(userdata.Key_version))
+	if err != nil {
+		return "", err
+	}
+	return contactFingerprint(userdata.Username, public_key, verify_key)
+}
+
+// Marks the keys of another user as verified after the fingerprint has been compared out of band.
+// Gives an error if the fingerprint does not match the pinned keys
+func (userdata *User) VerifyFingerprint(username string, fingerprint string) error {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
+	//Update the userdata
+	userdata, err := getUserdata(userdata)
+	if err != nil {
+		return err
+	}
+	_, _, _, err = pinnedPublicKeys(userdata, username)
+	if err != nil {
+		return err
+	}
+	contacts, err := loadContacts(userdata)
+	if err != nil {
+		return err
+	}
+	contact := contacts[username]
+	given := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(fingerprint))
+	if given != strings.ReplaceAll(contact.Fingerprint, "-", "") {
+		return errors.New("the fingerprint does not match the keys of the user")
+	}
+	contact.Verified = true
+	return storeContact(userdata, username, contact)
+}
+
+// Function to get the current public keys of another user from the keystore and check them against the contact book.
+// Keys of a user that is not in the contact book yet are pinned. If the keys differ from the pinned ones, they are
+// only accepted if the user rotated to them with a chain of key rotations signed by the pinned keys
+func pinnedPublicKeys(userdata *User, username string) (version int, public_key userlib.PKEEncKey, verify_key userlib.DSVerifyKey, err error) {
+	//The current version is only the one the rotations from version 1 lead to, so this also holds the first time
+	version, public_key, verify_key, err = followKeyRotations(username, 0)
+	if err != nil {
+		return 0, public_key, verify_key, err
+	}
+	fingerprint, err := contactFingerprint(username, public_key, verify_key)
+	if err != nil {
+		return 0, public_key, verify_key, err
+	}
+	contacts, err := loadContacts(userdata)
+	if err != nil {
+		return 0, public_key, verify_key, err
+	}
+	contact, ok := contacts[username]
+	if ok && contact.Fingerprint == fingerprint {
+		return version, public_key, verify_key, nil
+	}
+	if ok {
+		changed := errors.New("the keys of " + username + " have changed since they were pinned")
+		pinned_version := keyVersion(contact.Key_version)
+		if version <= pinned_version {
+			return 0, public_key, verify_key, changed
+		}
+		//The keys of the pinned version must still be the pinned ones
+		pinned_public_key, pinned_verify_key, err := publicKeysAt(username, pinned_version)
+		if err != nil {
+			return 0, public_key, verify_key, changed
+		}
+		pinned_fingerprint, err := contactFingerprint(username, pinned_public_key, pinned_verify_key)
+		if err != nil || pinned_fingerprint != contact.Fingerprint {
+			return 0, public_key, verify_key, changed
+		}
+	}
+	contact.Fingerprint = fingerprint
+	contact.Key_version = version
+	return version, public_key, verify_key, storeContact(userdata, username, contact)
+}
+
+// Function to find the contact book of a user and the keys it is encrypted with
+func contactBookLocation(userdata *User) (book_uuid uuid.UUID, encryption_key []byte, hmac_key []byte, err error) {
+	book_uuid, err = DeriveUUID(label_contact_book_uuid, []byte(userdata.Username), userdata.Namespace_key)
+	if err != nil {
+		return book_uuid, nil, nil, err
+	}
+	encryption_key, err = DeriveKey(userdata.Root_key, label_contact_book_encryption_key)
+	if err != nil {
+		return book_uuid, nil, nil, err
+	}
+	hmac_key, err = DeriveKey(userdata.Root_key, label_contact_book_hmac_key)
+	if err != nil {
+		return book_uuid, nil, nil, err
+	}
+	return book_uuid, encryption_key, hmac_key, nil
+}
+
+// Function to load the contacts of a user. The contact book is authenticated on its own and the user struct only
+// says that it exists, so deleting it cannot make the user pin the keys of someone again. Putting back an older
+// contact book is not noticed. Users from before the contact book have their contacts in the user struct until
+// the first contact is stored
+func loadContacts(userdata *User) (contacts map[string]Contact, err error) {
+	contacts, _, err = loadContactBook(userdata)
+	return contacts, err
+}
+
+// Function to load the contacts of a user together with the contact book as it is stored, nil if there is none yet
+func loadContactBook(userdata *User) (contacts map[string]Contact, sealed []byte, err error) {
+	contacts = make(map[string]Contact)
+	book_uuid, encryption_key, hmac_key, err := contactBookLocation(userdata)
+	if err != nil {
+		return nil, nil, err
+	}
+	sealed, ok := datastoreGet(book_uuid)
+	if !ok {
+		if userdata.Contact_book {
+			return nil, nil, errors.New("the contact book of the user is missing")
+		}
+		for name, contact := range userdata.Contacts {
+			contacts[name] = contact
+		}
+		return contacts, nil, nil
+	}
+	//Once there is a contact book it has every contact, also if the user struct was stored again without the mark
+	book_bytes, err := openSealed(book_uuid, encryption_key, hmac_key, sealed)
+	if err != nil {
+		return nil, nil, errors.New("the contact book of the user has been tampered with")
+	}
+	var book ContactBook
+	err = UnmarshalObject(book_bytes, &book)
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, contact := range book.Contacts {
+		contacts[name] = contact
+	}
+	return contacts, sealed, nil
+}
+
+// Function to store a contact in the contact book of a user. The contact book is loaded again and only stored
+// if no other session of the user changed it in the meantime, so contacts another session pinned are kept
+func storeContact(userdata *User, username string, contact Contact) (err error) {
+	for attempt := 0; attempt < commit_attempts; attempt++ {
+		err = commitContact(userdata, username, contact)
+		if err != err_concurrent_change {
+			break
+		}
+	}
+	if err != nil || userdata.Contact_book {
+		return err
+	}
+	userdata.Contact_book = true
+	userdata.Contacts = nil
+	return UploadUserdata(userdata)
+}
+
+// Function to store the contact in the contact book as it is stored now. Gives err_concurrent_change if another
+// session stored the contact book since it was loaded
+func commitContact(userdata *User, username string, contact Contact) error {
+	book_uuid, encryption_key, hmac_key, err := contactBookLocation(userdata)
+	if err != nil {
+		return err
+	}
+	contacts, sealed, err := loadContactBook(userdata)
+	if err != nil {
+		return err
+	}
+	contacts[username] = mergeContact(contacts[username], contact)
+	book_bytes, err := MarshalObject(ContactBook{Contacts: contacts})
+	if err != nil {
+		return err
+	}
+	stored, err := sealBytes(book_uuid, encryption_key, hmac_key, book_bytes, metadataBucket(userdata.Privacy_mode))
+	if err != nil {
+		return err
+	}
+	if !datastoreCompareAndSwap(book_uuid, sealed, stored) {
+		return err_concurrent_change
+	}
+	return nil
+}
+
+// Two sessions can store the same contact at the same time. The newer keys are kept, and for the same keys
+// the contact stays verified and keeps the newest prekey counter
+func mergeContact(stored Contact, contact Contact) Contact {
+	if stored.Fingerprint != contact.Fingerprint {
+		if keyVersion(stored.Key_version) > keyVersion(contact.Key_version) {
+			return stored
+		}
+		return contact
+	}
+	contact.Verified = contact.Verified || stored.Verified
+	if stored.Prekey_counter > contact.Prekey_counter {
+		contact.Prekey_counter = stored.Prekey_counter
+	}
+	return contact
+}
+
+// Version 1 of the keys has the names from before key rotation. Later versions have the id of their rotation
+// in the name, so nobody can take the names before the user rotates
+func publicKeyName(username string, version int, key_id string) string {
+	if version <= 1 {
+		return "Public key for:" + username
+	}
+	return fmt.Sprintf("Public key v%d %s for:%s", version, key_id, username)
+}
+
+func signatureKeyName(username string, version int, key_id string) string {
+	if version <= 1 {
+		return "Signature key for:" + username
+	}
+	return fmt.Sprintf("Signature key v%d %s for:%s", version, key_id, username)
+}
+
+func keyVersion(version int) int {
+	if version < 1 {
+		return 1
+	}
+	return version
+}
+
+// The current version of the keys of a user is the last one the rotations from version 1 lead to
+func currentKeyVersion(username string) (version int, err error) {
+	version, _, _, err = followKeyRotations(username, 0)
+	return version, err
+}
+
+func publicKeysAt(username string, version int) (public_key userlib.PKEEncKey, verify_key userlib.DSVerifyKey, err error) {
+	_, public_key, verify_key, err = followKeyRotations(username, version)
+	return public_key, verify_key, err
+}
+
+// The current public keys of a user
+func keystorePublicKeys(username string) (public_key userlib.PKEEncKey, verify_key userlib.DSVerifyKey, err error) {
+	_, public_key, verify_key, err = followKeyRotations(username, 0)
+	return public_key, verify_key, err
+}
+
+func keyRotationUUID(username string, version int) (uuid.UUID, error) {
+	return DeriveUUID(label_key_rotation_uuid, []byte(username), []byte(fmt.Sprint(version)))
+}
+
+// Function to follow the key rotations of a user from version 1 up to the given version, or as far as they go if
+// version is 0. Only the keys named by a rotation signed with the version before it are used, so keys somebody
+// else put in the keystore are never reached
+func followKeyRotations(username string, version int) (reached int, public_key userlib.PKEEncKey, verify_key userlib.DSVerifyKey, err error) {
+	public_key, ok := keystoreGet(publicKeyName(username, 1, ""))
+	if !ok {
+		return 0, public_key, verify_key, errors.New("the user does not exist")
+	}
+	verify_key, ok = keystoreGet(signatureKeyName(username, 1, ""))
+	if !ok {
+		return 0, public_key, verify_key, errors.New("there is no signature key for the user")
+	}
+	for reached = 1; version == 0 || reached < version; reached++ {
+		next_public_key, next_verify_key, err := rotatedKeys(username, reached+1, verify_key)
+		if err != nil && version == 0 {
+			return reached, public_key, verify_key, nil
+		}
+		if err != nil {
+			return 0, public_key, verify_key, err
+		}
+		public_key, verify_key = next_public_key, next_verify_key
+	}
+	return reached, public_key, verify_key, nil
+}
+
+// Function to load the keys a user rotated to at a version, the rotation must be signed with the signature key
+// of the version before it
+func rotatedKeys(username string, version int, previous_verify_key userlib.DSVerifyKey) (public_key userlib.PKEEncKey, verify_key userlib.DSVerifyKey, err error) {
+	rotation_uuid, err := keyRotationUUID(username, version)
+	if err != nil {
+		return public_key, verify_key, err
+	}
+	rotation_bytes_signed, ok := datastoreGet(rotation_uuid)
+	if !ok || len(rotation_bytes_signed) <= 256 {
+		return public_key, verify_key, errors.New("the user does not have that version of the keys")
+	}
+	rotation_bytes := rotation_bytes_signed[:len(rotation_bytes_signed)-256]
+	err = userlib.DSVerify(previous_verify_key, rotation_bytes, rotation_bytes_signed[len(rotation_bytes_signed)-256:])
+	if err != nil {
+		return public_key, verify_key, errors.New("the key rotation is not signed by the keys before it")
+	}
+	var rotation KeyRotation
+	err = json.Unmarshal(rotation_bytes, &rotation)
+	if err != nil {
+		return public_key, verify_key, err
+	}
+	if rotation.Version != version {
+		return public_key, verify_key, errors.New("the key rotation is for another version")
+	}
+	public_key, ok = keystoreGet(publicKeyName(username, version, rotation.Key_id))
+	if !ok {
+		return public_key, verify_key, errors.New("the keys of the key rotation are missing")
+	}
+	verify_key, ok = keystoreGet(signatureKeyName(username, version, rotation.Key_id))
+	if !ok {
+		return public_key, verify_key, errors.New("the keys of the key rotation are missing")
+	}
+	fingerprint, err := contactFingerprint(username, public_key, verify_key)
+	if err != nil {
+		return public_key, verify_key, err
+	}
+	if rotation.Fingerprint != fingerprint {
+		return public_key, verify_key, errors.New("the key rotation does not match the keys")
+	}
+	return public_key, verify_key, nil
+}
+
+// Function to find the version of the secret key of the user that an invitation was encrypted for
+func secretKeyAt(userdata *User, version int) (secret_key userlib.PKEDecKey, err error) {
+	if version == keyVersion(userdata.Key_version) {
+		return userdata.secret_key, nil
+	}
+	secret_key, ok := userdata.old_secret_keys[version]
+	if !ok {
+		return secret_key, errors.New("the key the invitation was encrypted for is not kept anymore")
+	}
+	return secret_key, nil
+}
+
+// Rotates the long term keys of the user. The new version is published in the keystore under names picked for
+// the rotation and signed with the old signature key. The old secret key is kept to accept pending invitations
+func (userdata *User) RotateKeys() error {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
+	//Update the userdata
+	userdata, err := getUserdata(userdata)
+	if err != nil {
+		return err
+	}
+	old_version := keyVersion(userdata.Key_version)
+	version := old_version + 1
+	//The password hashing is signed with the signature key, load it while the old key still checks it
+	hashing, found, err := LoadPasswordHashing(userdata.Username)
+	if err != nil {
+		return err
+	}
+	public_key, secret_key, err := userlib.PKEKeyGen()
+	if err != nil {
+		return err
+	}
+	sign_key, verify_key, err := userlib.DSKeyGen()
+	if err != nil {
+		return err
+	}
+	//Sign the fingerprint of the new keys with the old signature key
+	fingerprint, err := contactFingerprint(userdata.Username, public_key, verify_key)
+	if err != nil {
+		return err
+	}
+	//The names of the new keys are picked at random, so nobody can take them first. The keys are not used by
+	//anyone until the rotation naming them is written
+	var key_id string
+	for attempt := 0; ; attempt++ {
+		key_id = hex.EncodeToString(userlib.RandomBytes(16))
+		_, public_taken := keystoreGet(publicKeyName(userdata.Username, version, key_id))
+		_, signature_taken := keystoreGet(signatureKeyName(userdata.Username, version, key_id))
+		if !public_taken && !signature_taken {
+			break
+		}
+		if attempt == commit_attempts {
+			return errors.New("the names for the new keys are already taken in the keystore")
+		}
+	}
+	err = keystoreSet(publicKeyName(userdata.Username, version, key_id), public_key)
+	if err != nil {
+		return err
+	}
+	err = keystoreSet(signatureKeyName(userdata.Username, version, key_id), verify_key)
+	if err != nil {
+		return err
+	}
+	rotation_bytes, err := json.Marshal(KeyRotation{Version: version, Fingerprint: fingerprint, Key_id: key_id})
+	if err != nil {
+		return err
+	}
+	signature, err := userlib.DSSign(userdata.signature_private_key, rotation_bytes)
+	if err != nil {
+		return err
+	}
+	rotation_uuid, err := keyRotationUUID(userdata.Username, version)
+	if err != nil {
+		return err
+	}
+
+	//Keep the old secret key for pending invitations and forget the old signature key
+	if userdata.old_secret_keys == nil {
+		userdata.old_secret_keys = make(map[int]userlib.PKEDecKey)
+	}
+	userdata.old_secret_keys[old_version] = userdata.secret_key
+	userdata.secret_key = secret_key
+	userdata.signature_private_key = sign_key
+	userdata.Key_version = version
+	err = UploadUserdata(userdata)
+	if err != nil {
+		return err
+	}
+	//Only now that the user has the new keys do other users move to them
+	datastoreSet(rotation_uuid, append(rotation_bytes, signature...))
+	//Senders only use prekeys signed with the current version
+	if len(userdata.prekeys) > 0 {
+		err = publishPrekeys(userdata)
+		if err != nil {
+			return err
+		}
+	}
+	//The slots are checked with the current signature key, sign them again with the new one
+	err = storeAccountSlots(userdata, userdata.account_key)
+	if err != nil {
+		return err
+	}
+	if found {
+		return storePasswordHashing(userdata, hashing)
+	}
+	return nil
+}
+
+// Forgets the old secret keys kept after RotateKeys, invitations encrypted for them cannot be accepted anymore
+func (userdata *User) ForgetOldKeys() error {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
+	//Update the userdata
+	userdata, err := getUserdata(userdata)
+	if err != nil {
+		return err
+	}
+	userdata.old_secret_keys = nil
+	return UploadUserdata(userdata)
+}
+
+// The fingerprint of a user is a hash of the username and both public keys, printed as groups of hex characters
+func contactFingerprint(username string, public_key userlib.PKEEncKey, verify_key userlib.DSVerifyKey) (fingerprint string, err error) {
+	public_key_bytes, err := json.Marshal(public_key)
+	if err != nil {
+		return "", err
+	}
+	verify_key_bytes, err := json.Marshal(verify_key)
+	if err != nil {
+		return "", err
+	}
+	return formatHexGroups(DeriveBytes(label_contact_fingerprint, []byte(username), public_key_bytes, verify_key_bytes)[:16]), nil
+}
+
+// Function to calculate hmac key and masterkey and to check the integrity of the user
+func getUserdata(userdata *User) (updated_userdata *User, err error) {
+	updated_userdata = userdata
+	if userdata.slot == "" {
+		return nil, errors.New("the user is logged out")
+	}
+	//A session opened with the password opens the private key of the password slot again with the master key
+	//it derived when it logged in. Only if another session changed the salt or cost since then it is derived again,
+	//which fails if the password was changed as well
+	if userdata.slot == password_slot {
+		private_key, err := openPasswordKey(userdata.Username, userdata.master_key)
+		if err != nil {
+			master_key, err := loadMasterKey(userdata.Username, userdata.password_hash)
+			if err != nil {
+				return nil, err
+			}
+			private_key, err = openPasswordKey(userdata.Username, master_key)
+			if err != nil {
+				return nil, errors.New("the integrity of the user has been compromised")
+			}
+			updated_userdata.master_key = master_key
+		}
+		updated_userdata.slot_private_key = private_key
+	}
+	//Open the account through the slot of the session, this fails if the slot has been removed
+	err = openUserdata(updated_userdata, updated_userdata.slot, updated_userdata.slot_private_key)
+	if err != nil {
+		return nil, err
+	}
+	return updated_userdata, nil
+}
+
+// Wipes the keys of this session from memory. The session cannot be used anymore after this,
+// the user has to log in again. The private key of a device is left alone, it belongs to the device
+func (userdata *User) Logout() {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
+	wipeBytes(userdata.password_hash, userdata.master_key, userdata.account_key, userdata.loaded_account_key, userdata.enc_key, userdata.hmac_key,
+		userdata.key_encryption_key, userdata.Root_key, userdata.Namespace_key, userdata.legacy_password, userdata.legacy_master_key,
+		userdata.legacy_namespace_key)
+	wipePrivateKey(&userdata.secret_key)
+	wipePrivateKey(&userdata.signature_private_key)
+	for version, secret_key := range userdata.old_secret_keys {
+		wipePrivateKey(&secret_key)
+		delete(userdata.old_secret_keys, version)
+	}
+	for id, prekey := range userdata.prekeys {
+		wipePrivateKey(&prekey.Private_key)
+		delete(userdata.prekeys, id)
+	}
+	if userdata.slot == password_slot {
+		wipePrivateKey(&userdata.slot_private_key)
+	}
+	userdata.cache.wipe()
+	userdata.userState = userState{Username: userdata.Username}
+}
+
+func wipeBytes(values ...[]byte) {
+	for _, value := range values {
+		for i := range value {
+			value[i] = 0
+		}
+	}
+}
+
+// Function to overwrite the numbers of a private key, other copies of the key share them and are wiped too
+func wipePrivateKey(private_key *userlib.PrivateKeyType) {
+	key := &private_key.PrivKey
+	for _, value := range []*big.Int{key.D, key.Precomputed.Dp, key.Precomputed.Dq, key.Precomputed.Qinv} {
+		if value != nil {
+			value.SetInt64(0)
+		}
+	}
+	for _, prime := range key.Primes {
+		if prime != nil {
+			prime.SetInt64(0)
+		}
+	}
+	for _, crt_value := range key.Precomputed.CRTValues {
+		for _, value := range []*big.Int{crt_value.Exp, crt_value.Coeff, crt_value.R} {
+			if value != nil {
+				value.SetInt64(0)
+			}
+		}
+	}
+	*private_key = userlib.PrivateKeyType{}
+}
+
+// Function to open the account key from a slot and retrieve the user struct sealed with it.
+// The stored user replaces everything in userdata except what only this session knows
+func openUserdata(userdata *User, slot string, private_key userlib.PKEDecKey) (err error) {
+	account_key, err := openAccountSlot(userdata.Username, slot, private_key)
+	if err != nil {
+		return err
+	}
+	user_UUID, err := userUUID(userdata.Username)
+	if err != nil {
+		return err
+	}
+	sealed, ok := datastoreGet(user_UUID)
+	if !ok {
+		return errors.New("the integrity of the user has been compromised")
+	}
+	stored, sealed, err := openStoredUser(user_UUID, account_key, sealed)
+	if err != nil {
+		return err
+	}
+	//Kept so the user is only stored again if no other session changed it, see UploadUserdata
+	stored.loaded_user = sealed
+	stored.loaded_account_key = account_key
+	stored.password_hash = userdata.password_hash
+	stored.master_key = userdata.master_key
+	if stored.legacy_password == nil && stored.legacy_master_key == nil {
+		stored.legacy_password = userdata.legacy_password
+		stored.legacy_master_key = userdata.legacy_master_key
+	}
+	stored.legacy_namespace_key = userdata.legacy_namespace_key
+	stored.slot = slot
+	stored.slot_private_key = private_key
+	stored.cache = userdata.cache
+	if stored.cache == nil {
+		stored.cache = newSessionCache()
+	}
+	if userdata.lock == nil {
+		userdata.lock = &sync.Mutex{}
+	}
+	userdata.userState = stored.userState
+	return nil
+}
+
+// Function to open the user stored at user_UUID, sealed with the account key. Also gives the sealed user
+// as it is stored afterwards
+func openStoredUser(user_UUID uuid.UUID, account_key []byte, sealed []byte) (stored User, stored_sealed []byte, err error) {
+	err = setAccountKey(&stored, account_key)
+	if err != nil {
+		return stored, nil, err
+	}
+	//Open it, this also checks the integrity
+	stored_user_bytes_decrypted, stored_sealed, err := openStored(user_UUID, stored.enc_key, stored.hmac_key, sealed)
+	if err != nil {
+		return stored, nil, errors.New("the integrity of the user has been compromised")
+	}
+	err = UnmarshalObject(stored_user_bytes_decrypted, &stored)
+	if err != nil {
+		return stored, nil, err
+	}
+	if len(stored.Wrapped_keys) > 0 {
+		err = unwrapPrivateKeys(&stored)
+	} else {
+		//Stored before the private keys were wrapped, they are wrapped the next time it is uploaded
+		_, err = unmarshalLegacyUserdata(stored_user_bytes_decrypted, &stored)
+	}
+	if err != nil {
+		return stored, nil, err
+	}
+	return stored, stored_sealed, nil
+}
+
+// Function to give a user a new random account key with the password slot as the only way in
+func createAccount(userdata *User) (err error) {
+	if userdata.lock == nil {
+		userdata.lock = &sync.Mutex{}
+	}
+	public_key, private_key, err := userlib.PKEKeyGen()
+	if err != nil {
+		return err
+	}
+	userdata.Password_public_key = public_key
+	userdata.slot = password_slot
+	userdata.slot_private_key = private_key
+	if userdata.Devices == nil {
+		userdata.Devices = make(map[string]DeviceEntry)
+	}
+	account_key := userlib.RandomBytes(16)
+	err = setAccountKey(userdata, account_key)
+	if err != nil {
+		return err
+	}
+	err = storeAccountSlot(userdata, password_slot, public_key, account_key)
+	if err != nil {
+		return err
+	}
+	err = UploadUserdata(userdata)
+	if err != nil {
+		return err
+	}
+	//Seal the private key of the password slot with the master key from a random salt
+	return setPasswordHashing(userdata, private_key)
+}
+
+// Function to derive the keys that seal the user struct from the account key
+func setAccountKey(userdata *User, account_key []byte) (err error) {
+	enc_key, err := DeriveKey(account_key, label_account_encryption_key)
+	if err != nil {
+		return err
+	}
+	hmac_key, err := DeriveKey(account_key, label_account_hmac_key)
+	if err != nil {
+		return err
+	}
+	key_encryption_key, err := DeriveKey(account_key, label_key_encryption_key)
+	if err != nil {
+		return err
+	}
+	userdata.account_key = account_key
+	userdata.enc_key = enc_key
+	userdata.hmac_key = hmac_key
+	userdata.key_encryption_key = key_encryption_key
+	return nil
+}
+
+// Function to seal the private keys of the user with the key encryption key, bound to the username
+func wrapPrivateKeys(userdata *User) (err error) {
+	private_keys := PrivateKeys{
+		Secret_key:            userdata.secret_key,
+		Signature_private_key: userdata.signature_private_key,
+		Old_secret_keys:       userdata.old_secret_keys,
+		Prekeys:               userdata.prekeys,
+	}
+	private_keys_bytes, err := MarshalObject(private_keys)
+	if err != nil {
+		return err
+	}
+	hmac_key, err := DeriveKey(userdata.key_encryption_key, label_key_encryption_hmac_key)
+	if err != nil {
+		return err
+	}
+	userdata.Wrapped_keys, err = SealObject(userdata.key_encryption_key, hmac_key, private_keys_bytes, []byte(userdata.Username))
+	return err
+}
+
+func unwrapPrivateKeys(userdata *User) (err error) {
+	hmac_key, err := DeriveKey(userdata.key_encryption_key, label_key_encryption_hmac_key)
+	if err != nil {
+		return err
+	}
+	private_keys_bytes, err := OpenObject(userdata.key_encryption_key, hmac_key, userdata.Wrapped_keys, []byte(userdata.Username))
+	if err != nil {
+		return errors.New("the integrity of the private keys of the user has been compromised")
+	}
+	var private_keys PrivateKeys
+	err = UnmarshalObject(private_keys_bytes, &private_keys)
+	if err != nil {
+		return err
+	}
+	setPrivateKeys(userdata, private_keys)
+	return nil
+}
+
+func setPrivateKeys(userdata *User, private_keys PrivateKeys) {
+	userdata.secret_key = private_keys.Secret_key
+	userdata.signature_private_key = private_keys.Signature_private_key
+	userdata.old_secret_keys = private_keys.Old_secret_keys
+	userdata.prekeys = private_keys.Prekeys
+}
+
+// Function to read a user struct from before the private keys were wrapped, with the fields that are not in User anymore
+func unmarshalLegacyUserdata(userdata_bytes []byte, userdata *User) (legacy legacyUserFields, err error) {
+	err = json.Unmarshal(userdata_bytes, userdata)
+	if err != nil {
+		return legacy, err
+	}
+	err = json.Unmarshal(userdata_bytes, &legacy)
+	if err != nil {
+		return legacy, err
+	}
+	setPrivateKeys(userdata, legacy.PrivateKeys)
+	userdata.legacy_password = legacy.Legacy_password
+	userdata.legacy_master_key = legacy.Legacy_master_key
+	return legacy, nil
+}
+
+// The slot of the password, and the slot of a device
+const password_slot = "password"
+
+func deviceSlot(id string) string {
+	return "device " + id
+}
+
+func recoverySlot(id string) string {
+	return "recovery " + id
+}
+
+// Function to put the account key of a user in a slot, only the private key of the slot can open it.
+// The slot is signed with the signature key of the user, the signature is the last 256 bytes
+func storeAccountSlot(userdata *User, slot string, public_key userlib.PKEEncKey, account_key []byte) error {
+	slot_uuid, err := DeriveUUID(label_account_slot_uuid, []byte(userdata.Username), []byte(slot))
+	if err != nil {
+		return err
+	}
+	wrapped_account_key, err := userlib.PKEEnc(public_key, account_key)
+	if err != nil {
+		return err
+	}
+	signature, err := userlib.DSSign(userdata.signature_private_key, append(slot_uuid[:], wrapped_account_key...))
+	if err != nil {
+		return err
+	}
+	datastoreSet(slot_uuid, append(wrapped_account_key, signature...))
+	return nil
+}
+
+func openAccountSlot(Username string, slot string, private_key userlib.PKEDecKey) (account_key []byte, err error) {
+	slot_uuid, err := DeriveUUID(label_account_slot_uuid, []byte(Username), []byte(slot))
+	if err != nil {
+		return nil, err
+	}
+	wrapped_account_key_signed, ok := datastoreGet(slot_uuid)
+	if !ok {
+		return nil, errors.New("the slot does not exist or has been removed")
+	}
+	if len(wrapped_account_key_signed) <= 256 {
+		return nil, errors.New("the slot could not be opened")
+	}
+	//Check the signature before the slot is used, otherwise anybody could put an account key of their own in it
+	_, verify_key, err := keystorePublicKeys(Username)
+	if err != nil {
+		return nil, err
+	}
+	wrapped_account_key := wrapped_account_key_signed[:len(wrapped_account_key_signed)-256]
+	err = userlib.DSVerify(verify_key, append(slot_uuid[:], wrapped_account_key...), wrapped_account_key_signed[len(wrapped_account_key_signed)-256:])
+	if err != nil {
+		return nil, errors.New("the slot has been tampered with")
+	}
+	account_key, err = userlib.PKEDec(private_key, wrapped_account_key)
+	if err != nil {
+		return nil, errors.New("the slot could not be opened")
+	}
+	if len(account_key) != key_length {
+		return nil, errors.New("the slot could not be opened")
+	}
+	return account_key, nil
+}
+
+func deleteAccountSlot(Username string, slot string) error {
+	slot_uuid, err := DeriveUUID(label_account_slot_uuid, []byte(Username), []byte(slot))
+	if err != nil {
+		return err
+	}
+	datastoreDelete(slot_uuid)
+	return nil
+}
+
+// Function to move the user to a new account key. Only the password and the devices that are
+// still in the user struct get a copy of it, so removed slots cannot open the account anymore
+func rotateAccountKey(userdata *User) (err error) {
+	account_key := userlib.RandomBytes(16)
+	err = storeAccountSlots(userdata, account_key)
+	if err != nil {
+		return err
+	}
+	err = setAccountKey(userdata, account_key)
+	if err != nil {
+		return err
+	}
+	return UploadUserdata(userdata)
+}
+
+// Function to store the account key in the slot of the password, every device and every recovery code
+func storeAccountSlots(userdata *User, account_key []byte) (err error) {
+	err = storeAccountSlot(userdata, password_slot, userdata.Password_public_key, account_key)
+	if err != nil {
+		return err
+	}
+	for id, device := range userdata.Devices {
+		err = storeAccountSlot(userdata, deviceSlot(id), device.Public_key, account_key)
+		if err != nil {
+			return err
+		}
+	}
+	for id, public_key := range userdata.Recovery_codes {
+		err = storeAccountSlot(userdata, recoverySlot(id), public_key, account_key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Creates a new device for a user. The device can log in with GetUserOnDevice
+// once a session of the user has approved its id with ApproveDevice
+func NewDevice(Username string) (device *Device, err error) {
+	_, ok := keystoreGet("Public key for:" + Username)
+	if !ok {
+		return nil, errors.New("the user does not exists")
+	}
+	public_key, private_key, err := userlib.PKEKeyGen()
+	if err != nil {
+		return nil, err
+	}
+	device = &Device{Username: Username, Id: uuid.New().String(), Private_key: private_key}
+	//The public key goes in the keystore so it cannot be swapped before it is approved
+	err = keystoreSet(deviceKeystoreName(Username, device.Id), public_key)
+	if err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+func deviceKeystoreName(Username string, id string) string {
+	return "Device key for:" + Username + ":" + id
+}
+
+func GetUserOnDevice(device *Device) (userdataptr *User, err error) {
+	var userdata User
+	userdata.Username = device.Username
+	err = openUserdata(&userdata, deviceSlot(device.Id), device.Private_key)
+	if err != nil {
+		return nil, errors.New("the device has not been approved or has been removed")
+	}
+	return &userdata, nil
+}
+
+// Approves a new device of the user by its id, the name is only for ListDevices
+func (userdata *User) ApproveDevice(id string, name string) error {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
+	//Update the userdata
+	userdata, err := getUserdata(userdata)
+	if err != nil {
+		return err
+	}
+	_, ok := userdata.Devices[id]
+	if ok {
+		return errors.New("the device has already been approved")
+	}
+	public_key, ok := keystoreGet(deviceKeystoreName(userdata.Username, id))
+	if !ok {
+		return errors.New("there is no device with that id")
+	}
+	err = storeAccountSlot(userdata, deviceSlot(id), public_key, userdata.account_key)
+	if err != nil {
+		return err
+	}
+	userdata.Devices[id] = DeviceEntry{Id: id, Name: name, Public_key: public_key}
+	return UploadUserdata(userdata)
+}
+
+// Lists the approved devices of the user sorted by name
+func (userdata *User) ListDevices() (devices []DeviceEntry, err error) {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
+	//Update the userdata
+	userdata, err = getUserdata(userdata)
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range userdata.Devices {
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].Name != devices[j].Name {
+			return devices[i].Name < devices[j].Name
+		}
+		return devices[i].Id < devices[j].Id
+	})
+	return devices, nil
+}
+
+// Removes a device of the user. Its slot is deleted and the account key is changed,
+// so neither the device nor a session it still has open can use the account anymore
+func (userdata *User) RemoveDevice(id string) error {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
+	//Update the userdata
+	userdata, err := getUserdata(userdata)
+	if err != nil {
+		return err
+	}
+	_, ok := userdata.Devices[id]
+	if !ok {
+		return errors.New("there is no approved device with that id")
+	}
+	delete(userdata.Devices, id)
+	err = deleteAccountSlot(userdata.Username, deviceSlot(id))
+	if err != nil {
+		return err
+	}
+	return rotateAccountKey(userdata)
+}
+
+// Every key, salt and uuid is derived through one labeled function. The label says what the value is for and every
+// input is prefixed with its length, so two different purposes or two different splits of the same bytes
+// (like "bob"+"k..." and "bobk"+"...") can never give the same input to the hash
+const kdf_domain = "cs161-project2 key derivation v1"
+
+const label_password_hash = "password hash"
+const label_master_key_salt = "master key salt"
+const label_user_encryption_key = "user encryption key"
+const label_user_hmac_key = "user hmac key"
+const label_user_uuid = "user uuid"
+const label_password_hashing_uuid = "password hashing uuid"
+const label_password_key_uuid = "password key uuid"
+const label_password_key_encryption_key = "password key encryption key"
+const label_password_key_hmac_key = "password key hmac key"
+const label_legacy_keys_uuid = "legacy keys uuid"
+const label_legacy_keys_encryption_key = "legacy keys encryption key"
+const label_legacy_keys_hmac_key = "legacy keys hmac key"
+const label_account_slot_uuid = "account slot uuid"
+const label_account_encryption_key = "account encryption key"
+const label_account_hmac_key = "account hmac key"
+const label_key_encryption_key = "key encryption key"
+const label_key_encryption_hmac_key = "key encryption hmac key"
+const label_recovery_code_id = "recovery code id"
+const label_recovery_key_uuid = "recovery key uuid"
+const label_recovery_key_encryption_key = "recovery key encryption key"
+const label_recovery_key_hmac_key = "recovery key hmac key"
+const label_contact_fingerprint = "contact fingerprint"
+const label_contact_book_uuid = "contact book uuid"
+const label_contact_book_encryption_key = "contact book encryption key"
+const label_contact_book_hmac_key = "contact book hmac key"
+const label_key_rotation_uuid = "key rotation uuid"
+const label_prekey_bundle_uuid = "prekey bundle uuid"
+const label_prekey_claim_uuid = "prekey claim uuid"
+const label_invitation_encryption_key = "invitation encryption key"
+const label_invitation_hmac_key = "invitation hmac key"
+const label_owned_file_id = "owned file id"
+const label_file_reference_uuid = "file reference uuid"
+const label_file_reference_encryption_key = "file reference encryption key"
+const label_file_reference_hmac_key = "file reference hmac key"
+const label_primary_uuid = "file reference primary uuid"
+const label_primary_hmac_key = "file reference primary hmac key"
+const label_file_sharing_uuid = "file sharing uuid"
+const label_file_sharing_encryption_key = "file sharing encryption key"
+const label_file_sharing_hmac_key = "file sharing hmac key"
+const label_file_list_uuid = "file list uuid"
+const label_file_lease_uuid = "file lease uuid"
+const label_envelope_migrated_uuid = "envelope migrated uuid"
+const label_file_lease_encryption_key = "file lease encryption key"
+const label_file_lease_hmac_key = "file lease hmac key"
+const label_chunk_gear = "chunk gear table"
+const label_chunk_uuid = "chunk uuid"
+const label_chunk_encryption_key = "chunk encryption key"
+const label_chunk_hmac_key = "chunk hmac key"
+const label_chunk_refs_uuid = "chunk refs uuid"
+const label_chunk_refs_encryption_key = "chunk refs encryption key"
+const label_chunk_refs_hmac_key = "chunk refs hmac key"
+
+// Encodes the domain, the label and the inputs, each with a 4 byte length in front
+func encodeDerivationInput(label string, inputs [][]byte) []byte {
+	var encoded []byte
+	parts := append([][]byte{[]byte(kdf_domain), []byte(label)}, inputs...)
+	for _, part := range parts {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(part)))
+		encoded = append(encoded, length...)
+		encoded = append(encoded, part...)
+	}
+	return encoded
+}
+
+// Derives 64 bytes from public or low entropy inputs, used for the password hash, salts and uuids
+func DeriveBytes(label string, inputs ...[]byte) []byte {
+	return userlib.Hash(encodeDerivationInput(label, inputs))
+}
+
+// Derives a 16 byte key from a key
+func DeriveKey(parent_key []byte, label string, inputs ...[]byte) (key []byte, err error) {
+	key_64, err := userlib.HashKDF(parent_key, encodeDerivationInput(label, inputs))
+	if err != nil {
+		return nil, err
+	}
+	return key_64[:key_length], nil
+}
+
+// Derives a uuid
+func DeriveUUID(label string, inputs ...[]byte) (uuid.UUID, error) {
+	return uuid.FromBytes(DeriveBytes(label, inputs...)[:16])
+}
+
+// The hash of the password that is kept in the user struct
+func userPasswordHash(Username string, password string) []byte {
+	return DeriveBytes(label_password_hash, []byte(Username), []byte(password))
+}
+
+func userUUID(Username string) (uuid.UUID, error) {
+	return DeriveUUID(label_user_uuid, []byte(Username))
+}
+
+// Function to derive the master key from the password hash with Argon2
+func deriveMasterKey(password_hash []byte, hashing PasswordHashing) (master_key []byte, err error) {
+	if len(hashing.Salt) == 0 || hashing.Time == 0 {
+		return nil, errors.New("the password hashing is not valid")
+	}
+	master_key = password_hash
+	for round := uint32(0); round < hashing.Time; round++ {
+		master_key = userlib.Argon2Key(master_key, hashing.Salt, key_length)
+	}
+	return master_key, nil
+}
+
+// Function to derive the master key of a user with the salt and cost that are stored for it now
+func loadMasterKey(Username string, password_hash []byte) (master_key []byte, err error) {
+	hashing, found, err := LoadPasswordHashing(Username)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New("the password hashing of the user is missing")
+	}
+	return deriveMasterKey(password_hash, hashing)
+}
+
+// Where the private key of the password slot is stored, sealed with keys from the master key
+func passwordKeyUUID(Username string) (uuid.UUID, error) {
+	return DeriveUUID(label_password_key_uuid, []byte(Username))
+}
+
+func passwordKeyKeys(master_key []byte) (enc_key []byte, hmac_key []byte, err error) {
+	enc_key, err = DeriveKey(master_key, label_password_key_encryption_key)
+	if err != nil {
+		return nil, nil, err
+	}
+	hmac_key, err = DeriveKey(master_key, label_password_key_hmac_key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc_key, hmac_key, nil
+}
+
+// Function to open the private key of the password slot with the master key
+func openPasswordKey(Username string, master_key []byte) (private_key userlib.PKEDecKey, err error) {
+	password_key_uuid, err := passwordKeyUUID(Username)
+	if err != nil {
+		return private_key, err
+	}
+	enc_key, hmac_key, err := passwordKeyKeys(master_key)
+	if err != nil {
+		return private_key, err
+	}
+	private_key_bytes, err := RetrieveFromDatastore(password_key_uuid, enc_key, hmac_key)
+	if err != nil {
+		return private_key, err
+	}
+	err = json.Unmarshal(private_key_bytes, &private_key)
+	return private_key, err
+}
+
+func (hashing PasswordHashing) sameCost(other PasswordHashing) bool {
+	return hashing.Time == other.Time
+}
+
+// Users stored before the random salt used a salt derived from the username and the default cost of userlib
+func legacyPasswordHashing(Username string) PasswordHashing {
+	return PasswordHashing{Salt: DeriveBytes(label_master_key_salt, []byte(Username)), Time: 1}
+}
+
+// Function to pick a new random salt with the current cost, derive the master key from it,
+// seal the private key of the password slot with it and then publish the new salt and cost
+func setPasswordHashing(userdata *User, password_private_key userlib.PKEDecKey) (err error) {
+	hashing := DefaultPasswordHashing
+	hashing.Salt = userlib.RandomBytes(16)
+	userdata.master_key, err = deriveMasterKey(userdata.password_hash, hashing)
+	if err != nil {
+		return err
+	}
+	password_key_uuid, err := passwordKeyUUID(userdata.Username)
+	if err != nil {
+		return err
+	}
+	enc_key, hmac_key, err := passwordKeyKeys(userdata.master_key)
+	if err != nil {
+		return err
+	}
+	err = SendToDatastorePadded(password_key_uuid, enc_key, hmac_key, password_private_key, metadataBucket(userdata.Privacy_mode))
+	if err != nil {
+		return err
+	}
+	err = storeLegacyKeys(userdata)
+	if err != nil {
+		return err
+	}
+	return storePasswordHashing(userdata, hashing)
+}
+
+// Function to publish the salt and cost of the password hashing of a user, signed with the signature key of the user
+func storePasswordHashing(userdata *User, hashing PasswordHashing) (err error) {
+	hashing_uuid, err := PasswordHashingUUID(userdata.Username)
+	if err != nil {
+		return err
+	}
+	hashing_bytes, err := json.Marshal(hashing)
+	if err != nil {
+		return err
+	}
+	//Sign it so nobody else can change the salt or lower the cost, the signature is the last 256 bytes
+	signature, err := userlib.DSSign(userdata.signature_private_key, hashing_bytes)
+	if err != nil {
+		return err
+	}
+	datastoreSet(hashing_uuid, append(hashing_bytes, signature...))
+	return nil
+}
+
+// The public location of the salt and cost of the password hashing of a user
+func PasswordHashingUUID(Username string) (uuid.UUID, error) {
+	return DeriveUUID(label_password_hashing_uuid, []byte(Username))
+}
+
+// Function to load the salt and cost of the password hashing of a user and check that the user signed it.
+// found is false if the user has not been moved to a random salt yet
+func LoadPasswordHashing(Username string) (hashing PasswordHashing, found bool, err error) {
+	hashing_uuid, err := PasswordHashingUUID(Username)
+	if err != nil {
+		return hashing, false, err
+	}
+	hashing_bytes_signed, ok := datastoreGet(hashing_uuid)
+	if !ok {
+		return hashing, false, nil
+	}
+	if len(hashing_bytes_signed) <= 256 {
+		return hashing, false, errors.New("the password hashing of the user is too short")
+	}
+	//It is signed with the current version of the signature key
+	_, verify_key, err := keystorePublicKeys(Username)
+	if err != nil {
+		return hashing, false, err
+	}
+	hashing_bytes := hashing_bytes_signed[:len(hashing_bytes_signed)-256]
+	err = userlib.DSVerify(verify_key, hashing_bytes, hashing_bytes_signed[len(hashing_bytes_signed)-256:])
+	if err != nil {
+		return hashing, false, errors.New("the password hashing of the user has been tampered with")
+	}
+	err = json.Unmarshal(hashing_bytes, &hashing)
+	if err != nil {
+		return hashing, false, err
+	}
+	return hashing, true, nil
+}
+
+// The id of a file in Files_owned
+func ownedFileID(filename string) (uuid.UUID, error) {
+	return DeriveUUID(label_owned_file_id, []byte(filename))
+}
+
+// Function to compute where the filereferenceowner or filereferencesecondary of a name at the top of the
+// namespace of the user is stored and the keys for it. If the user was created with the old key derivation
+// and the reference is still stored under it, it is moved over first
+func getFileReference(userdata *User, filename string) (file_uuid uuid.UUID, encryption_key []byte, hmac_key []byte, err error) {
+	file_uuid, err = DeriveUUID(label_file_reference_uuid, []byte(userdata.Username), userdata.Namespace_key, []byte(filename))
+	if err != nil {
+		return file_uuid, nil, nil, err
+	}
+	encryption_key, err = DeriveKey(userdata.Root_key, label_file_reference_encryption_key, []byte(filename))
+	if err != nil {
+		return file_uuid, nil, nil, err
+	}
+	hmac_key, err = DeriveKey(userdata.Root_key, label_file_reference_hmac_key, []byte(filename))
+	if err != nil {
+		return file_uuid, nil, nil, err
+	}
+	if userdata.legacy_master_key == nil && userdata.legacy_namespace_key == nil {
+		return file_uuid, encryption_key, hmac_key, nil
+	}
+	_, ok := datastoreGet(file_uuid)
+	if !ok {
+		err = migrateLegacyFileReference(userdata, filename, file_uuid, encryption_key, hmac_key)
+		if err != nil {
+			return file_uuid, nil, nil, err
+		}
+	}
+	return file_uuid, encryption_key, hmac_key, nil
+}
+
+// Function to move a reference stored with the old key derivation to its new uuid and keys.
+// Owned files were also recorded under an old id in Files_owned, so that is moved as well
+func migrateLegacyFileReference(userdata *User, filename string, file_uuid uuid.UUID, encryption_key []byte, hmac_key []byte) error {
+	//References stored before the random salt only have to move from the old namespace key, the keys are the same
+	if userdata.legacy_namespace_key != nil {
+		namespace_uuid, err := DeriveUUID(label_file_reference_uuid, []byte(userdata.Username), userdata.legacy_namespace_key, []byte(filename))
+		if err != nil {
+			return err
+		}
+		_, ok := datastoreGet(namespace_uuid)
+		if ok {
+			reference_bytes, err := RetrieveFromDatastore(namespace_uuid, encryption_key, hmac_key)
+			if err != nil {
+				return err
+			}
+			err = SendToDatastorePadded(file_uuid, encryption_key, hmac_key, json.RawMessage(reference_bytes), metadataBucket(userdata.Privacy_mode))
+			if err != nil {
+				return err
+			}
+			datastoreDelete(namespace_uuid)
+			return nil
+		}
+	}
+	if userdata.legacy_master_key == nil {
+		return nil
+	}
+	//The old uuid was the hash of the hash of the username, the password hash and the hash of the filename
+	var legacy_uuid_bytes []byte
+	legacy_uuid_bytes = append(legacy_uuid_bytes, userlib.Hash([]byte(userdata.Username))...)
+	legacy_uuid_bytes = append(legacy_uuid_bytes, userdata.legacy_password...)
+	legacy_uuid_bytes = append(legacy_uuid_bytes, userlib.Hash([]byte(filename))...)
+	legacy_uuid, err := uuid.FromBytes(userlib.Hash(legacy_uuid_bytes)[:16])
+	if err != nil {
+		return err
+	}
+	_, ok := datastoreGet(legacy_uuid)
+	if !ok {
+		return nil
+	}
+	legacy_encryption_key_64, err := userlib.HashKDF(userdata.legacy_master_key, []byte("Encryption key for file"+filename))
+	if err != nil {
+		return err
+	}
+	legacy_hmac_key_64, err := userlib.HashKDF(userdata.legacy_master_key, []byte("HMAC key for file"+filename))
+	if err != nil {
+		return err
+	}
+	reference_bytes, err := RetrieveFromDatastore(legacy_uuid, legacy_encryption_key_64[:16], legacy_hmac_key_64[:16])
+	if err != nil {
+		return err
+	}
+	//The reference is moved as it is, it does not matter if it is a filereferenceowner or a filereferencesecondary
+	err = SendToDatastorePadded(file_uuid, encryption_key, hmac_key, json.RawMessage(reference_bytes), metadataBucket(userdata.Privacy_mode))
+	if err != nil {
+		return err
+	}
+	datastoreDelete(legacy_uuid)
+
+	legacy_id, err := uuid.FromBytes(userlib.Hash([]byte(filename))[:16])
+	if err != nil {
+		return err
+	}
+	if !userdata.Files_owned[legacy_id] {
+		return nil
+	}
+	owned_id, err := ownedFileID(filename)
+	if err != nil {
+		return err
+	}
+	delete(userdata.Files_owned, legacy_id)
+	userdata.Files_owned[owned_id] = true
+	return UploadUserdata(userdata)
+}
+
+// The old key derivation of the user, only used to find users that have not been moved over yet
+func legacyPasswordHash(Username string, password string) []byte {
+	return userlib.Hash([]byte(password + Username + "p"))
+}
+
+func legacyUserKeys(Username string, legacy_password []byte) (master_key []byte, hmac_key []byte, err error) {
+	master_key = userlib.Argon2Key(legacy_password, []byte(Username+"k"), key_length)
+	hmac_key_64, err := userlib.HashKDF(master_key, []byte("HMAC key for user"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return master_key, hmac_key_64[:16], nil
+}
+
+func legacyUserUUID(Username string) (uuid.UUID, error) {
+	return uuid.FromBytes(userlib.Hash([]byte(Username))[:16])
+}
+
+// The keys of the old key derivations that files of the user might still be stored with. They are derived from the
+// password without a random salt, so they are not in the user struct but sealed with the master key of the password
+type LegacyKeys struct {
+	Password      []byte
+	Master_key    []byte
+	Namespace_key []byte
+}
+
+func legacyKeysLocation(Username string, master_key []byte) (legacy_uuid uuid.UUID, enc_key []byte, hmac_key []byte, err error) {
+	legacy_uuid, err = DeriveUUID(label_legacy_keys_uuid, []byte(Username))
+	if err != nil {
+		return legacy_uuid, nil, nil, err
+	}
+	enc_key, err = DeriveKey(master_key, label_legacy_keys_encryption_key)
+	if err != nil {
+		return legacy_uuid, nil, nil, err
+	}
+	hmac_key, err = DeriveKey(master_key, label_legacy_keys_hmac_key)
+	if err != nil {
+		return legacy_uuid, nil, nil, err
+	}
+	return legacy_uuid, enc_key, hmac_key, nil
+}
+
+// Function to seal the old keys of the session with its master key. A session without them removes
+// what is stored, it could not be opened with the new master key anyway
+func storeLegacyKeys(userdata *User) error {
+	legacy_uuid, enc_key, hmac_key, err := legacyKeysLocation(userdata.Username, userdata.master_key)
+	if err != nil {
+		return err
+	}
+	if userdata.legacy_password == nil && userdata.legacy_master_key == nil && userdata.legacy_namespace_key == nil {
+		datastoreDelete(legacy_uuid)
+		return nil
+	}
+	legacy := LegacyKeys{Password: userdata.legacy_password, Master_key: userdata.legacy_master_key, Namespace_key: userdata.legacy_namespace_key}
+	return SendToDatastorePadded(legacy_uuid, enc_key, hmac_key, legacy, metadataBucket(userdata.Privacy_mode))
+}
+
+// Function to open the old keys of the user with the master key of a session opened with the password.
+// Users stored before they were sealed still have them in the user struct, they are sealed and removed from it
+func loadLegacyKeys(userdata *User) error {
+	legacy_uuid, enc_key, hmac_key, err := legacyKeysLocation(userdata.Username, userdata.master_key)
+	if err != nil {
+		return err
+	}
+	_, ok := datastoreGet(legacy_uuid)
+	if !ok {
+		if userdata.legacy_password == nil && userdata.legacy_master_key == nil {
+			return nil
+		}
+		err = storeLegacyKeys(userdata)
+		if err != nil {
+			return err
+		}
+		return UploadUserdata(userdata)
+	}
+	legacy_bytes, err := RetrieveFromDatastore(legacy_uuid, enc_key, hmac_key)
+	if err != nil {
+		return errors.New("the old keys of the user have been tampered with")
+	}
+	var legacy LegacyKeys
+	err = json.Unmarshal(legacy_bytes, &legacy)
+	if err != nil {
+		return err
+	}
+	userdata.legacy_password = legacy.Password
+	userdata.legacy_master_key = legacy.Master_key
+	userdata.legacy_namespace_key = legacy.Namespace_key
+	return nil
+}
+
+func ValidHMAC(hmac_key []byte, content_with_HMAC []byte) (valid bool) {
+	if len(content_with_HMAC) < 64 {
+		return false
+	}
+	hmac := content_with_HMAC[len(content_with_HMAC)-64:]
+	content := content_with_HMAC[0 : len(content_with_HMAC)-64]
+
+	hmac_content, err := userlib.HMACEval(hmac_key, content)
+	if err != nil {
+		return false
+	}
+	valid = userlib.HMACEqual(hmac, hmac_content)
+	return valid
+}
+
+// Function to send an object to datastore
+func SendToDatastore(uuid uuid.UUID, encryption_key []byte, hmac_key []byte, object interface{}) (err error) {
+	return SendToDatastorePadded(uuid, encryption_key, hmac_key, object, 0)
+}
+
+// Function to send an object to datastore padded to a multiple of the bucket size, no padding if the size is 0
+func SendToDatastorePadded(uuid uuid.UUID, encryption_key []byte, hmac_key []byte, object interface{}, bucket_size int) (err error) {
+	//marshall it
+	object_bytes, err := MarshalObject(object)
+	if err != nil {
+		return err
+	}
+	return SendBytesToDatastore(uuid, encryption_key, hmac_key, object_bytes, bucket_size)
+}
+
+// Function to send bytes that are already encoded to datastore, padded like SendToDatastorePadded
+func SendBytesToDatastore(uuid uuid.UUID, encryption_key []byte, hmac_key []byte, object_bytes []byte, bucket_size int) (err error) {
+	sealed, err := sealBytes(uuid, encryption_key, hmac_key, object_bytes, bucket_size)
+	if err != nil {
+		return err
+	}
+	//Send to datastore
+	datastoreSet(uuid, sealed)
+	return nil
+}
+
+// Function to pad and seal bytes the way SendBytesToDatastore stores them, without storing them
+func sealBytes(uuid uuid.UUID, encryption_key []byte, hmac_key []byte, object_bytes []byte, bucket_size int) (sealed []byte, err error) {
+	//Pad it
+	if bucket_size > 0 {
+		object_bytes = padObject(object_bytes, bucket_size)
+	}
+	//Seal it, the uuid is bound to the blob so it cannot be moved to another uuid
+	return SealObject(encryption_key, hmac_key, object_bytes, uuid[:])
+}
+
+// Function to retrieve an object from datastore
+func RetrieveFromDatastore(uuid uuid.UUID, encryption_key []byte, hmac_key []byte) (object_bytes []byte, err error) {
+	sealed, ok := datastoreGet(uuid)
+	if !ok {
+		return nil, errors.New("could not find the object in the datastore")
+	}
+	return openSealed(uuid, encryption_key, hmac_key, sealed)
+}
+
+// Function to open what RetrieveFromDatastore would give for sealed bytes that were already loaded
+func openSealed(uuid uuid.UUID, encryption_key []byte, hmac_key []byte, sealed []byte) (object_bytes []byte, err error) {
+	object_bytes, _, err = openStored(uuid, encryption_key, hmac_key, sealed)
+	return object_bytes, err
+}
+
+// Function to open sealed bytes loaded from uuid, together with the bytes that are stored there afterwards.
+// A blob from before the envelope is sealed in the envelope in its place the first time it is opened
+func openStored(uuid uuid.UUID, encryption_key []byte, hmac_key []byte, sealed []byte) (object_bytes []byte, stored []byte, err error) {
+	//Check the integrity and decrypt
+	object_bytes, err = OpenObject(encryption_key, hmac_key, sealed, uuid[:])
+	if err != nil {
+		object_bytes, sealed, err = migrateLegacyObject(uuid, encryption_key, hmac_key, sealed, err)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	object_bytes, err = unpadObject(object_bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return object_bytes, sealed, nil
+}
+
+// Function to open a blob from before the envelope and seal it in the envelope at the same uuid. Old blobs are not
+// bound to their uuid, so a mark is left next to the object and a blob in the old format is refused there from then on.
+// envelope_err is given back if the blob is not in the old format either
+func migrateLegacyObject(uuid uuid.UUID, encryption_key []byte, hmac_key []byte, sealed []byte, envelope_err error) (plaintext []byte, stored []byte, err error) {
+	plaintext, err = openLegacy(encryption_key, hmac_key, sealed)
+	if err != nil {
+		return nil, nil, envelope_err
+	}
+	migrated_uuid, err := DeriveUUID(label_envelope_migrated_uuid, uuid[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	_, migrated := datastoreGet(migrated_uuid)
+	if migrated {
+		return nil, nil, errors.New("the object is in the old format after it was moved to the envelope")
+	}
+	resealed, err := SealObject(encryption_key, hmac_key, plaintext, uuid[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	//Someone else may have moved it over or changed it in the meantime, their blob is kept then
+	if datastoreCompareAndSwap(uuid, sealed, resealed) {
+		sealed = resealed
+	}
+	datastoreSet(migrated_uuid, []byte{1})
+	return plaintext, sealed, nil
+}
+
+// Every object in the datastore is sealed in an envelope:
+//
+//	magic (4) | version (1) | algorithm (1) | nonce (16) | ciphertext | tag (64)
+//
+// The tag is computed over the associated data and everything in the envelope before the tag.
+// Blobs stored before the envelope existed are just iv | ciphertext | hmac and can still be opened
+const envelope_magic = "P2EV"
+const envelope_version = 1
+const envelope_algorithm_ctr_hmac = 1 //AES-CTR with HMAC-SHA512, encrypt then MAC
+const envelope_nonce_length = 16
+const envelope_tag_length = 64
+const envelope_header_length = 4 + 1 + 1 + envelope_nonce_length
+
+// Function to encrypt and authenticate plaintext together with associated data. This is the only
+// function that should be used to seal what is stored in the datastore
+func SealObject(encryption_key []byte, hmac_key []byte, plaintext []byte, associated_data []byte) (sealed []byte, err error) {
+	if len(encryption_key) != userlib.AESKeySizeBytes {
+		return nil, errors.New("the encryption key has the wrong length")
+	}
+	nonce := userlib.RandomBytes(envelope_nonce_length)
+	//SymEnc puts the nonce in front of the ciphertext
+	ciphertext := userlib.SymEnc(encryption_key, nonce, plaintext)[envelope_nonce_length:]
+
+	sealed = make([]byte, 0, envelope_header_length+len(ciphertext)+envelope_tag_length)
+	sealed = append(sealed, envelope_magic...)
+	sealed = append(sealed, envelope_version, envelope_algorithm_ctr_hmac)
+	sealed = append(sealed, nonce...)
+	sealed = append(sealed, ciphertext...)
+	tag, err := envelopeTag(hmac_key, sealed, associated_data)
+	if err != nil {
+		return nil, err
+	}
+	return append(sealed, tag...), nil
+}
+
+// Function to check and decrypt what SealObject sealed with the same associated data
+func OpenObject(encryption_key []byte, hmac_key []byte, sealed []byte, associated_data []byte) (plaintext []byte, err error) {
+	if len(encryption_key) != userlib.AESKeySizeBytes {
+		return nil, errors.New("the encryption key has the wrong length")
+	}
+	if len(sealed) < envelope_header_length+envelope_tag_length || string(sealed[:len(envelope_magic)]) != envelope_magic {
+		return nil, errors.New("the object is not sealed in an envelope")
+	}
+	return openEnvelope(encryption_key, hmac_key, sealed, associated_data)
+}
+
+// Function to compute the tag of an envelope. The length of the associated data goes first so
+// the associated data and the envelope cannot be shifted into each other
+func envelopeTag(hmac_key []byte, envelope []byte, associated_data []byte) (tag []byte, err error) {
+	tagged := make([]byte, 4, 4+len(associated_data)+len(envelope))
+	binary.BigEndian.PutUint32(tagged, uint32(len(associated_data)))
+	tagged = append(tagged, associated_data...)
+	tagged = append(tagged, envelope...)
+	return userlib.HMACEval(hmac_key, tagged)
+}
+
+func openEnvelope(encryption_key []byte, hmac_key []byte, sealed []byte, associated_data []byte) (plaintext []byte, err error) {
+	version := sealed[len(envelope_magic)]
+	algorithm := sealed[len(envelope_magic)+1]
+	if version != envelope_version {
+		return nil, errors.New("unknown envelope version")
+	}
+	if algorithm != envelope_algorithm_ctr_hmac {
+		return nil, errors.New("unknown envelope algorithm")
+	}
+	envelope := sealed[:len(sealed)-envelope_tag_length]
+	tag := sealed[len(sealed)-envelope_tag_length:]
+	expected_tag, err := envelopeTag(hmac_key, envelope, associated_data)
+	if err != nil {
+		return nil, err
+	}
+	if !userlib.HMACEqual(tag, expected_tag) {
+		return nil, errors.New("integrity of object has been compromised")
+	}
+	//The nonce and the ciphertext are in the format SymDec expects
+	return userlib.SymDec(encryption_key, envelope[len(envelope_magic)+2:]), nil
+}
+
+// Function to open a blob stored before the envelope existed, only used to move it to the envelope.
+// A blob from before the envelope can start with the magic by chance
+func openLegacy(encryption_key []byte, hmac_key []byte, sealed []byte) (plaintext []byte, err error) {
+	if len(sealed) < userlib.AESBlockSizeBytes+envelope_tag_length {
+		return nil, errors.New("the object is too short")
+	}
+	if !ValidHMAC(hmac_key, sealed) {
+		return nil, errors.New("integrity of object has been compromised")
+	}
+	return userlib.SymDec(encryption_key, sealed[:len(sealed)-envelope_tag_length]), nil
+}
+
+// Function to pad the bytes of an object to a multiple of the bucket size. The padded bytes start with a 0,
+// which JSON never starts with, followed by the real length, so unpadObject can tell them apart
+func padObject(object_bytes []byte, bucket_size int) (padded []byte) {
+	padded_length := (len(object_bytes) + 5 + bucket_size - 1) / bucket_size * bucket_size
+	padded = make([]byte, padded_length)
+	binary.BigEndian.PutUint32(padded[1:5], uint32(len(object_bytes)))
+	copy(padded[5:], object_bytes)
+	return padded
+}
+
+// Function to remove the padding from the bytes of an object, objects that are not padded are returned as they are
+func unpadObject(object_bytes []byte) (unpadded []byte, err error) {
+	if len(object_bytes) == 0 || object_bytes[0] != 0 {
+		return object_bytes, nil
+	}
+	if len(object_bytes) < 5 {
+		return nil, errors.New("the padding of the object is broken")
+	}
+	length := binary.BigEndian.Uint32(object_bytes[1:5])
+	if uint64(length) > uint64(len(object_bytes)-5) {
+		return nil, errors.New("the padding of the object is broken")
+	}
+	return object_bytes[5 : 5+length], nil
+}
+
+// Function to get the size metadata is padded to, 0 means no padding
+func metadataBucket(private bool) int {
+	if private {
+		return private_metadata_bucket
+	}
+	return 0
+}
+
+// Function to get the size the files in the list of a file controller are padded to, 0 means no padding
+func fileBucket(private bool) int {
+	if private {
+		return private_file_bucket
+	}
+	return 0
+}
+
+// Function to encrypt an invitation to the recipient, sign it and store it at a new uuid
+func SendInvitation(sender *User, recipient string, recipient_public_key userlib.PKEEncKey, recipient_key_version int, invitation Invitation) (invitation_uuid uuid.UUID, err error) {
+	invitation_uuid = uuid.New()
+	//Marshal it
+	invitation_bytes, err := MarshalObject(invitation)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	//Take a one-time prekey of the recipient if there is one left
+	prekey_id, prekey_public_key, found, err := claimPrekey(sender, recipient, keyVersion(recipient_key_version))
+	if err != nil {
+		return uuid.Nil, err
+	}
+	//The prekey is given back if the invitation is never stored
+	defer func() {
+		if err != nil && found {
+			releasePrekey(recipient, prekey_id)
+		}
+	}()
+	//Put the versions of the keys and the prekey in front so the recipient knows which keys to use
+	header := make([]byte, invitation_header_length)
+	copy(header, invitation_magic)
+	binary.BigEndian.PutUint32(header[4:8], uint32(keyVersion(sender.Key_version)))
+	binary.BigEndian.PutUint32(header[8:12], uint32(keyVersion(recipient_key_version)))
+	//The invitation is sealed with a new key made from two random secrets, one encrypted with the prekey and
+	//one with the long term key, so both private keys are needed to open it
+	var prekey_secret []byte
+	invitation_bytes_encrypted := header
+	if found {
+		copy(header[12:28], prekey_id[:])
+		prekey_secret = userlib.RandomBytes(16)
+		prekey_secret_encrypted, err := userlib.PKEEnc(prekey_public_key, prekey_secret)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		invitation_bytes_encrypted = append(invitation_bytes_encrypted, prekey_secret_encrypted...)
+	}
+	long_term_secret := userlib.RandomBytes(16)
+	long_term_secret_encrypted, err := userlib.PKEEnc(recipient_public_key, long_term_secret)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	invitation_bytes_encrypted = append(invitation_bytes_encrypted, long_term_secret_encrypted...)
+	encryption_key, hmac_key, err := invitationKeys(prekey_secret, long_term_secret)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	sealed, err := SealObject(encryption_key, hmac_key, invitation_bytes, header)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	invitation_bytes_encrypted = append(invitation_bytes_encrypted, sealed...)
+	//Sign it
+	invitation_bytes_encrypted_signature, err := userlib.DSSign(sender.signature_private_key, invitation_bytes_encrypted)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	//Append signature
+	invitation_bytes_encrypted_signed := append(invitation_bytes_encrypted, invitation_bytes_encrypted_signature...)
+	//Store it
+	datastoreSet(invitation_uuid, invitation_bytes_encrypted_signed)
+	return invitation_uuid, nil
+}
+
+// Invitations start with a magic value, the versions of the key of the sender that signed it and of the key
+// of the recipient it was encrypted for, and the prekey that was used. Invitations from before the prekeys have
+// a shorter header without the prekey and were encrypted directly, invitations from before that have no header
+const invitation_magic = "INV3"
+const invitation_header_length = 4 + 4 + 4 + 16
+const direct_invitation_magic = "INV2"
+const direct_invitation_header_length = 4 + 4 + 4
+const legacy_invitation_length = 256
+const pke_ciphertext_length = 256
+
+func parseInvitationHeader(invitation_bytes_encrypted []byte) (header InvitationHeader, header_bytes []byte, body []byte, err error) {
+	if len(invitation_bytes_encrypted) == legacy_invitation_length {
+		return InvitationHeader{Sender_version: 1, Recipient_version: 1}, nil, invitation_bytes_encrypted, nil
+	}
+	header_length := invitation_header_length
+	if len(invitation_bytes_encrypted) > direct_invitation_header_length && string(invitation_bytes_encrypted[:4]) == direct_invitation_magic {
+		header_length = direct_invitation_header_length
+	} else if len(invitation_bytes_encrypted) <= invitation_header_length || string(invitation_bytes_encrypted[:4]) != invitation_magic {
+		return header, nil, nil, errors.New("the invitation is not valid")
+	}
+	header.Sender_version = int(binary.BigEndian.Uint32(invitation_bytes_encrypted[4:8]))
+	header.Recipient_version = int(binary.BigEndian.Uint32(invitation_bytes_encrypted[8:12]))
+	if header.Sender_version < 1 || header.Recipient_version < 1 {
+		return header, nil, nil, errors.New("the invitation is not valid")
+	}
+	if header_length == invitation_header_length {
+		header.Hybrid = true
+		header.Prekey_id, err = uuid.FromBytes(invitation_bytes_encrypted[12:28])
+		if err != nil {
+			return header, nil, nil, err
+		}
+	}
+	return header, invitation_bytes_encrypted[:header_length], invitation_bytes_encrypted[header_length:], nil
+}
+
+// Function to decrypt the body of an invitation with the keys the header says were used
+func openInvitation(userdata *User, header InvitationHeader, header_bytes []byte, body []byte) (invitation_bytes []byte, err error) {
+	secret_key, err := secretKeyAt(userdata, header.Recipient_version)
+	if err != nil {
+		return nil, err
+	}
+	if !header.Hybrid {
+		return userlib.PKEDec(secret_key, body)
+	}
+	var prekey_secret []byte
+	if header.Prekey_id != uuid.Nil {
+		prekey, ok := userdata.prekeys[header.Prekey_id]
+		if !ok {
+			return nil, errors.New("the prekey of the invitation is unknown or was already used")
+		}
+		if len(body) < pke_ciphertext_length {
+			return nil, errors.New("the invitation is too short")
+		}
+		prekey_secret, err = userlib.PKEDec(prekey.Private_key, body[:pke_ciphertext_length])
+		if err != nil {
+			return nil, err
+		}
+		body = body[pke_ciphertext_length:]
+	}
+	if len(body) < pke_ciphertext_length {
+		return nil, errors.New("the invitation is too short")
+	}
+	long_term_secret, err := userlib.PKEDec(secret_key, body[:pke_ciphertext_length])
+	if err != nil {
+		return nil, err
+	}
+	encryption_key, hmac_key, err := invitationKeys(prekey_secret, long_term_secret)
+	if err != nil {
+		return nil, err
+	}
+	return OpenObject(encryption_key, hmac_key, body[pke_ciphertext_length:], header_bytes)
+}
+
+func invitationKeys(prekey_secret []byte, long_term_secret []byte) (encryption_key []byte, hmac_key []byte, err error) {
+	encryption_key = DeriveBytes(label_invitation_encryption_key, prekey_secret, long_term_secret)[:key_length]
+	hmac_key, err = DeriveKey(encryption_key, label_invitation_hmac_key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encryption_key, hmac_key, nil
+}
+
+// Users publish this many prekeys when they are created, and make a new one for every prekey that is used
+const initial_prekeys = 8
+
+// The public location of the signed prekeys of a user
+func PrekeyBundleUUID(Username string) (uuid.UUID, error) {
+	return DeriveUUID(label_prekey_bundle_uuid, []byte(Username))
+}
+
+// A sender marks a prekey as taken so the next sender does not use it too. If the mark is removed two invitations
+// use the same prekey and only the first can be accepted. The mark is signed by the sender, see prekeyClaimed
+func prekeyClaimUUID(Username string, id uuid.UUID) (uuid.UUID, error) {
+	return DeriveUUID(label_prekey_claim_uuid, []byte(Username), id[:])
+}
+
+// Function to find the sharing of a file and the keys it is encrypted with, from the keys of the filereferenceowner
+func fileSharingLocation(file_uuid uuid.UUID, encryption_key []byte) (sharing_uuid uuid.UUID, sharing_encryption_key []byte, sharing_hmac_key []byte, err error) {
+	sharing_uuid, err = DeriveUUID(label_file_sharing_uuid, file_uuid[:])
+	if err != nil {
+		return sharing_uuid, nil, nil, err
+	}
+	sharing_encryption_key, err = DeriveKey(encryption_key, label_file_sharing_encryption_key)
+	if err != nil {
+		return sharing_uuid, nil, nil, err
+	}
+	sharing_hmac_key, err = DeriveKey(encryption_key, label_file_sharing_hmac_key)
+	if err != nil {
+		return sharing_uuid, nil, nil, err
+	}
+	return sharing_uuid, sharing_encryption_key, sharing_hmac_key, nil
+}
+
+// Function to load who the owner shared a file with. The sharing is authenticated on its own and the
+// filereferenceowner only says that it exists, so deleting it is noticed. Putting back an older sharing is not
+func loadFileSharing(file_uuid uuid.UUID, encryption_key []byte, file_reference_owner FileReferenceOwner) (sharing FileSharing, err error) {
+	sharing, _, err = loadStoredFileSharing(file_uuid, encryption_key, file_reference_owner)
+	return sharing, err
+}
+
+// Function to load the sharing of a file together with the sharing as it is stored, nil if it is not stored on its own yet
+func loadStoredFileSharing(file_uuid uuid.UUID, encryption_key []byte, file_reference_owner FileReferenceOwner) (sharing FileSharing, sealed []byte, err error) {
+	sharing_uuid, sharing_encryption_key, sharing_hmac_key, err := fileSharingLocation(file_uuid, encryption_key)
+	if err != nil {
+		return sharing, nil, err
+	}
+	sealed, ok := datastoreGet(sharing_uuid)
+	if !ok {
+		if file_reference_owner.Sharing_stored {
+			return sharing, nil, errors.New("the sharing of the file is missing")
+		}
+		//References stored before the sharing was split out still have it themselves
+		sharing.Uuid_shared_with = file_reference_owner.Uuid_shared_with
+		sharing.Enc_keys_shared_with = file_reference_owner.Enc_keys_shared_with
+		sharing.Hmac_keys_shared_with = file_reference_owner.Hmac_keys_shared_with
+		sharing.Invitations_shared_with = file_reference_owner.Invitations_shared_with
+	} else {
+		//Once the sharing is stored on its own it has every recipient, also if the filereferenceowner was stored
+		//again without the mark
+		sharing_bytes, err := openSealed(sharing_uuid, sharing_encryption_key, sharing_hmac_key, sealed)
+		if err != nil {
+			return sharing, nil, errors.New("the sharing of the file has been tampered with")
+		}
+		err = UnmarshalObject(sharing_bytes, &sharing)
+		if err != nil {
+			return sharing, nil, err
+		}
+	}
+	if sharing.Uuid_shared_with == nil {
+		sharing.Uuid_shared_with = make(map[string]uuid.UUID)
+	}
+	if sharing.Enc_keys_shared_with == nil {
+		sharing.Enc_keys_shared_with = make(map[string][]byte)
+	}
+	if sharing.Hmac_keys_shared_with == nil {
+		sharing.Hmac_keys_shared_with = make(map[string][]byte)
+	}
+	if sharing.Invitations_shared_with == nil {
+		sharing.Invitations_shared_with = make(map[string]uuid.UUID)
+	}
+	return sharing, sealed, nil
+}
+
+// Function to change who the owner shared a file with by the recipients that were added and removed. The sharing
+// is loaded again and only stored if no other session of the owner changed it in the meantime, so what another
+// session changed is kept. The filereferenceowner is marked to have its sharing stored on its own, the caller
+// stores it afterwards if it was not marked before
+func updateFileSharing(file_uuid uuid.UUID, encryption_key []byte, file_reference_owner *FileReferenceOwner, added FileSharing, removed []string, bucket_size int) (err error) {
+	for attempt := 0; attempt < commit_attempts; attempt++ {
+		err = commitFileSharing(file_uuid, encryption_key, *file_reference_owner, added, removed, bucket_size)
+		if err != err_concurrent_change {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	file_reference_owner.Sharing_stored = true
+	file_reference_owner.Uuid_shared_with = nil
+	file_reference_owner.Enc_keys_shared_with = nil
+	file_reference_owner.Hmac_keys_shared_with = nil
+	file_reference_owner.Invitations_shared_with = nil
+	return nil
+}
+
+// Function to store the sharing as it is stored now with the changes. Gives err_concurrent_change if another
+// session stored the sharing since it was loaded
+func commitFileSharing(file_uuid uuid.UUID, encryption_key []byte, file_reference_owner FileReferenceOwner, added FileSharing, removed []string, bucket_size int) error {
+	sharing_uuid, sharing_encryption_key, sharing_hmac_key, err := fileSharingLocation(file_uuid, encryption_key)
+	if err != nil {
+		return err
+	}
+	sharing, sealed, err := loadStoredFileSharing(file_uuid, encryption_key, file_reference_owner)
+	if err != nil {
+		return err
+	}
+	for recipient, primary_uuid := range added.Uuid_shared_with {
+		//Another session shared the file with the recipient in the meantime
+		_, ok := sharing.Uuid_shared_with[recipient]
+		if ok {
+			return errors.New("this user already has access")
+		}
+		sharing.Uuid_shared_with[recipient] = primary_uuid
+		sharing.Enc_keys_shared_with[recipient] = added.Enc_keys_shared_with[recipient]
+		sharing.Hmac_keys_shared_with[recipient] = added.Hmac_keys_shared_with[recipient]
+		invitation_uuid, ok := added.Invitations_shared_with[recipient]
+		if ok {
+			sharing.Invitations_shared_with[recipient] = invitation_uuid
+		}
+	}
+	for _, recipient := range removed {
+		delete(sharing.Uuid_shared_with, recipient)
+		delete(sharing.Enc_keys_shared_with, recipient)
+		delete(sharing.Hmac_keys_shared_with, recipient)
+		delete(sharing.Invitations_shared_with, recipient)
+	}
+	sharing_bytes, err := MarshalObject(sharing)
+	if err != nil {
+		return err
+	}
+	stored, err := sealBytes(sharing_uuid, sharing_encryption_key, sharing_hmac_key, sharing_bytes, bucket_size)
+	if err != nil {
+		return err
+	}
+	if !datastoreCompareAndSwap(sharing_uuid, sealed, stored) {
+		return err_concurrent_change
+	}
+	return nil
+}
+
+// Function to delete an invitation that might not have been accepted. The prekey it claimed
+// is given back to the recipient, an accepted invitation has already been deleted by the recipient
+func deleteInvitation(recipient string, invitation_uuid uuid.UUID) {
+	invitation_bytes_signed, ok := datastoreGet(invitation_uuid)
+	if !ok {
+		return
+	}
+	datastoreDelete(invitation_uuid)
+	if len(invitation_bytes_signed) <= 256 {
+		return
+	}
+	header, _, _, err := parseInvitationHeader(invitation_bytes_signed[:len(invitation_bytes_signed)-256])
+	if err != nil || header.Prekey_id == uuid.Nil {
+		return
+	}
+	releasePrekey(recipient, header.Prekey_id)
+}
+
+// Function to remove the mark on a prekey that an invitation claimed, so the next sender can take it
+func releasePrekey(recipient string, id uuid.UUID) {
+	claim_uuid, err := prekeyClaimUUID(recipient, id)
+	if err != nil {
+		return
+	}
+	datastoreDelete(claim_uuid)
+}
+
+// Function to make new prekeys, they still have to be stored with the userdata and published
+func addPrekeys(userdata *User, count int) error {
+	if userdata.prekeys == nil {
+		userdata.prekeys = make(map[uuid.UUID]Prekey)
+	}
+	for i := 0; i < count; i++ {
+		public_key, private_key, err := userlib.PKEKeyGen()
+		if err != nil {
+			return err
+		}
+		userdata.prekeys[uuid.New()] = Prekey{Public_key: public_key, Private_key: private_key}
+	}
+	return nil
+}
+
+// Function to publish the public keys of all prekeys of the user, signed with the current signature key.
+// The userdata is stored first, with the private keys of the prekeys and the counter of the new bundle
+func publishPrekeys(userdata *User) error {
+	userdata.Prekey_counter++
+	err := UploadUserdata(userdata)
+	if err != nil {
+		return err
+	}
+	bundle := PrekeyBundle{Key_version: keyVersion(userdata.Key_version), Counter: userdata.Prekey_counter, Prekeys: make(map[uuid.UUID]userlib.PKEEncKey)}
+	for id, prekey := range userdata.prekeys {
+		bundle.Prekeys[id] = prekey.Public_key
+	}
+	bundle_bytes, err := json.Marshal(bundle)
+	if err != nil {
+		return err
+	}
+	signature, err := userlib.DSSign(userdata.signature_private_key, bundle_bytes)
+	if err != nil {
+		return err
+	}
+	bundle_uuid, err := PrekeyBundleUUID(userdata.Username)
+	if err != nil {
+		return err
+	}
+	datastoreSet(bundle_uuid, append(bundle_bytes, signature...))
+	return nil
+}
+
+// Function to take a prekey of a user that nobody took yet. Found is false if the user has no prekeys left
+// or only has prekeys signed with an older version of their keys, the invitation then only uses the long term key
+func claimPrekey(sender *User, Username string, key_version int) (id uuid.UUID, public_key userlib.PKEEncKey, found bool, err error) {
+	contacts, err := loadContacts(sender)
+	if err != nil {
+		return uuid.Nil, public_key, false, err
+	}
+	contact, pinned := contacts[Username]
+	bundle_uuid, err := PrekeyBundleUUID(Username)
+	if err != nil {
+		return uuid.Nil, public_key, false, err
+	}
+	bundle_bytes_signed, ok := datastoreGet(bundle_uuid)
+	if !ok {
+		if contact.Prekey_counter > 0 {
+			return uuid.Nil, public_key, false, errors.New("the prekeys of the user have been removed")
+		}
+		return uuid.Nil, public_key, false, nil
+	}
+	if len(bundle_bytes_signed) <= 256 {
+		return uuid.Nil, public_key, false, errors.New("the prekeys of the user are not valid")
+	}
+	bundle_bytes := bundle_bytes_signed[:len(bundle_bytes_signed)-256]
+	var bundle PrekeyBundle
+	err = json.Unmarshal(bundle_bytes, &bundle)
+	if err != nil {
+		return uuid.Nil, public_key, false, err
+	}
+	if bundle.Key_version < 1 || bundle.Key_version > key_version {
+		return uuid.Nil, public_key, false, errors.New("the prekeys of the user are not valid")
+	}
+	_, verify_key, err := publicKeysAt(Username, bundle.Key_version)
+	if err != nil {
+		return uuid.Nil, public_key, false, err
+	}
+	err = userlib.DSVerify(verify_key, bundle_bytes, bundle_bytes_signed[len(bundle_bytes_signed)-256:])
+	if err != nil {
+		return uuid.Nil, public_key, false, errors.New("the prekeys of the user are not signed by the user")
+	}
+	//A bundle older than one the sender has seen was put back by somebody else, its prekeys might have been used
+	if bundle.Counter < contact.Prekey_counter {
+		return uuid.Nil, public_key, false, errors.New("the prekeys of the user have been replaced with older ones")
+	}
+	if pinned && bundle.Counter > contact.Prekey_counter {
+		contact.Prekey_counter = bundle.Counter
+		err = storeContact(sender, Username, contact)
+		if err != nil {
+			return uuid.Nil, public_key, false, err
+		}
+	}
+	if bundle.Key_version != key_version {
+		return uuid.Nil, public_key, false, nil
+	}
+	for id, public_key = range bundle.Prekeys {
+		claimed, err := prekeyClaimed(Username, id)
+		if err != nil {
+			return uuid.Nil, public_key, false, err
+		}
+		if !claimed {
+			err = markPrekeyClaimed(sender, Username, id)
+			if err != nil {
+				return uuid.Nil, public_key, false, err
+			}
+			return id, public_key, true, nil
+		}
+	}
+	return uuid.Nil, public_key, false, nil
+}
+
+// Function to mark a prekey of a user as taken. The mark is the version of the keys of the sender, a signature
+// with them over the uuid of the mark and the name of the sender, and the name of the sender
+func markPrekeyClaimed(sender *User, Username string, id uuid.UUID) error {
+	claim_uuid, err := prekeyClaimUUID(Username, id)
+	if err != nil {
+		return err
+	}
+	signature, err := userlib.DSSign(sender.signature_private_key, append(claim_uuid[:], sender.Username...))
+	if err != nil {
+		return err
+	}
+	claim := make([]byte, 4, 4+len(signature)+len(sender.Username))
+	binary.BigEndian.PutUint32(claim, uint32(keyVersion(sender.Key_version)))
+	claim = append(claim, signature...)
+	claim = append(claim, sender.Username...)
+	datastoreSet(claim_uuid, claim)
+	return nil
+}
+
+// Function to check if a sender took a prekey of a user. Only a mark signed by the user it names counts,
+// otherwise anybody could mark every prekey so the senders only use the long term key
+func prekeyClaimed(Username string, id uuid.UUID) (claimed bool, err error) {
+	claim_uuid, err := prekeyClaimUUID(Username, id)
+	if err != nil {
+		return false, err
+	}
+	claim, ok := datastoreGet(claim_uuid)
+	if !ok || len(claim) <= 4+256 {
+		return false, nil
+	}
+	version := int(binary.BigEndian.Uint32(claim[:4]))
+	sender := string(claim[4+256:])
+	current_version, err := currentKeyVersion(sender)
+	if err != nil || version < 1 || version > current_version {
+		return false, nil
+	}
+	_, verify_key, err := publicKeysAt(sender, version)
+	if err != nil {
+		return false, nil
+	}
+	err = userlib.DSVerify(verify_key, append(claim_uuid[:], sender...), claim[4:4+256])
+	return err == nil, nil
+}
+
+// Function to forget a prekey after it was used and to publish a new one in its place
+func consumePrekey(userdata *User, id uuid.UUID) error {
+	delete(userdata.prekeys, id)
+	err := addPrekeys(userdata, 1)
+	if err != nil {
+		return err
+	}
+	err = publishPrekeys(userdata)
+	if err != nil {
+		return err
+	}
+	claim_uuid, err := prekeyClaimUUID(userdata.Username, id)
+	if err != nil {
+		return err
+	}
+	datastoreDelete(claim_uuid)
+	return nil
+}
+
+// Makes sure there are count prekeys that no sender took yet, so that many invitations can be
+// sent to the user before they fall back to only the long term key
+func (userdata *User) PublishPrekeys(count int) error {
+	userdata.lock.Lock()
+	defer userdata.lock.Unlock()
+	//Update the userdata
+	userdata, err := getUserdata(userdata)
+	if err != nil {
+		return err
+	}
+	unclaimed := 0
+	for id := range userdata.prekeys {
+		claimed, err := prekeyClaimed(userdata.Username, id)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			unclaimed++
+		}
+	}
+	if unclaimed < count {
+		err = addPrekeys(userdata, count-unclaimed)
+		if err != nil {
+			return err
+		}
+	}
+	return publishPrekeys(userdata)
+}
+
+// Function to find the file controller (or directory) of a file and the keys for it. This works for owners,
+// for users it is shared with and for paths into a directory
+func getFileAccess(userdata *User, filename string) (access FileAccess, err error) {
+	_, directory, name, is_path, err := getParentDirectory(userdata, filename)
+	if err != nil {
+		return access, err
+	}
+	if is_path {
+		entry, ok := directory.Entries[name]
+		if !ok {
+			return access, errors.New("the file does not exist in the directory")
+		}
+		access.Controller_uuid = entry.Pointer
+		access.Enc_key = entry.Enc_key
+		access.Hmac_key = entry.Hmac_key
+		access.Is_directory = entry.Is_directory
+		return access, nil
+	}
+	//Compute the uuid of the file
+	file_uuid, encryption_key, hmac_key, err := getFileReference(userdata, filename)
+	if err != nil {
+		return access, err
+	}
+
+	uuid_check, err := ownedFileID(filename)
+	if err != nil {
+		return access, err
+	}
+	if userdata.Files_owned[uuid_check] {
+		var file_reference_owner FileReferenceOwner
+		file_reference_owner_bytes, err := RetrieveFromDatastore(file_uuid, encryption_key, hmac_key)
+		if err != nil {
+			return access, err
+		}
+		err = UnmarshalObject(file_reference_owner_bytes, &file_reference_owner)
+		if err != nil {
+			return access, err
+		}
+		access.Controller_uuid = file_reference_owner.File_controller_pointer
+		access.Enc_key = file_reference_owner.File_enc_key
+		access.Hmac_key = file_reference_owner.Hmac_key
+		access.Is_directory = file_reference_owner.Is_directory
+		return access, nil
+	}
+	//If the user does not own the file go through the filereferencesecondary and filereferenceprimary.
+	//The filereferencesecondary never changes once the invitation is accepted, so it is only loaded once
+	var file_reference_primary FileReferencePrimary
+	file_reference_secondary, ok := userdata.cache.reference(file_uuid)
+	if !ok {
+		sealed, ok := datastoreGet(file_uuid)
+		if !ok {
+			return access, err_file_not_found
+		}
+		file_reference_secondary_bytes, err := openSealed(file_uuid, encryption_key, hmac_key, sealed)
+		if err != nil {
+			return access, err
+		}
+		err = UnmarshalObject(file_reference_secondary_bytes, &file_reference_secondary)
+		if err != nil {
+			return access, err
+		}
+		userdata.cache.addReference(file_uuid, file_reference_secondary)
+	}
+	file_reference_primary_bytes, err := RetrieveFromDatastore(file_reference_secondary.File_reference_primary_pointer, file_reference_secondary.File_Reference_Primary_enc_key, file_reference_secondary.Hmac_key)
+	if err != nil {
+		return access, err
+	}
+	err = UnmarshalObject(file_reference_primary_bytes, &file_reference_primary)
+	if err != nil {
+		return access, err
+	}
+	access.Controller_uuid = file_reference_primary.File_controller_pointer
+	access.Enc_key = file_reference_primary.File_enc_key
+	access.Hmac_key = file_reference_primary.Hmac_key
+	access.Is_directory = file_reference_primary.Is_directory
+	return access, nil
+}
+
+// Given when the user has no file with the name at all, every other error means the file is there but could not be loaded
+var err_file_not_found = errors.New("the file does not exist")
+
+// Function to find the directory that a path like "dir/sub/file" is in. A name is only a path if the part
+// before the first "/" is a directory of the user, so flat filenames containing a "/" keep working.
+// If the part before it cannot be loaded the error is given instead of storing a flat file with the name
+func getParentDirectory(userdata *User, path string) (parent FileAccess, directory Directory, name string, is_path bool, err error) {
+	components := strings.Split(path, "/")
+	if len(components) < 2 {
+		return parent, directory, "", false, nil
+	}
+	parent, err = getFileAccess(userdata, components[0])
+	if err == err_file_not_found || (err == nil && !parent.Is_directory) {
+		return FileAccess{}, directory, "", false, nil
+	}
+	if err != nil {
+		return FileAccess{}, directory, "", false, err
+	}
+	directory, err = LoadDirectory(parent)
+	if err != nil {
+		return parent, directory, "", false, err
+	}
+	//Walk down through the subdirectories
+	for _, component := range components[1 : len(components)-1] {
+		entry, ok := directory.Entries[component]
+		if !ok || !entry.Is_directory {
+			return parent, directory, "", false, errors.New("the directory does not exist")
+		}
+		parent.Controller_uuid = entry.Pointer
+		parent.Enc_key = entry.Enc_key
+		parent.Hmac_key = entry.Hmac_key
+		directory, err = LoadDirectory(parent)
+		if err != nil {
+			return parent, directory, "", false, err
+		}
+	}
+	name = components[len(components)-1]
+	if name == "" {
+		return parent, directory, "", false, errors.New("names inside a directory cannot be empty")
+	}
+	return parent, directory, name, true, nil
+}
+
+// Function to load and decrypt a directory
+func LoadDirectory(access FileAccess) (directory Directory, err error) {
+	directory_bytes, err := RetrieveFromDatastore(access.Controller_uuid, access.Enc_key, access.Hmac_key)
+	if err != nil {
+		return directory, err
+	}
+	err = json.Unmarshal(directory_bytes, &directory)
+	if err != nil {
+		return directory, err
+	}
+	if directory.Entries == nil {
+		directory.Entries = make(map[string]DirectoryEntry)
+	}
+	return directory, nil
+}
+
+// Function to add an entry to a directory. The directory is loaded again and only stored if no other session
+// changed it in the meantime, so the entries other sessions added are kept. If another session added the name
+// first nothing is stored and found is true with the entry that is there
+func addDirectoryEntry(parent FileAccess, name string, entry DirectoryEntry, bucket_size int) (existing DirectoryEntry, found bool, err error) {
+	for attempt := 0; attempt < commit_attempts; attempt++ {
+		existing, found, err = commitDirectoryEntry(parent, name, entry, bucket_size)
+		if err != err_concurrent_change {
+			return existing, found, err
+		}
+	}
+	return existing, found, err
+}
+
+// Function to add the entry to the directory as it is stored now. Gives err_concurrent_change if another
+// session stored the directory since it was loaded
+func commitDirectoryEntry(parent FileAccess, name string, entry DirectoryEntry, bucket_size int) (existing DirectoryEntry, found bool, err error) {
+	sealed, ok := datastoreGet(parent.Controller_uuid)
+	if !ok {
+		return existing, false, errors.New("the directory does not exist")
+	}
+	directory_bytes, err := openSealed(parent.Controller_uuid, parent.Enc_key, parent.Hmac_key, sealed)
+	if err != nil {
+		return existing, false, err
+	}
+	var directory Directory
+	err = json.Unmarshal(directory_bytes, &directory)
+	if err != nil {
+		return existing, false, err
+	}
+	existing, found = directory.Entries[name]
+	if found {
+		return existing, true, nil
+	}
+	if directory.Entries == nil {
+		directory.Entries = make(map[string]DirectoryEntry)
+	}
+	directory.Entries[name] = entry
+	directory_bytes, err = MarshalObject(directory)
+	if err != nil {
+		return existing, false, err
+	}
+	stored, err := sealBytes(parent.Controller_uuid, parent.Enc_key, parent.Hmac_key, directory_bytes, bucket_size)
+	if err != nil {
+		return existing, false, err
+	}
+	if !datastoreCompareAndSwap(parent.Controller_uuid, sealed, stored) {
+		return existing, false, err_concurrent_change
+	}
+	return existing, false, nil
+}
+
+// Function to delete a list of files that nothing points to anymore, together with its file controller
+func deleteFileList(file_controller_uuid uuid.UUID, encryption_key []byte, hmac_key []byte) error {
+	file_controller, _, err := loadFileController(file_controller_uuid, encryption_key, hmac_key)
+	if err != nil {
+		return err
+	}
+	file_uuids, chunks, err := listFiles(file_controller, encryption_key, hmac_key)
+	if err != nil {
+		return err
+	}
+	for _, file_uuid := range file_uuids {
+		datastoreDelete(file_uuid)
+	}
+	datastoreDelete(file_controller_uuid)
+	return releaseChunks(chunks)
+}
+
+// Function to copy a directory and everything under it to new uuids under new keys, used when revoking a directory.
+// Only new uuids are stored, the old entries and the leases on the files are left to the cleanup of the revocation
+func rekeyDirectory(old_access FileAccess, new_access FileAccess, private bool, cleanup *revocationCleanup) (err error) {
+	directory, err := LoadDirectory(old_access)
+	if err != nil {
+		return err
+	}
+	for name, entry := range directory.Entries {
+		var new_entry DirectoryEntry
+		new_entry.Is_directory = entry.Is_directory
+		new_entry.Pointer = uuid.New()
+		new_entry.Enc_key = userlib.RandomBytes(16)
+		new_entry.Hmac_key = userlib.RandomBytes(16)
+		old_entry_access := FileAccess{Controller_uuid: entry.Pointer, Enc_key: entry.Enc_key, Hmac_key: entry.Hmac_key}
+		new_entry_access := FileAccess{Controller_uuid: new_entry.Pointer, Enc_key: new_entry.Enc_key, Hmac_key: new_entry.Hmac_key}
+		if entry.Is_directory {
+			err = rekeyDirectory(old_entry_access, new_entry_access, private, cleanup)
+			if err != nil {
+				return err
+			}
+		} else {
+			var file_controller FileController
+			file_controller_bytes, err := RetrieveFromDatastore(entry.Pointer, entry.Enc_key, entry.Hmac_key)
+			if err != nil {
+				return err
+			}
+			err = UnmarshalObject(file_controller_bytes, &file_controller)
+			if err != nil {
+				return err
+			}
+			content, err := LoadFileList(file_controller, entry.Enc_key, entry.Hmac_key)
+			if err != nil {
+				return err
+			}
+			//The lease on the file moves along with its file controller, like the lease of a shared file
+			_, _, err = loadFileLease(old_entry_access)
+			if err != nil {
+				return err
+			}
+			err = reencryptFileList(entry.Enc_key, entry.Hmac_key, file_controller, content, new_entry.Pointer, new_entry.Enc_key, new_entry.Hmac_key, cleanup)
+			if err != nil {
+				return err
+			}
+			cleanup.leases = append(cleanup.leases, leaseMove{old_access: old_entry_access, new_access: new_entry_access})
+		}
+		cleanup.old_uuids = append(cleanup.old_uuids, entry.Pointer)
+		directory.Entries[name] = new_entry
+	}
+	return SendToDatastorePadded(new_access.Controller_uuid, new_access.Enc_key, new_access.Hmac_key, directory, metadataBucket(private))
+}
+
+// Function to store content as a list of files. The given uuids are used first and new ones are made when
+// they run out, the first unused uuid becomes the empty tail. Private files are split into blocks of the
+// same size, so the number of files only depends on the size of the content. With pending writes every file
+// is only stored if nobody else stored something there in the meantime
+func storeFileList(writes *pendingWrites, list_uuids []uuid.UUID, segment *ListSegment, encryption_key []byte, hmac_key []byte, content []byte, private bool, dedup_key []byte, compression int) (last_uuid uuid.UUID, end_uuid uuid.UUID, err error) {
+	blocks := [][]byte{content}
+	//The content of a deduplicated file is stored as chunks and the file only points to them
+	var chunks []ChunkReference
+	if dedup_key != nil && !private && len(content) > 0 {
+		chunks, err = storeChunks(dedup_key, content, compression)
+		if err != nil {
+			return uuid.Nil, uuid.Nil, err
+		}
+		writes.addChunks(chunks)
+		blocks = [][]byte{nil}
+	}
+	if private {
+		blocks = nil
+		for len(content) > private_block_size {
+			blocks = append(blocks, content[:private_block_size])
+			content = content[private_block_size:]
+		}
+		blocks = append(blocks, content)
+	}
+	//Make sure there is a uuid for every block and for the empty tail. The given uuids end with the empty tail,
+	//in a list with an index the uuids after it are the next positions of the last segment
+	var uuids []uuid.UUID
+	uuids = append(uuids, list_uuids...)
+	for len(uuids) < len(blocks)+1 {
+		next_uuid := uuid.New()
+		if segment != nil {
+			next_uuid, err = fileListUUID(segment.Seed, segment.Count+len(uuids)+1-len(list_uuids))
+			if err != nil {
+				return uuid.Nil, uuid.Nil, err
+			}
+		}
+		uuids = append(uuids, next_uuid)
+	}
+	end_uuid = uuids[len(blocks)]
+	//Store the empty tail first and then the blocks from the back,
+	//so every file only points to files that are already stored
+	var end_file File
+	err = writes.storeFile(end_uuid, encryption_key, hmac_key, end_file, private, compression)
+	if err != nil {
+		return uuid.Nil, uuid.Nil, err
+	}
+	for i := len(blocks) - 1; i >= 0; i-- {
+		var file File
+		file.Content = blocks[i]
+		file.Chunks = chunks
+		file.Next_uuid = uuids[i+1]
+		err = writes.storeFile(uuids[i], encryption_key, hmac_key, file, private, compression)
+		if err != nil {
+			return uuid.Nil, uuid.Nil, err
+		}
+	}
+	if segment != nil {
+		segment.Count += len(blocks) + 1 - len(list_uuids)
+	}
+	return uuids[len(blocks)-1], end_uuid, nil
+}
+
+// Function to find the file at a position of a segment of a list
+func fileListUUID(seed []byte, position int) (uuid.UUID, error) {
+	return DeriveUUID(label_file_list_uuid, seed, []byte(fmt.Sprint(position)))
+}
+
+// Function to start the list of a file controller over with a single new segment
+func newFileList(file_controller *FileController) (err error) {
+	segment := ListSegment{Seed: userlib.RandomBytes(16)}
+	file_controller.Index = []ListSegment{segment}
+	file_controller.Start, err = fileListUUID(segment.Seed, 0)
+	return err
+}
+
+// The segment that new files are appended to, nil for lists stored before the index
+func lastSegment(file_controller *FileController) *ListSegment {
+	if len(file_controller.Index) == 0 {
+		return nil
+	}
+	return &file_controller.Index[len(file_controller.Index)-1]
+}
+
+// Function to create a new file controller with a list of files holding the content and an empty tail
+func StoreNewFileList(file_controller_uuid uuid.UUID, encryption_key []byte, hmac_key []byte, content []byte, private bool, dedup_key []byte) (err error) {
+	var file_controller FileController
+	err = newFileList(&file_controller)
+	if err != nil {
+		return err
+	}
+	file_controller.Private = private
+	file_controller.Chunked = dedup_key != nil && !private
+	file_controller.Last, file_controller.End, err = storeFileList(nil, []uuid.UUID{file_controller.Start}, lastSegment(&file_controller), encryption_key, hmac_key, content, private, dedup_key, compression_none)
+	if err != nil {
+		return err
+	}
+	//The file controller is stored last so it only points to files that exist
+	return SendToDatastorePadded(file_controller_uuid, encryption_key, hmac_key, file_controller, metadataBucket(private))
+}
+
+// Function to replace the content of a file for the user with the username. The list starts over with a new segment,
+// the file controller stays where it is for everyone with access
+func OverwriteFileList(file_controller_uuid uuid.UUID, encryption_key []byte, hmac_key []byte, content []byte, dedup_key []byte, username string) (err error) {
+	//If another session changes the file at the same time the new list is taken back and stored again,
+	//so whatever that session did counts as done before and is replaced like everything else
+	for attempt := 0; attempt < commit_attempts; attempt++ {
+		err = overwriteFileList(file_controller_uuid, encryption_key, hmac_key, content, dedup_key, username)
+		if err != err_concurrent_change {
+			return err
+		}
+	}
+	return err
+}
+
+func overwriteFileList(file_controller_uuid uuid.UUID, encryption_key []byte, hmac_key []byte, content []byte, dedup_key []byte, username string) (err error) {
+	file_controller, sealed, err := loadFileController(file_controller_uuid, encryption_key, hmac_key)
+	if err != nil {
+		return err
+	}
+	err = checkFileLease(FileAccess{Controller_uuid: file_controller_uuid, Enc_key: encryption_key, Hmac_key: hmac_key}, username)
+	if err != nil {
+		return err
+	}
+	if file_controller.Sensitive {
+		dedup_key = nil
+	}
+	//The chunks the old list points to are released once the new list is stored,
+	//so chunks that are in both are never deleted in between
+	old_uuids, old_chunks, err := listFiles(file_controller, encryption_key, hmac_key)
+	if err != nil {
+		return err
+	}
+	//Now we create the new list from the start, the old list is deleted afterwards
+	err = newFileList(&file_controller)
+	if err != nil {
+		return err
+	}
+	writes := newPendingWrites()
+	file_controller.Last, file_controller.End, err = storeFileList(writes, []uuid.UUID{file_controller.Start}, lastSegment(&file_controller), encryption_key, hmac_key, content, file_controller.Private, dedup_key, file_controller.Compression)
+	if err == nil {
+		file_controller.Chunked = dedup_key != nil && !file_controller.Private
+		//Every old file in the list is replaced, so the keys of earlier epochs are not needed anymore
+		file_controller.Old_enc_keys = nil
+		file_controller.Old_hmac_keys = nil
+		file_controller.Old_hashes = nil
+		file_controller.Appends = 0
+		file_controller.Version++
+		err = commitFileController(file_controller_uuid, encryption_key, hmac_key, file_controller, sealed)
+	}
+	if err != nil {
+		writes.undo()
+		return err
+	}
+	//None of the old files are pointed to anymore
+	for _, old_uuid := range old_uuids {
+		datastoreDelete(old_uuid)
+	}
+	return releaseChunks(old_chunks)
+}
+
+// Files are compacted when they are loaded after this many appends
+const compaction_threshold = 64
+
+// Function to store the content of a file as a new list at new uuids and delete the old list afterwards.
+// The old list stays complete until the file controller points to the new one, so the file can be read
+// at every point, and the revoked users of a lazy revocation do not know any of the new uuids
+func compactFileList(file_controller_uuid uuid.UUID, file_controller FileController, sealed []byte, encryption_key []byte, hmac_key []byte, content []byte, dedup_key []byte) (err error) {
+	old_uuids, old_chunks, err := listFiles(file_controller, encryption_key, hmac_key)
+	if err != nil {
+		return err
+	}
+	if file_controller.Sensitive || file_controller.Private {
+		dedup_key = nil
+	}
+	err = newFileList(&file_controller)
+	if err != nil {
+		return err
+	}
+	//The content is only the content of the list that was loaded, if another session has changed it since then
+	//the new list is taken back and the file is left as it is
+	writes := newPendingWrites()
+	file_controller.Last, file_controller.End, err = storeFileList(writes, []uuid.UUID{file_controller.Start}, lastSegment(&file_controller), encryption_key, hmac_key, content, file_controller.Private, dedup_key, file_controller.Compression)
+	if err == nil {
+		file_controller.Chunked = dedup_key != nil
+		//Everything is stored under the current key now
+		file_controller.Old_enc_keys = nil
+		file_controller.Old_hmac_keys = nil
+		file_controller.Old_hashes = nil
+		file_controller.Appends = 0
+		file_controller.Version++
+		err = commitFileController(file_controller_uuid, encryption_key, hmac_key, file_controller, sealed)
+	}
+	if err != nil {
+		writes.undo()
+		return err
+	}
+	for _, old_uuid := range old_uuids {
+		datastoreDelete(old_uuid)
+	}
+	return releaseChunks(old_chunks)
+}
+
+// Function to append content to the end of the list of a file controller for the user with the username
+func AppendToFileList(file_controller_uuid uuid.UUID, encryption_key []byte, hmac_key []byte, content []byte, dedup_key []byte, username string) (err error) {
+	//If another session appends or stores the file at the same time, whatever this one stored is taken back
+	//and the content is appended again after what the other session did
+	for attempt := 0; attempt < commit_attempts; attempt++ {
+		err = appendToFileList(file_controller_uuid, encryption_key, hmac_key, content, dedup_key, username)
+		if err != err_concurrent_change {
+			return err
+		}
+	}
+	return err
+}
+
+func appendToFileList(file_controller_uuid uuid.UUID, encryption_key []byte, hmac_key []byte, content []byte, dedup_key []byte, username string) (err error) {
+	file_controller, sealed, err := loadFileController(file_controller_uuid, encryption_key, hmac_key)
+	if err != nil {
+		return err
+	}
+	err = checkFileLease(FileAccess{Controller_uuid: file_controller_uuid, Enc_key: encryption_key, Hmac_key: hmac_key}, username)
+	if err != nil {
+		return err
+	}
+	//The empty tail and the last file of a private list are stored again, and only if they are still what is read here.
+	//Another session that appends at the same time stores its new empty tail at the same uuid first, so only one of
+	//them gets to append there
+	writes := newPendingWrites()
+	writes.expect(file_controller.End)
+	//The content is normally stored in the empty tail, and a new empty tail is added after it
+	list_uuids := []uuid.UUID{file_controller.End}
+	if file_controller.Private && file_controller.Last != uuid.Nil {
+		//Private files fill up the last block first, so the number of files does not tell how many appends there were
+		writes.expect(file_controller.Last)
+		last_file, err := RetrieveFileFromDatastore(file_controller.Last, file_controller, encryption_key, hmac_key)
+		if err != nil {
+			return err
+		}
+		content = append(last_file.Content, content...)
+		list_uuids = []uuid.UUID{file_controller.Last, file_controller.End}
+	}
+	//Files stored again are under the current key from now on, the old keys must not open them anymore
+	for _, list_uuid := range list_uuids {
+		delete(file_controller.Old_hashes, list_uuid)
+	}
+	if file_controller.Sensitive || file_controller.Private {
+		dedup_key = nil
+	}
+	file_controller.Last, file_controller.End, err = storeFileList(writes, list_uuids, lastSegment(&file_controller), encryption_key, hmac_key, content, file_controller.Private, dedup_key, file_controller.Compression)
+	if err != nil {
+		writes.undo()
+		if err == err_concurrent_change {
+			return err
+		}
+		return errors.New("could not append")
+	}
+	if dedup_key != nil {
+		file_controller.Chunked = true
+	}
+	file_controller.Appends++
+	file_controller.Version++
+	//Update the file controller with the new tail
+	err = commitFileController(file_controller_uuid, encryption_key, hmac_key, file_controller, sealed)
+	if err != nil {
+		writes.undo()
+		if err == err_concurrent_change {
+			return err
+		}
+		return errors.New("could not store new filecontroller")
+	}
+	return nil
+}
+
+// Function to load a file controller together with the sealed bytes it was stored as. They are different every
+// time the file controller is stored, so commitFileController can tell whether anyone stored it in the meantime
+func loadFileController(file_controller_uuid uuid.UUID, encryption_key []byte, hmac_key []byte) (file_controller FileController, sealed []byte, err error) {
+	sealed, ok := datastoreGet(file_controller_uuid)
+	if !ok {
+		return file_controller, nil, errors.New("could not find the object in the datastore")
+	}
+	file_controller_bytes, sealed, err := openStored(file_controller_uuid, encryption_key, hmac_key, sealed)
+	if err != nil {
+		return file_controller, nil, err
+	}
+	err = UnmarshalObject(file_controller_bytes, &file_controller)
+	return file_controller, sealed, err
+}
+
+// Function to store a file controller only if it is still stored as the sealed bytes it was loaded from
+func commitFileController(file_controller_uuid uuid.UUID, encryption_key []byte, hmac_key []byte, file_controller FileController, sealed []byte) error {
+	file_controller_bytes, err := MarshalObject(file_controller)
+	if err != nil {
+		return err
+	}
+	new_sealed, err := sealBytes(file_controller_uuid, encryption_key, hmac_key, file_controller_bytes, metadataBucket(file_controller.Private))
+	if err != nil {
+		return err
+	}
+	if !datastoreCompareAndSwap(file_controller_uuid, sealed, new_sealed) {
+		return err_concurrent_change
+	}
+	return nil
+}
+
+// What a session has stored of a change to a list that is not committed yet. Every file is only stored if the
+// datastore still has what the session expects there, nothing for uuids that are new, so sessions that change the
+// same list at the same time never overwrite what the other stored. The one that does not get to commit its file
+// controller takes everything back
+type pendingWrites struct {
+	expected map[uuid.UUID][]byte
+	written  []pendingWrite
+	chunks   []ChunkReference
+}
+
+type pendingWrite struct {
+	uuid   uuid.UUID
+	before []byte
+	after  []byte
+}
+
+func newPendingWrites() *pendingWrites {
+	return &pendingWrites{expected: make(map[uuid.UUID][]byte)}
+}
+
+// Function to remember what is stored at a uuid now, the uuid can only be stored again while that is still there
+func (writes *pendingWrites) expect(file_uuid uuid.UUID) {
+	writes.expected[file_uuid], _ = datastoreGet(file_uuid)
+}
+
+// Function to store one file of a list. Without pending writes the file is simply stored
+func (writes *pendingWrites) storeFile(file_uuid uuid.UUID, encryption_key []byte, hmac_key []byte, file File, private bool, compression int) error {
+	if writes == nil {
+		return storeFile(file_uuid, encryption_key, hmac_key, file, private, compression)
+	}
+	sealed, err := sealFile(file_uuid, encryption_key, hmac_key, file, private, compression)
+	if err != nil {
+		return err
+	}
+	before := writes.expected[file_uuid]
+	if !datastoreCompareAndSwap(file_uuid, before, sealed) {
+		return err_concurrent_change
+	}
+	writes.written = append(writes.written, pendingWrite{uuid: file_uuid, before: before, after: sealed})
+	writes.expected[file_uuid] = sealed
+	return nil
+}
+
+// The chunks that were counted for the change, they are released again when it is taken back
+func (writes *pendingWrites) addChunks(chunks []ChunkReference) {
+	if writes != nil {
+		writes.chunks = append(writes.chunks, chunks...)
+	}
+}
+
+// Function to take back everything that was stored, from the last to the first. What someone else has
+// stored since then is left alone
+func (writes *pendingWrites) undo() {
+	for i := len(writes.written) - 1; i >= 0; i-- {
+		write := writes.written[i]
+		datastoreCompareAndSwap(write.uuid, write.after, write.before)
+	}
+	_ = releaseChunks(writes.chunks)
+}
+
+// Function to retrieve one file of the list. Files written before a lazy revocation are still
+// encrypted under the key of their epoch, so the keys are tried from the newest to the oldest
+func RetrieveFileFromDatastore(file_uuid uuid.UUID, file_controller FileController, encryption_key []byte, hmac_key []byte) (file File, err error) {
+	sealed, ok := datastoreGet(file_uuid)
+	if !ok {
+		return file, errors.New("could not find the object in the datastore")
+	}
+	return openFile(file_uuid, file_controller, encryption_key, hmac_key, sealed)
+}
+
+// Function to open a file of a list that was already loaded. The keys of earlier epochs are only tried
+// for files that a lazy revocation left as they were, anything stored since then is under the current key
+func openFile(file_uuid uuid.UUID, file_controller FileController, encryption_key []byte, hmac_key []byte, sealed []byte) (file File, err error) {
+	file_bytes, err := openSealed(file_uuid, encryption_key, hmac_key, sealed)
+	if err == nil {
+		return decodeFile(file_bytes)
+	}
+	old_hash, ok := file_controller.Old_hashes[file_uuid]
+	if !ok || !userlib.HMACEqual(userlib.Hash(sealed), old_hash) {
+		return file, err
+	}
+	//The hash pins the blob, so it is opened as it is, also if it is in the format from before the envelope
+	for i := len(file_controller.Old_enc_keys) - 1; i >= 0; i-- {
+		old_file_bytes, old_err := OpenObject(file_controller.Old_enc_keys[i], file_controller.Old_hmac_keys[i], sealed, file_uuid[:])
+		if old_err != nil {
+			old_file_bytes, old_err = openLegacy(file_controller.Old_enc_keys[i], file_controller.Old_hmac_keys[i], sealed)
+		}
+		if old_err == nil {
+			old_file_bytes, old_err = unpadObject(old_file_bytes)
+		}
+		if old_err == nil {
+			return decodeFile(old_file_bytes)
+		}
+	}
+	return file, err
+}
+
+// Function to hash every file of a list as it is right before a lazy revocation. The empty tail is left out,
+// it becomes the link to the files stored after the revocation and is stored under the new key
+func oldFileHashes(file_controller FileController, encryption_key []byte, hmac_key []byte) (hashes map[uuid.UUID][]byte, err error) {
+	hashes = make(map[uuid.UUID][]byte)
+	next_uuid := file_controller.Start
+	for next_uuid != file_controller.End && next_uuid != uuid.Nil {
+		sealed, ok := datastoreGet(next_uuid)
+		if !ok {
+			return nil, errors.New("could not find the object in the datastore")
+		}
+		file, err := openFile(next_uuid, file_controller, encryption_key, hmac_key, sealed)
+		if err != nil {
+			return nil, err
+		}
+		hashes[next_uuid] = userlib.Hash(sealed)
+		next_uuid = file.Next_uuid
+	}
+	return hashes, nil
+}
+
+// userlib cannot be used from more than one goroutine at once, so every call to the datastore and the keystore
+// goes through the functions below and they take turns. The lock is only held for the call itself, checking and
+// decrypting runs in parallel. Sessions have a lock of their own for their state, see User
+var userlib_lock sync.Mutex
+
+func datastoreGet(key uuid.UUID) (value []byte, ok bool) {
+	userlib_lock.Lock()
+	defer userlib_lock.Unlock()
+	return userlib.DatastoreGet(key)
+}
+
+func datastoreSet(key uuid.UUID, value []byte) {
+	userlib_lock.Lock()
+	defer userlib_lock.Unlock()
+	userlib.DatastoreSet(key, value)
+}
+
+func datastoreDelete(key uuid.UUID) {
+	userlib_lock.Lock()
+	defer userlib_lock.Unlock()
+	userlib.DatastoreDelete(key)
+}
+
+func keystoreGet(key string) (value userlib.PublicKeyType, ok bool) {
+	userlib_lock.Lock()
+	defer userlib_lock.Unlock()
+	return userlib.KeystoreGet(key)
+}
+
+func keystoreSet(key string, value userlib.PublicKeyType) error {
+	userlib_lock.Lock()
+	defer userlib_lock.Unlock()
+	return userlib.KeystoreSet(key, value)
+}
+
+// userlib has no conditional put, so it is done here: value is only stored at key if the datastore still has
+// expected there. A nil expected means that nothing may be stored there yet and a nil value deletes what is there.
+// It is only atomic between the sessions in this process, as it relies on userlib_lock. Clients in other processes
+// do not take that lock, so against them it is a check and then a set, and a change made in between is lost
+func datastoreCompareAndSwap(key uuid.UUID, expected []byte, value []byte) bool {
+	userlib_lock.Lock()
+	defer userlib_lock.Unlock()
+	current, ok := userlib.DatastoreGet(key)
+	if ok != (expected != nil) || !bytes.Equal(current, expected) {
+		return false
+	}
+	if value == nil {
+		userlib.DatastoreDelete(key)
+	} else {
+		userlib.DatastoreSet(key, value)
+	}
+	return true
+}
+
+// Given when another session changed a file or what the user stores about it between loading and committing it,
+// the change is then made again
+var err_concurrent_change = errors.New("the object has been changed by another session at the same time")
+
+// How many times a change is made again before giving up
+const commit_attempts = 16
+
+// The most files or chunks that are loaded at the same time
+const load_workers = 8
+
+// Function to call load for every number below count with a bounded number of goroutines.
+// Gives the first error in the order of the numbers
+func loadParallel(count int, load func(i int) error) error {
+	errs := make([]error, count)
+	next := make(chan int)
+	var wait sync.WaitGroup
+	for worker := 0; worker < load_workers && worker < count; worker++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for i := range next {
+				errs[i] = load(i)
+			}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		next <- i
+	}
+	close(next)
+	wait.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Function to load and concatenate the content of every file in the list of a file controller.
+// With an index all the files and then all the chunks are loaded at once and put back in order
+func LoadFileList(file_controller FileController, encryption_key []byte, hmac_key []byte) (content []byte, err error) {
+	return loadFileListCached(nil, uuid.Nil, file_controller, encryption_key, hmac_key)
+}
+
+// Function to load the content of a list with what the session has in its cache. The content of the same version
+// of the file is used as it is, otherwise only the files and chunks that are not in the cache are loaded
+func loadFileListCached(cache *sessionCache, file_controller_uuid uuid.UUID, file_controller FileController, encryption_key []byte, hmac_key []byte) (content []byte, err error) {
+	content, ok := cache.content(file_controller_uuid, file_controller, encryption_key)
+	if ok {
+		return content, nil
+	}
+	if len(file_controller.Index) == 0 {
+		content, err = loadFileChain(file_controller, encryption_key, hmac_key)
+	} else {
+		content, err = loadIndexedList(cache, file_controller, encryption_key, hmac_key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cache.addContent(file_controller_uuid, file_controller, encryption_key, content)
+	return content, nil
+}
+
+// Function to load the list of a file controller with an index
+func loadIndexedList(cache *sessionCache, file_controller FileController, encryption_key []byte, hmac_key []byte) (content []byte, err error) {
+	var file_uuids []uuid.UUID
+	for _, segment := range file_controller.Index {
+		for position := 0; position < segment.Count; position++ {
+			file_uuid, err := fileListUUID(segment.Seed, position)
+			if err != nil {
+				return nil, err
+			}
+			file_uuids = append(file_uuids, file_uuid)
+		}
+	}
+	//The files of private lists are not cached, the last file of a segment is written again when appending
+	files := make([]File, len(file_uuids))
+	var missing_files []int
+	for i, file_uuid := range file_uuids {
+		file, ok := cache.file(file_uuid)
+		if ok && !file_controller.Private {
+			files[i] = file
+		} else {
+			missing_files = append(missing_files, i)
+		}
+	}
+	err = loadParallel(len(missing_files), func(i int) (err error) {
+		file_index := missing_files[i]
+		files[file_index], err = RetrieveFileFromDatastore(file_uuids[file_index], file_controller, encryption_key, hmac_key)
+		if err == nil && !file_controller.Private {
+			cache.addFile(file_uuids[file_index], files[file_index])
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var chunks []ChunkReference
+	for _, file := range files {
+		chunks = append(chunks, file.Chunks...)
+	}
+	chunk_contents := make([][]byte, len(chunks))
+	var missing_chunks []int
+	for i, chunk := range chunks {
+		chunk_content, ok := cache.chunk(chunk)
+		if ok {
+			chunk_contents[i] = chunk_content
+		} else {
+			missing_chunks = append(missing_chunks, i)
+		}
+	}
+	err = loadParallel(len(missing_chunks), func(i int) (err error) {
+		chunk_index := missing_chunks[i]
+		chunk_contents[chunk_index], err = loadChunk(chunks[chunk_index])
+		if err == nil {
+			cache.addChunk(chunks[chunk_index], chunk_contents[chunk_index])
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		content = append(content, file.Content...)
+		for range file.Chunks {
+			content = append(content, chunk_contents[0]...)
+			chunk_contents = chunk_contents[1:]
+		}
+	}
+	return content, nil
+}
+
+// What a session has loaded before and can use again without loading it. Only what never changes once it is stored
+// is kept on its own: accepted filereferencesecondaries, the files of lists that are not private, as the uuid of a file
+// is never used for other content, and chunks, which are found by their content. The content of a whole file is kept
+// with the version of its file controller, which is loaded every time, so changes of other sessions are always seen
+type sessionCache struct {
+	lock       sync.Mutex
+	size       int
+	references map[uuid.UUID]FileReferenceSecondary
+	files      map[uuid.UUID]File
+	chunks     map[uuid.UUID]cachedChunk
+	contents   map[uuid.UUID]cachedContent
+}
+
+type cachedChunk struct {
+	hash    []byte
+	content []byte
+}
+
+type cachedContent struct {
+	start    uuid.UUID
+	version  int
+	key_hash []byte
+	content  []byte
+}
+
+// The most bytes a session keeps, everything is forgotten when it is full
+const cache_max_size = 64 * 1024 * 1024
+
+func newSessionCache() *sessionCache {
+	cache := &sessionCache{}
+	cache.clear()
+	return cache
+}
+
+// The caller holds the lock
+func (cache *sessionCache) clear() {
+	cache.size = 0
+	cache.references = make(map[uuid.UUID]FileReferenceSecondary)
+	cache.files = make(map[uuid.UUID]File)
+	cache.chunks = make(map[uuid.UUID]cachedChunk)
+	cache.contents = make(map[uuid.UUID]cachedContent)
+}
+
+// Function to make room for size more bytes, gives false if it is more than fits at all. The caller holds the lock
+func (cache *sessionCache) reserve(size int) bool {
+	if size > cache_max_size {
+		return false
+	}
+	if cache.size+size > cache_max_size {
+		cache.clear()
+	}
+	cache.size += size
+	return true
+}
+
+// Wipes everything in the cache from memory
+func (cache *sessionCache) wipe() {
+	if cache == nil {
+		return
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	for _, file := range cache.files {
+		wipeBytes(file.Content)
+	}
+	for _, chunk := range cache.chunks {
+		wipeBytes(chunk.content)
+	}
+	for _, content := range cache.contents {
+		wipeBytes(content.content)
+	}
+	cache.clear()
+}
+
+func (cache *sessionCache) reference(file_uuid uuid.UUID) (file_reference_secondary FileReferenceSecondary, ok bool) {
+	if cache == nil {
+		return file_reference_secondary, false
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	file_reference_secondary, ok = cache.references[file_uuid]
+	return file_reference_secondary, ok
+}
+
+func (cache *sessionCache) addReference(file_uuid uuid.UUID, file_reference_secondary FileReferenceSecondary) {
+	if cache == nil {
+		return
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.reserve(len(file_reference_secondary.File_Reference_Primary_enc_key) + len(file_reference_secondary.Hmac_key) + 16) {
+		cache.references[file_uuid] = file_reference_secondary
+	}
+}
+
+func (cache *sessionCache) file(file_uuid uuid.UUID) (file File, ok bool) {
+	if cache == nil {
+		return file, false
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	file, ok = cache.files[file_uuid]
+	return file, ok
+}
+
+func (cache *sessionCache) addFile(file_uuid uuid.UUID, file File) {
+	if cache == nil {
+		return
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.reserve(len(file.Content) + len(file.Chunks)*96 + 16) {
+		file.Content = append([]byte{}, file.Content...)
+		file.Chunks = append([]ChunkReference{}, file.Chunks...)
+		cache.files[file_uuid] = file
+	}
+}
+
+// A chunk is only taken from the cache if it has the hash the file points to
+func (cache *sessionCache) chunk(chunk ChunkReference) (content []byte, ok bool) {
+	if cache == nil {
+		return nil, false
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cached, ok := cache.chunks[chunk.Pointer]
+	if !ok || !userlib.HMACEqual(cached.hash, chunk.Hash) {
+		return nil, false
+	}
+	return cached.content, true
+}
+
+func (cache *sessionCache) addChunk(chunk ChunkReference, content []byte) {
+	if cache == nil {
+		return
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.reserve(len(content) + 80) {
+		cache.chunks[chunk.Pointer] = cachedChunk{hash: chunk.Hash, content: append([]byte{}, content...)}
+	}
+}
+
+// The content is only taken from the cache for the same version of the same list under the same key
+func (cache *sessionCache) content(file_controller_uuid uuid.UUID, file_controller FileController, encryption_key []byte) (content []byte, ok bool) {
+	if cache == nil {
+		return nil, false
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cached, ok := cache.contents[file_controller_uuid]
+	if !ok || cached.version != file_controller.Version || cached.start != file_controller.Start ||
+		!userlib.HMACEqual(cached.key_hash, userlib.Hash(encryption_key)) {
+		return nil, false
+	}
+	return append([]byte{}, cached.content...), true
+}
+
+func (cache *sessionCache) addContent(file_controller_uuid uuid.UUID, file_controller FileController, encryption_key []byte, content []byte) {
+	if cache == nil {
+		return
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.reserve(len(content) + 96) {
+		cache.contents[file_controller_uuid] = cachedContent{start: file_controller.Start, version: file_controller.Version,
+			key_hash: userlib.Hash(encryption_key), content: append([]byte{}, content...)}
+	}
+}
+
+// Function to load a list without an index by following the Next_uuid of every file
+func loadFileChain(file_controller FileController, encryption_key []byte, hmac_key []byte) (content []byte, err error) {
+	next_uuid := file_controller.Start
+	for {
+		file, err := RetrieveFileFromDatastore(next_uuid, file_controller, encryption_key, hmac_key)
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, file.Content...)
+		content, err = loadChunks(content, file.Chunks)
+		if err != nil {
+			return nil, err
+		}
+		//Check if that was the end of the list
+		if file.Next_uuid == uuid.Nil {
+			break
+		}
+		next_uuid = file.Next_uuid
+	}
+	return content, nil
+}
+
+// Content defined chunking cuts the content where a rolling hash of the last bytes has its low bits zero,
+// so inserting or removing bytes only changes the chunks around it. The table of the hash is derived from
+// the dedup key so the boundaries do not tell anything about the content to others
+const chunk_min_size = 2 * 1024
+const chunk_max_size = 32 * 1024
+const chunk_boundary_mask = 8*1024 - 1 //About 8 KiB on average
+
+func chunkGearTable(dedup_key []byte) (table [256]uint64, err error) {
+	for i := 0; i < len(table); i += 8 {
+		table_bytes, err := userlib.HashKDF(dedup_key, encodeDerivationInput(label_chunk_gear, [][]byte{{byte(i)}}))
+		if err != nil {
+			return table, err
+		}
+		for j := 0; j < 8; j++ {
+			table[i+j] = binary.BigEndian.Uint64(table_bytes[j*8 : j*8+8])
+		}
+	}
+	return table, nil
+}
+
+// Function to split content into chunks at content defined boundaries
+func splitChunks(table [256]uint64, content []byte) (chunks [][]byte) {
+	for len(content) > 0 {
+		var hash uint64
+		end := len(content)
+		if end > chunk_max_size {
+			end = chunk_max_size
+		}
+		for i := 0; i < end; i++ {
+			hash = (hash << 1) + table[content[i]]
+			if i+1 >= chunk_min_size && hash&chunk_boundary_mask == 0 {
+				end = i + 1
+				break
+			}
+		}
+		chunks = append(chunks, content[:end])
+		content = content[end:]
+	}
+	return chunks
+}
+
+// The uuid and keys of a chunk only depend on its content and the dedup key, so the same content gets the same chunk
+func chunkLocation(dedup_key []byte, hash []byte) (chunk_uuid uuid.UUID, enc_key []byte, err error) {
+	chunk_id, err := DeriveKey(dedup_key, label_chunk_uuid, hash)
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+	chunk_uuid, err = uuid.FromBytes(chunk_id)
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+	enc_key, err = DeriveKey(dedup_key, label_chunk_encryption_key, hash)
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+	return chunk_uuid, enc_key, nil
+}
+
+// The hmac key of a chunk and where its count is and the keys for it, anyone that can read the chunk can change the count
+func chunkKeys(chunk ChunkReference) (hmac_key []byte, refs_uuid uuid.UUID, refs_enc_key []byte, refs_hmac_key []byte, err error) {
+	hmac_key, err = DeriveKey(chunk.Enc_key, label_chunk_hmac_key)
+	if err != nil {
+		return nil, uuid.Nil, nil, nil, err
+	}
+	refs_uuid, err = DeriveUUID(label_chunk_refs_uuid, chunk.Pointer[:])
+	if err != nil {
+		return nil, uuid.Nil, nil, nil, err
+	}
+	refs_enc_key, err = DeriveKey(chunk.Enc_key, label_chunk_refs_encryption_key)
+	if err != nil {
+		return nil, uuid.Nil, nil, nil, err
+	}
+	refs_hmac_key, err = DeriveKey(chunk.Enc_key, label_chunk_refs_hmac_key)
+	if err != nil {
+		return nil, uuid.Nil, nil, nil, err
+	}
+	return hmac_key, refs_uuid, refs_enc_key, refs_hmac_key, nil
+}
+
+// Function to store content as chunks. A chunk that is already stored only gets its count increased
+func storeChunks(dedup_key []byte, content []byte, compression int) (chunks []ChunkReference, err error) {
+	table, err := chunkGearTable(dedup_key)
+	if err != nil {
+		return nil, err
+	}
+	for _, chunk_content := range splitChunks(table, content) {
+		var chunk ChunkReference
+		chunk.Hash = userlib.Hash(chunk_content)
+		chunk.Pointer, chunk.Enc_key, err = chunkLocation(dedup_key, chunk.Hash)
+		if err != nil {
+			return nil, err
+		}
+		hmac_key, _, _, _, err := chunkKeys(chunk)
+		if err != nil {
+			return nil, err
+		}
+		count, err := countChunk(chunk, 1)
+		if err != nil {
+			return nil, err
+		}
+		//The chunk is stored again if it is missing, even if it still has a count. This is checked after counting it,
+		//so a session that releases it at the same time either sees the count or deletes it before the check
+		_, ok := datastoreGet(chunk.Pointer)
+		if count == 1 || !ok {
+			chunk_bytes, err := encodeChunk(chunk_content, compression)
+			if err != nil {
+				return nil, err
+			}
+			err = SendBytesToDatastore(chunk.Pointer, chunk.Enc_key, hmac_key, chunk_bytes, 0)
+			if err != nil {
+				return nil, err
+			}
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, nil
+}
+
+// Function to append the content of chunks to content, checking every chunk against its hash
+func loadChunks(content []byte, chunks []ChunkReference) ([]byte, error) {
+	for _, chunk := range chunks {
+		chunk_content, err := loadChunk(chunk)
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, chunk_content...)
+	}
+	return content, nil
+}
+
+// Function to load the content of one chunk and check that it is the content the file points to
+func loadChunk(chunk ChunkReference) (chunk_content []byte, err error) {
+	hmac_key, _, _, _, err := chunkKeys(chunk)
+	if err != nil {
+		return nil, err
+	}
+	chunk_bytes, err := RetrieveFromDatastore(chunk.Pointer, chunk.Enc_key, hmac_key)
+	if err != nil {
+		return nil, err
+	}
+	chunk_content, err = decodeChunk(chunk_bytes)
+	if err != nil {
+		return nil, err
+	}
+	if !userlib.HMACEqual(userlib.Hash(chunk_content), chunk.Hash) {
+		return nil, errors.New("a chunk of the file has been changed")
+	}
+	return chunk_content, nil
+}
+
+// Function to decrease the count of chunks, a chunk nothing points to anymore is deleted
+func releaseChunks(chunks []ChunkReference) error {
+	for _, chunk := range chunks {
+		_, refs_uuid, _, _, err := chunkKeys(chunk)
+		if err != nil {
+			return err
+		}
+		count, err := countChunk(chunk, -1)
+		if err != nil {
+			//Without a count the chunk cannot be released safely, it is left for garbage collection
+			continue
+		}
+		if count > 0 {
+			continue
+		}
+		//A session that counts the chunk again at the same time stores it again if it is missing. If it found
+		//the chunk before it was deleted here, the count is back by now and the chunk is put back
+		chunk_bytes, ok := datastoreGet(chunk.Pointer)
+		datastoreDelete(chunk.Pointer)
+		_, counted := datastoreGet(refs_uuid)
+		if ok && counted {
+			datastoreCompareAndSwap(chunk.Pointer, nil, chunk_bytes)
+		}
+	}
+	return nil
+}
+
+// Function to change the count of a chunk and give the new count, the count is deleted when it reaches zero.
+// Other sessions of the user can count the same chunk at the same time, so the count is only stored if it
+// has not changed since it was loaded and loaded again otherwise. A count that is missing is zero
+func countChunk(chunk ChunkReference, change int) (count int, err error) {
+	_, refs_uuid, refs_enc_key, refs_hmac_key, err := chunkKeys(chunk)
+	if err != nil {
+		return 0, err
+	}
+	for attempt := 0; attempt < commit_attempts; attempt++ {
+		var refs ChunkRefs
+		sealed, ok := datastoreGet(refs_uuid)
+		if ok {
+			refs_bytes, err := openSealed(refs_uuid, refs_enc_key, refs_hmac_key, sealed)
+			if err == nil {
+				err = json.Unmarshal(refs_bytes, &refs)
+			}
+			if err != nil && change < 0 {
+				return 0, err
+			}
+		} else if change < 0 {
+			return 0, errors.New("the chunk is not counted")
+		}
+		refs.Count += change
+		var new_sealed []byte
+		if refs.Count > 0 {
+			refs_bytes, err := json.Marshal(refs)
+			if err != nil {
+				return 0, err
+			}
+			new_sealed, err = sealBytes(refs_uuid, refs_enc_key, refs_hmac_key, refs_bytes, 0)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if datastoreCompareAndSwap(refs_uuid, sealed, new_sealed) {
+			return refs.Count, nil
+		}
+	}
+	return 0, err_concurrent_change
+}
+
+// Function to collect the uuids of the files in the list of a file controller and the chunks they point to
+func listFiles(file_controller FileController, encryption_key []byte, hmac_key []byte) (file_uuids []uuid.UUID, chunks []ChunkReference, err error) {
+	next_uuid := file_controller.Start
+	for next_uuid != uuid.Nil {
+		file, err := RetrieveFileFromDatastore(next_uuid, file_controller, encryption_key, hmac_key)
+		if err != nil {
+			return nil, nil, err
+		}
+		file_uuids = append(file_uuids, next_uuid)
+		chunks = append(chunks, file.Chunks...)
+		next_uuid = file.Next_uuid
+	}
+	return file_uuids, chunks, nil
+}
+
+// Content can be compressed before it is encrypted. Every file and chunk records whether its own content
+// was compressed, so changing the setting of a file does not break what is already stored
+const compression_none = 0
+const compression_deflate = 1
+
+// Function to compress content, the content is kept as it is if compressing it does not make it smaller
+func compressContent(compression int, content []byte) (compressed []byte, used int, err error) {
+	if compression != compression_deflate || len(content) == 0 {
+		return content, compression_none, nil
+	}
+	var buffer bytes.Buffer
+	writer, err := flate.NewWriter(&buffer, flate.DefaultCompression)
+	if err != nil {
+		return nil, compression_none, err
+	}
+	_, err = writer.Write(content)
+	if err != nil {
+		return nil, compression_none, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, compression_none, err
+	}
+	if buffer.Len() >= len(content) {
+		return content, compression_none, nil
+	}
+	return buffer.Bytes(), compression_deflate, nil
+}
+
+func decompressContent(compression int, content []byte) ([]byte, error) {
+	switch compression {
+	case compression_none:
+		return content, nil
+	case compression_deflate:
+		return io.ReadAll(flate.NewReader(bytes.NewReader(content)))
+	}
+	return nil, errors.New("unknown compression")
+}
+
+// Files and chunks are stored in a compact binary encoding instead of JSON, which would inflate the content
+// by a third. The first byte is the version of the encoding, which can never be the start of JSON or of padding
+//
+//	file:  version (1) | compression (1) | next uuid (16) | content length (4) | content | chunk count (4) | chunks
+//	chunk: pointer (16) | encryption key (16) | hash (64)
+//
+//	chunk blob: version (1) | compression (1) | content
+const binary_record_version = 1
+const chunk_reference_length = 16 + key_length + 64
+
+func encodeFile(file File, compression int) (file_bytes []byte, err error) {
+	content, used, err := compressContent(compression, file.Content)
+	if err != nil {
+		return nil, err
+	}
+	file_bytes = make([]byte, 0, 1+1+16+4+len(content)+4+len(file.Chunks)*chunk_reference_length)
+	file_bytes = append(file_bytes, binary_record_version, byte(used))
+	file_bytes = append(file_bytes, file.Next_uuid[:]...)
+	file_bytes = appendUint32(file_bytes, len(content))
+	file_bytes = append(file_bytes, content...)
+	file_bytes = appendUint32(file_bytes, len(file.Chunks))
+	for _, chunk := range file.Chunks {
+		if len(chunk.Enc_key) != key_length || len(chunk.Hash) != 64 {
+			return nil, errors.New("the chunk reference is not valid")
+		}
+		file_bytes = append(file_bytes, chunk.Pointer[:]...)
+		file_bytes = append(file_bytes, chunk.Enc_key...)
+		file_bytes = append(file_bytes, chunk.Hash...)
+	}
+	return file_bytes, nil
+}
+
+// Function to decode a file, files stored before the binary encoding are JSON
+func decodeFile(file_bytes []byte) (file File, err error) {
+	if len(file_bytes) > 0 && file_bytes[0] == '{' {
+		err = json.Unmarshal(file_bytes, &file)
+		return file, err
+	}
+	broken := errors.New("the file is not valid")
+	if len(file_bytes) < 1+1+16+4 || file_bytes[0] != binary_record_version {
+		return file, broken
+	}
+	compression := int(file_bytes[1])
+	copy(file.Next_uuid[:], file_bytes[2:18])
+	content_length := int(binary.BigEndian.Uint32(file_bytes[18:22]))
+	rest := file_bytes[22:]
+	if content_length > len(rest)-4 {
+		return file, broken
+	}
+	if content_length > 0 {
+		file.Content, err = decompressContent(compression, rest[:content_length])
+		if err != nil {
+			return file, err
+		}
+	}
+	rest = rest[content_length:]
+	chunk_count := int(binary.BigEndian.Uint32(rest[:4]))
+	rest = rest[4:]
+	if len(rest) != chunk_count*chunk_reference_length {
+		return file, broken
+	}
+	for i := 0; i < chunk_count; i++ {
+		var chunk ChunkReference
+		copy(chunk.Pointer[:], rest[:16])
+		chunk.Enc_key = append([]byte{}, rest[16:16+key_length]...)
+		chunk.Hash = append([]byte{}, rest[16+key_length:chunk_reference_length]...)
+		file.Chunks = append(file.Chunks, chunk)
+		rest = rest[chunk_reference_length:]
+	}
+	return file, nil
+}
+
+// Function to store one file of a list
+func storeFile(file_uuid uuid.UUID, encryption_key []byte, hmac_key []byte, file File, private bool, compression int) error {
+	sealed, err := sealFile(file_uuid, encryption_key, hmac_key, file, private, compression)
+	if err != nil {
+		return err
+	}
+	datastoreSet(file_uuid, sealed)
+	return nil
+}
+
+// Function to seal one file of a list the way storeFile stores it
+func sealFile(file_uuid uuid.UUID, encryption_key []byte, hmac_key []byte, file File, private bool, compression int) (sealed []byte, err error) {
+	if private {
+		compression = compression_none
+	}
+	file_bytes, err := encodeFile(file, compression)
+	if err != nil {
+		return nil, err
+	}
+	return sealBytes(file_uuid, encryption_key, hmac_key, file_bytes, fileBucket(private))
+}
+
+func encodeChunk(content []byte, compression int) (chunk_bytes []byte, err error) {
+	content, used, err := compressContent(compression, content)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{binary_record_version, byte(used)}, content...), nil
+}
+
+// Function to decode a chunk, chunks stored before the binary encoding are JSON
+func decodeChunk(chunk_bytes []byte) (content []byte, err error) {
+	if len(chunk_bytes) > 0 && chunk_bytes[0] == '"' {
+		err = json.Unmarshal(chunk_bytes, &content)
+		return content, err
+	}
+	if len(chunk_bytes) < 2 || chunk_bytes[0] != binary_record_version {
+		return nil, errors.New("the chunk is not valid")
+	}
+	return decompressContent(int(chunk_bytes[1]), chunk_bytes[2:])
+}
+
+func appendUint32(encoded []byte, value int) []byte {
+	var value_bytes [4]byte
+	binary.BigEndian.PutUint32(value_bytes[:], uint32(value))
+	return append(encoded, value_bytes[:]...)
+}
+
+// The structs that are stored in the datastore are encoded in a compact binary encoding instead of JSON:
+//
+//	version (1) | type (1) | fields
+//
+// Fields are written in the order of the struct. Byte slices and strings have a 4 byte length in front,
+// maps and lists a 4 byte count and maps are sorted by key. Everything is checked while decoding, and a
+// record with bytes left over is rejected. Objects stored before the binary encoding are JSON, which
+// always starts with "{" and never with the version
+const record_user = 1
+const record_file_controller = 2
+const record_file_reference_owner = 3
+const record_file_reference_primary = 4
+const record_file_reference_secondary = 5
+const record_invitation = 6
+const record_private_keys = 7
+const record_file_sharing = 8
+
+// Function to encode an object for the datastore. Structs without a binary encoding are encoded as JSON
+func MarshalObject(object interface{}) (object_bytes []byte, err error) {
+	switch value := object.(type) {
+	case *User:
+		return encodeUser(*value), nil
+	case User:
+		return encodeUser(value), nil
+	case FileController:
+		return encodeFileController(value), nil
+	case FileReferenceOwner:
+		return encodeFileReferenceOwner(value), nil
+	case FileReferencePrimary:
+		return encodeFileReferencePrimary(value), nil
+	case FileReferenceSecondary:
+		return encodeFileReferenceSecondary(value), nil
+	case Invitation:
+		return encodeInvitation(value), nil
+	case PrivateKeys:
+		return encodePrivateKeys(value), nil
+	case FileSharing:
+		return encodeFileSharing(value), nil
+	}
+	return json.Marshal(object)
+}
+
+// Function to decode an object from the datastore, in the binary encoding or as JSON
+func UnmarshalObject(object_bytes []byte, object interface{}) (err error) {
+	if len(object_bytes) == 0 || object_bytes[0] != binary_record_version {
+		return json.Unmarshal(object_bytes, object)
+	}
+	switch value := object.(type) {
+	case *User:
+		return decodeUser(object_bytes, value)
+	case *FileController:
+		*value, err = decodeFileController(object_bytes)
+	case *FileReferenceOwner:
+		*value, err = decodeFileReferenceOwner(object_bytes)
+	case *FileReferencePrimary:
+		*value, err = decodeFileReferencePrimary(object_bytes)
+	case *FileReferenceSecondary:
+		*value, err = decodeFileReferenceSecondary(object_bytes)
+	case *Invitation:
+		*value, err = decodeInvitation(object_bytes)
+	case *PrivateKeys:
+		*value, err = decodePrivateKeys(object_bytes)
+	case *FileSharing:
+		*value, err = decodeFileSharing(object_bytes)
+	default:
+		return errors.New("there is no binary encoding for the object")
+	}
+	return err
+}
+
+func encodeUser(userdata User) []byte {
+	record := newRecord(record_user)
+	record.putString(userdata.Username)
+	record.putBytes(userdata.Root_key)
+	record.putBytes(userdata.Namespace_key)
+	record.putBytes(userdata.Wrapped_keys)
+	record.putInt(userdata.Key_version)
+	record.putPublicKey(userdata.Password_public_key)
+	device_ids := make([]string, 0, len(userdata.Devices))
+	for id := range userdata.Devices {
+		device_ids = append(device_ids, id)
+	}
+	sort.Strings(device_ids)
+	record.putCount(len(device_ids))
+	for _, id := range device_ids {
+		device := userdata.Devices[id]
+		record.putString(id)
+		record.putString(device.Id)
+		record.putString(device.Name)
+		record.putPublicKey(device.Public_key)
+	}
+	recovery_ids := make([]string, 0, len(userdata.Recovery_codes))
+	for id := range userdata.Recovery_codes {
+		recovery_ids = append(recovery_ids, id)
+	}
+	sort.Strings(recovery_ids)
+	record.putCount(len(recovery_ids))
+	for _, id := range recovery_ids {
+		record.putString(id)
+		record.putPublicKey(userdata.Recovery_codes[id])
+	}
+	contact_names := make([]string, 0, len(userdata.Contacts))
+	for name := range userdata.Contacts {
+		contact_names = append(contact_names, name)
+	}
+	sort.Strings(contact_names)
+	record.putCount(len(contact_names))
+	for _, name := range contact_names {
+		contact := userdata.Contacts[name]
+		record.putString(name)
+		record.putString(contact.Fingerprint)
+		record.putInt(contact.Key_version)
+		record.putBool(contact.Verified)
+	}
+	files_owned := make([]uuid.UUID, 0, len(userdata.Files_owned))
+	for id := range userdata.Files_owned {
+		files_owned = append(files_owned, id)
+	}
+	sortUUIDs(files_owned)
+	record.putCount(len(files_owned))
+	for _, id := range files_owned {
+		record.putUUID(id)
+		record.putBool(userdata.Files_owned[id])
+	}
+	record.putBool(userdata.Privacy_mode)
+	record.putBool(userdata.Deduplication)
+	record.putBytes(userdata.Dedup_key)
+	record.putBool(userdata.Contact_book)
+	path_prefixes := make([]string, 0, len(userdata.Path_prefixes))
+	for prefix := range userdata.Path_prefixes {
+		path_prefixes = append(path_prefixes, prefix)
+	}
+	sort.Strings(path_prefixes)
+	record.putCount(len(path_prefixes))
+	for _, prefix := range path_prefixes {
+		record.putString(prefix)
+	}
+	record.putInt(userdata.Prekey_counter)
+	return record.encoded
+}
+
+// Function to decode a user struct into userdata, only the fields that are stored are set
+func decodeUser(object_bytes []byte, userdata *User) error {
+	record := openRecord(object_bytes, record_user)
+	userdata.Username = record.getString()
+	userdata.Root_key = record.getBytes()
+	userdata.Namespace_key = record.getBytes()
+	userdata.Wrapped_keys = record.getBytes()
+	userdata.Key_version = record.getInt()
+	userdata.Password_public_key = record.getPublicKey()
+	userdata.Devices = make(map[string]DeviceEntry)
+	for i := record.getCount(); i > 0; i-- {
+		id := record.getString()
+		var device DeviceEntry
+		device.Id = record.getString()
+		device.Name = record.getString()
+		device.Public_key = record.getPublicKey()
+		userdata.Devices[id] = device
+	}
+	userdata.Recovery_codes = make(map[string]userlib.PKEEncKey)
+	for i := record.getCount(); i > 0; i-- {
+		id := record.getString()
+		userdata.Recovery_codes[id] = record.getPublicKey()
+	}
+	userdata.Contacts = make(map[string]Contact)
+	for i := record.getCount(); i > 0; i-- {
+		name := record.getString()
+		var contact Contact
+		contact.Fingerprint = record.getString()
+		contact.Key_version = record.getInt()
+		contact.Verified = record.getBool()
+		userdata.Contacts[name] = contact
+	}
+	userdata.Files_owned = make(map[uuid.UUID]bool)
+	for i := record.getCount(); i > 0; i-- {
+		id := record.getUUID()
+		userdata.Files_owned[id] = record.getBool()
+	}
+	userdata.Privacy_mode = record.getBool()
+	userdata.Deduplication = record.getBool()
+	userdata.Dedup_key = record.getBytes()
+	userdata.Contact_book = record.getBool()
+	userdata.Path_prefixes = make(map[string]bool)
+	for i := record.getCount(); i > 0; i-- {
+		userdata.Path_prefixes[record.getString()] = true
+	}
+	userdata.Prekey_counter = record.getInt()
+	return record.finish()
+}
+
+func encodePrivateKeys(private_keys PrivateKeys) []byte {
+	record := newRecord(record_private_keys)
+	record.putPrivateKey(private_keys.Secret_key)
+	record.putPrivateKey(private_keys.Signature_private_key)
+	versions := make([]int, 0, len(private_keys.Old_secret_keys))
+	for version := range private_keys.Old_secret_keys {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+	record.putCount(len(versions))
+	for _, version := range versions {
+		record.putInt(version)
+		record.putPrivateKey(private_keys.Old_secret_keys[version])
+	}
+	prekey_ids := make([]uuid.UUID, 0, len(private_keys.Prekeys))
+	for id := range private_keys.Prekeys {
+		prekey_ids = append(prekey_ids, id)
+	}
+	sortUUIDs(prekey_ids)
+	record.putCount(len(prekey_ids))
+	for _, id := range prekey_ids {
+		prekey := private_keys.Prekeys[id]
+		record.putUUID(id)
+		record.putPublicKey(prekey.Public_key)
+		record.putPrivateKey(prekey.Private_key)
+	}
+	return record.encoded
+}
+
+func decodePrivateKeys(object_bytes []byte) (private_keys PrivateKeys, err error) {
+	record := openRecord(object_bytes, record_private_keys)
+	private_keys.Secret_key = record.getPrivateKey()
+	private_keys.Signature_private_key = record.getPrivateKey()
+	private_keys.Old_secret_keys = make(map[int]userlib.PKEDecKey)
+	for i := record.getCount(); i > 0; i-- {
+		version := record.getInt()
+		private_keys.Old_secret_keys[version] = record.getPrivateKey()
+	}
+	private_keys.Prekeys = make(map[uuid.UUID]Prekey)
+	for i := record.getCount(); i > 0; i-- {
+		id := record.getUUID()
+		var prekey Prekey
+		prekey.Public_key = record.getPublicKey()
+		prekey.Private_key = record.getPrivateKey()
+		private_keys.Prekeys[id] = prekey
+	}
+	return private_keys, record.finish()
+}
+
+func encodeFileController(file_controller FileController) []byte {
+	record := newRecord(record_file_controller)
+	record.putUUID(file_controller.Start)
+	record.putUUID(file_controller.End)
+	record.putInt(file_controller.Epoch)
+	record.putCount(len(file_controller.Old_enc_keys))
+	for _, key := range file_controller.Old_enc_keys {
+		record.putBytes(key)
+	}
+	record.putCount(len(file_controller.Old_hmac_keys))
+	for _, key := range file_controller.Old_hmac_keys {
+		record.putBytes(key)
+	}
+	record.putUUID(file_controller.Last)
+	record.putBool(file_controller.Private)
+	record.putBool(file_controller.Sensitive)
+	record.putBool(file_controller.Chunked)
+	record.putInt(file_controller.Compression)
+	record.putInt(file_controller.Appends)
+	record.putCount(len(file_controller.Index))
+	for _, segment := range file_controller.Index {
+		record.putBytes(segment.Seed)
+		record.putInt(segment.Count)
+	}
+	record.putInt(file_controller.Version)
+	old_uuids := make([]uuid.UUID, 0, len(file_controller.Old_hashes))
+	for file_uuid := range file_controller.Old_hashes {
+		old_uuids = append(old_uuids, file_uuid)
+	}
+	sortUUIDs(old_uuids)
+	record.putCount(len(old_uuids))
+	for _, file_uuid := range old_uuids {
+		record.putUUID(file_uuid)
+		record.putBytes(file_controller.Old_hashes[file_uuid])
+	}
+	return record.encoded
+}
+
+func decodeFileController(object_bytes []byte) (file_controller FileController, err error) {
+	record := openRecord(object_bytes, record_file_controller)
+	file_controller.Start = record.getUUID()
+	file_controller.End = record.getUUID()
+	file_controller.Epoch = record.getInt()
+	for i := record.getCount(); i > 0; i-- {
+		file_controller.Old_enc_keys = append(file_controller.Old_enc_keys, record.getBytes())
+	}
+	for i := record.getCount(); i > 0; i-- {
+		file_controller.Old_hmac_keys = append(file_controller.Old_hmac_keys, record.getBytes())
+	}
+	if len(file_controller.Old_enc_keys) != len(file_controller.Old_hmac_keys) {
+		return file_controller, errors.New("the file controller is not valid")
+	}
+	file_controller.Last = record.getUUID()
+	file_controller.Private = record.getBool()
+	file_controller.Sensitive = record.getBool()
+	file_controller.Chunked = record.getBool()
+	file_controller.Compression = record.getInt()
+	file_controller.Appends = record.getInt()
+	for i := record.getCount(); i > 0; i-- {
+		var segment ListSegment
+		segment.Seed = record.getBytes()
+		segment.Count = record.getInt()
+		file_controller.Index = append(file_controller.Index, segment)
+	}
+	file_controller.Version = record.getInt()
+	for i := record.getCount(); i > 0; i-- {
+		if file_controller.Old_hashes == nil {
+			file_controller.Old_hashes = make(map[uuid.UUID][]byte)
+		}
+		file_uuid := record.getUUID()
+		file_controller.Old_hashes[file_uuid] = record.getBytes()
+	}
+	return file_controller, record.finish()
+}
+
+func encodeFileReferenceOwner(file_reference_owner FileReferenceOwner) []byte {
+	record := newRecord(record_file_reference_owner)
+	record.putBool(file_reference_owner.Is_directory)
+	recipients := make([]string, 0, len(file_reference_owner.Uuid_shared_with))
+	for recipient := range file_reference_owner.Uuid_shared_with {
+		recipients = append(recipients, recipient)
+	}
+	sort.Strings(recipients)
+	record.putCount(len(recipients))
+	for _, recipient := range recipients {
+		record.putString(recipient)
+		record.putUUID(file_reference_owner.Uuid_shared_with[recipient])
+		record.putBytes(file_reference_owner.Enc_keys_shared_with[recipient])
+		record.putBytes(file_reference_owner.Hmac_keys_shared_with[recipient])
+	}
+	record.putBytes(file_reference_owner.File_enc_key)
+	record.putBytes(file_reference_owner.Hmac_key)
+	record.putUUID(file_reference_owner.File_controller_pointer)
+	invitation_recipients := make([]string, 0, len(file_reference_owner.Invitations_shared_with))
+	for recipient := range file_reference_owner.Invitations_shared_with {
+		invitation_recipients = append(invitation_recipients, recipient)
+	}
+	sort.Strings(invitation_recipients)
+	record.putCount(len(invitation_recipients))
+	for _, recipient := range invitation_recipients {
+		record.putString(recipient)
+		record.putUUID(file_reference_owner.Invitations_shared_with[recipient])
+	}
+	record.putBool(file_reference_owner.Sharing_stored)
+	return record.encoded
+}
+
+func decodeFileReferenceOwner(object_bytes []byte) (file_reference_owner FileReferenceOwner, err error) {
+	record := openRecord(object_bytes, record_file_reference_owner)
+	file_reference_owner.Is_directory = record.getBool()
+	file_reference_owner.Uuid_shared_with = make(map[string]uuid.UUID)
+	file_reference_owner.Enc_keys_shared_with = make(map[string][]byte)
+	file_reference_owner.Hmac_keys_shared_with = make(map[string][]byte)
+	for i := record.getCount(); i > 0; i-- {
+		recipient := record.getString()
+		file_reference_owner.Uuid_shared_with[recipient] = record.getUUID()
+		file_reference_owner.Enc_keys_shared_with[recipient] = record.getBytes()
+		file_reference_owner.Hmac_keys_shared_with[recipient] = record.getBytes()
+	}
+	file_reference_owner.File_enc_key = record.getBytes()
+	file_reference_owner.Hmac_key = record.getBytes()
+	file_reference_owner.File_controller_pointer = record.getUUID()
+	file_reference_owner.Invitations_shared_with = make(map[string]uuid.UUID)
+	for i := record.getCount(); i > 0; i-- {
+		recipient := record.getString()
+		file_reference_owner.Invitations_shared_with[recipient] = record.getUUID()
+	}
+	file_reference_owner.Sharing_stored = record.getBool()
+	return file_reference_owner, record.finish()
+}
+
+func encodeFileSharing(sharing FileSharing) []byte {
+	record := newRecord(record_file_sharing)
+	recipients := make([]string, 0, len(sharing.Uuid_shared_with))
+	for recipient := range sharing.Uuid_shared_with {
+		recipients = append(recipients, recipient)
+	}
+	sort.Strings(recipients)
+	record.putCount(len(recipients))
+	for _, recipient := range recipients {
+		record.putString(recipient)
+		record.putUUID(sharing.Uuid_shared_with[recipient])
+		record.putBytes(sharing.Enc_keys_shared_with[recipient])
+		record.putBytes(sharing.Hmac_keys_shared_with[recipient])
+	}
+	invitation_recipients := make([]string, 0, len(sharing.Invitations_shared_with))
+	for recipient := range sharing.Invitations_shared_with {
+		invitation_recipients = append(invitation_recipients, recipient)
+	}
+	sort.Strings(invitation_recipients)
+	record.putCount(len(invitation_recipients))
+	for _, recipient := range invitation_recipients {
+		record.putString(recipient)
+		record.putUUID(sharing.Invitations_shared_with[recipient])
+	}
+	return record.encoded
+}
+
+func decodeFileSharing(object_bytes []byte) (sharing FileSharing, err error) {
+	record := openRecord(object_bytes, record_file_sharing)
+	sharing.Uuid_shared_with = make(map[string]uuid.UUID)
+	sharing.Enc_keys_shared_with = make(map[string][]byte)
+	sharing.Hmac_keys_shared_with = make(map[string][]byte)
+	sharing.Invitations_shared_with = make(map[string]uuid.UUID)
+	for i := record.getCount(); i > 0; i-- {
+		recipient := record.getString()
+		sharing.Uuid_shared_with[recipient] = record.getUUID()
+		sharing.Enc_keys_shared_with[recipient] = record.getBytes()
+		sharing.Hmac_keys_shared_with[recipient] = record.getBytes()
+	}
+	for i := record.getCount(); i > 0; i-- {
+		recipient := record.getString()
+		sharing.Invitations_shared_with[recipient] = record.getUUID()
+	}
+	return sharing, record.finish()
+}
+
+func encodeFileReferencePrimary(file_reference_primary FileReferencePrimary) []byte {
+	record := newRecord(record_file_reference_primary)
+	record.putBool(file_reference_primary.Is_directory)
+	record.putBytes(file_reference_primary.File_enc_key)
+	record.putBytes(file_reference_primary.Hmac_key)
+	record.putUUID(file_reference_primary.File_controller_pointer)
+	return record.encoded
+}
+
+func decodeFileReferencePrimary(object_bytes []byte) (file_reference_primary FileReferencePrimary, err error) {
+	record := openRecord(object_bytes, record_file_reference_primary)
+	file_reference_primary.Is_directory = record.getBool()
+	file_reference_primary.File_enc_key = record.getBytes()
+	file_reference_primary.Hmac_key = record.getBytes()
+	file_reference_primary.File_controller_pointer = record.getUUID()
+	return file_reference_primary, record.finish()
+}
+
+func encodeFileReferenceSecondary(file_reference_secondary FileReferenceSecondary) []byte {
+	record := newRecord(record_file_reference_secondary)
+	record.putBytes(file_reference_secondary.File_Reference_Primary_enc_key)
+	record.putBytes(file_reference_secondary.Hmac_key)
+	record.putUUID(file_reference_secondary.File_reference_primary_pointer)
+	return record.encoded
+}
+
+func decodeFileReferenceSecondary(object_bytes []byte) (file_reference_secondary FileReferenceSecondary, err error) {
+	record := openRecord(object_bytes, record_file_reference_secondary)
+	file_reference_secondary.File_Reference_Primary_enc_key = record.getBytes()
+	file_reference_secondary.Hmac_key = record.getBytes()
+	file_reference_secondary.File_reference_primary_pointer = record.getUUID()
+	return file_reference_secondary, record.finish()
+}
+
+func encodeInvitation(invitation Invitation) []byte {
+	record := newRecord(record_invitation)
+	record.putBytes(invitation.FRPdk)
+	record.putBytes(invitation.FRPhmk)
+	return record.encoded
+}
+
+func decodeInvitation(object_bytes []byte) (invitation Invitation, err error) {
+	record := openRecord(object_bytes, record_invitation)
+	invitation.FRPdk = record.getBytes()
+	invitation.FRPhmk = record.getBytes()
+	return invitation, record.finish()
+}
+
+func sortUUIDs(ids []uuid.UUID) {
+	sort.Slice(ids, func(i, j int) bool {
+		return string(ids[i][:]) < string(ids[j][:])
+	})
+}
+
+// Writes the fields of a record
+type recordEncoder struct {
+	encoded []byte
+}
+
+func newRecord(record_type byte) *recordEncoder {
+	return &recordEncoder{encoded: []byte{binary_record_version, record_type}}
+}
+
+func (record *recordEncoder) putCount(count int) {
+	record.encoded = appendUint32(record.encoded, count)
+}
+
+func (record *recordEncoder) putBytes(value []byte) {
+	record.putCount(len(value))
+	record.encoded = append(record.encoded, value...)
+}
+
+func (record *recordEncoder) putString(value string) {
+	record.putBytes([]byte(value))
+}
+
+func (record *recordEncoder) putUUID(value uuid.UUID) {
+	record.encoded = append(record.encoded, value[:]...)
+}
+
+func (record *recordEncoder) putInt(value int) {
+	var value_bytes [8]byte
+	binary.BigEndian.PutUint64(value_bytes[:], uint64(int64(value)))
+	record.encoded = append(record.encoded, value_bytes[:]...)
+}
+
+func (record *recordEncoder) putBool(value bool) {
+	if value {
+		record.encoded = append(record.encoded, 1)
+	} else {
+		record.encoded = append(record.encoded, 0)
+	}
+}
+
+// Keys are written as their type and the PKCS #1 encoding of the RSA key, a key that is not set is empty
+func (record *recordEncoder) putPublicKey(key userlib.PublicKeyType) {
+	record.putString(key.KeyType)
+	if key.PubKey.N == nil {
+		record.putBytes(nil)
+		return
+	}
+	record.putBytes(x509.MarshalPKCS1PublicKey(&key.PubKey))
+}
+
+func (record *recordEncoder) putPrivateKey(key userlib.PrivateKeyType) {
+	record.putString(key.KeyType)
+	if key.PrivKey.D == nil {
+		record.putBytes(nil)
+		return
+	}
+	record.putBytes(x509.MarshalPKCS1PrivateKey(&key.PrivKey))
+}
+
+// Reads the fields of a record. The first error is kept and everything read after it is empty,
+// so a record can be read to the end and checked once with finish
+type recordDecoder struct {
+	rest []byte
+	err  error
+}
+
+func openRecord(object_bytes []byte, record_type byte) *recordDecoder {
+	record := &recordDecoder{rest: object_bytes}
+	header := record.take(2)
+	if record.err == nil && (header[0] != binary_record_version || header[1] != record_type) {
+		record.fail()
+	}
+	return record
+}
+
+func (record *recordDecoder) fail() {
+	if record.err == nil {
+		record.err = errors.New("the object is not valid")
+	}
+	record.rest = nil
+}
+
+func (record *recordDecoder) take(length int) []byte {
+	if record.err != nil || length < 0 || length > len(record.rest) {
+		record.fail()
+		return nil
+	}
+	value := record.rest[:length]
+	record.rest = record.rest[length:]
+	return value
+}
+
+// A count can never be more than the bytes that are left, so a broken count cannot make a huge map
+func (record *recordDecoder) getCount() int {
+	count_bytes := record.take(4)
+	if record.err != nil {
+		return 0
+	}
+	count := int(binary.BigEndian.Uint32(count_bytes))
+	if count > len(record.rest) {
+		record.fail()
+		return 0
+	}
+	return count
+}
+
+// Empty byte slices are read as nil, like keys that were never set
+func (record *recordDecoder) getBytes() []byte {
+	value := record.take(record.getCount())
+	if len(value) == 0 {
+		return nil
+	}
+	return append([]byte{}, value...)
+}
+
+func (record *recordDecoder) getString() string {
+	return string(record.take(record.getCount()))
+}
+
+func (record *recordDecoder) getUUID() (value uuid.UUID) {
+	copy(value[:], record.take(16))
+	return value
+}
+
+func (record *recordDecoder) getInt() int {
+	value_bytes := record.take(8)
+	if record.err != nil {
+		return 0
+	}
+	return int(int64(binary.BigEndian.Uint64(value_bytes)))
+}
+
+func (record *recordDecoder) getBool() bool {
+	value_bytes := record.take(1)
+	if record.err != nil {
+		return false
+	}
+	if value_bytes[0] > 1 {
+		record.fail()
+		return false
+	}
+	return value_bytes[0] == 1
+}
+
+func (record *recordDecoder) getPublicKey() (key userlib.PublicKeyType) {
+	key.KeyType = record.getString()
+	key_bytes := record.getBytes()
+	if record.err != nil || key_bytes == nil {
+		return key
+	}
+	public_key, err := x509.ParsePKCS1PublicKey(key_bytes)
+	if err != nil {
+		record.fail()
+		return key
+	}
+	key.PubKey = *public_key
+	return key
+}
+
+func (record *recordDecoder) getPrivateKey() (key userlib.PrivateKeyType) {
+	key.KeyType = record.getString()
+	key_bytes := record.getBytes()
+	if record.err != nil || key_bytes == nil {
+		return key
+	}
+	private_key, err := x509.ParsePKCS1PrivateKey(key_bytes)
+	if err != nil {
+		record.fail()
+		return key
+	}
+	key.PrivKey = *private_key
+	return key
+}
+
+// Function to check that the whole record was read without errors
+func (record *recordDecoder) finish() error {
+	if record.err != nil {
+		return record.err
+	}
+	if len(record.rest) != 0 {
+		return errors.New("the object has bytes left over")
+	}
+	return nil
 }
@@ -7,9 +7,10 @@ import (
 	// Some imports use an underscore to prevent the compiler from complaining
 	// about unused imports.
 	_ "encoding/hex"
+	"encoding/json"
 	_ "errors"
 	_ "strconv"
-	_ "strings"
+	"strings"
 	"testing"
 
 	// A "dot" import is used here so that the functions in the ginko and gomega
@@ -19,6 +20,7 @@ import (
 	. "github.com/onsi/gomega"
 
 	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
 
 	"github.com/cs161-staff/project2-starter-code/client"
 )
@@ -1124,4 +1126,3478 @@ var _ = Describe("Client Tests", func() {
 			Expect(err).NotTo(BeNil())
 		})
 	})
+
+	Describe("Batch Sharing Tests", func() {
+
+		Specify("Batch Test: Testing CreateInvitations and RevokeMany with several recipients.", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, Charles and Doris.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice storing file %s with content: %s", aliceFile, contentOne)
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice inviting Bob, Charles and Doris at once.")
+			invites, err := alice.CreateInvitations(aliceFile, []string{"bob", "charles", "doris"})
+			Expect(err).To(BeNil())
+			Expect(len(invites)).To(Equal(3))
+
+			err = bob.AcceptInvitation("alice", invites["bob"], bobFile)
+			Expect(err).To(BeNil())
+
+			err = charles.AcceptInvitation("alice", invites["charles"], charlesFile)
+			Expect(err).To(BeNil())
+
+			err = doris.AcceptInvitation("alice", invites["doris"], dorisFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice revoking Bob and Charles at once.")
+			err = alice.RevokeMany(aliceFile, []string{"bob", "charles"})
+			Expect(err).To(BeNil())
+
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+
+			_, err = charles.LoadFile(charlesFile)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Checking that Doris still has access.")
+			err = doris.AppendToFile(dorisFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+		})
+
+		Specify("Batch Test: A bad recipient makes the whole batch fail without sharing.", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice inviting Bob and a user that does not exist.")
+			_, err = alice.CreateInvitations(aliceFile, []string{"bob", "nobody"})
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Bob was not shared with, so Alice can still invite him.")
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Revoking a batch with a user that was never shared with fails and changes nothing.")
+			err = alice.RevokeMany(aliceFile, []string{"bob", "charles"})
+			Expect(err).ToNot(BeNil())
+
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("Batch Test: A batch that fails part of the way leaves the datastore as it was.", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice pins the keys and the prekeys of Bob and Charles with a batch before.")
+			err = alice.StoreFile(dorisFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			_, err = alice.CreateInvitations(dorisFile, []string{"bob", "charles"})
+			Expect(err).To(BeNil())
+
+			before := make(map[userlib.UUID][]byte)
+			for key, value := range userlib.DatastoreGetMap() {
+				before[key] = value
+			}
+
+			userlib.DebugMsg("The prekeys of Charles cannot be read, so the batch fails after Bob was invited.")
+			bundleUUID, err := client.PrekeyBundleUUID("charles")
+			Expect(err).To(BeNil())
+			datastoreGet := userlib.DatastoreGet
+			userlib.DatastoreGet = func(key userlib.UUID) ([]byte, bool) {
+				if key == bundleUUID {
+					return []byte(strings.Repeat("x", 300)), true
+				}
+				return datastoreGet(key)
+			}
+			_, err = alice.CreateInvitations(aliceFile, []string{"bob", "charles"})
+			userlib.DatastoreGet = datastoreGet
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Nothing that the batch stored is left behind.")
+			after := userlib.DatastoreGetMap()
+			Expect(len(after)).To(Equal(len(before)))
+			for key, value := range before {
+				Expect(string(after[key]) == string(value)).To(BeTrue())
+			}
+
+			userlib.DebugMsg("The batch can be sent again and accepted.")
+			invites, err := alice.CreateInvitations(aliceFile, []string{"bob", "charles"})
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invites["bob"], bobFile)
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invites["charles"], charlesFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Revoking a name twice in one batch revokes it once.")
+			err = alice.RevokeMany(aliceFile, []string{"bob", "bob"})
+			Expect(err).To(BeNil())
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+			data, err := charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("Batch Test: A revocation that fails part of the way leaves everyone with the access they had.", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice shares a directory with two files with Bob and Charles.")
+			err = alice.Mkdir("docs")
+			Expect(err).To(BeNil())
+			err = alice.StoreFile("docs/a.txt", []byte(contentOne))
+			Expect(err).To(BeNil())
+			before := make(map[uuid.UUID]bool)
+			for key := range userlib.DatastoreGetMap() {
+				before[key] = true
+			}
+			err = alice.StoreFile("docs/b.txt", []byte(contentTwo))
+			Expect(err).To(BeNil())
+			var broken []uuid.UUID
+			for key := range userlib.DatastoreGetMap() {
+				if !before[key] {
+					broken = append(broken, key)
+				}
+			}
+			invites, err := alice.CreateInvitations("docs", []string{"bob", "charles"})
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invites["bob"], "bobDocs")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invites["charles"], "charlesDocs")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("b.txt cannot be loaded, so revoking Bob fails and he keeps his access.")
+			datastore := userlib.DatastoreGetMap()
+			stored := make(map[uuid.UUID][]byte)
+			for _, key := range broken {
+				stored[key] = datastore[key]
+				datastore[key] = []byte(strings.Repeat("x", len(datastore[key])))
+			}
+			err = alice.RevokeAccess("docs", "bob")
+			Expect(err).ToNot(BeNil())
+			names, err := bob.ListDir("bobDocs")
+			Expect(err).To(BeNil())
+			Expect(names).To(Equal([]string{"a.txt", "b.txt"}))
+			names, err = charles.ListDir("charlesDocs")
+			Expect(err).To(BeNil())
+			Expect(names).To(Equal([]string{"a.txt", "b.txt"}))
+			data, err := bob.LoadFile("bobDocs/a.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("Once b.txt is back the revocation goes through.")
+			for key, value := range stored {
+				datastore[key] = value
+			}
+			data, err = bob.LoadFile("bobDocs/b.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+			err = alice.RevokeAccess("docs", "bob")
+			Expect(err).To(BeNil())
+			_, err = bob.LoadFile("bobDocs/a.txt")
+			Expect(err).ToNot(BeNil())
+			data, err = charles.LoadFile("charlesDocs/b.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+		})
+	})
+
+	Describe("Lazy Revocation Tests", func() {
+
+		Specify("Lazy Revocation Test: Revoked users cannot read content written after a lazy revocation.", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice storing file %s with content: %s", aliceFile, contentOne)
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			invites, err := alice.CreateInvitations(aliceFile, []string{"bob", "charles"})
+			Expect(err).To(BeNil())
+
+			err = bob.AcceptInvitation("alice", invites["bob"], bobFile)
+			Expect(err).To(BeNil())
+
+			err = charles.AcceptInvitation("alice", invites["charles"], charlesFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Taking a snapshot of the datastore before the revocation.")
+			before := make(map[userlib.UUID][]byte)
+			for key, value := range userlib.DatastoreGetMap() {
+				before[key] = value
+			}
+
+			userlib.DebugMsg("Alice lazily revoking Bob.")
+			err = alice.RevokeAccessLazy(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+
+			err = bob.AppendToFile(bobFile, []byte(contentThree))
+			Expect(err).ToNot(BeNil())
+
+			afterRevoke := make(map[userlib.UUID][]byte)
+			for key, value := range userlib.DatastoreGetMap() {
+				afterRevoke[key] = value
+			}
+
+			userlib.DebugMsg("Charles appending after the revocation.")
+			err = charles.AppendToFile(charlesFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+
+			userlib.DebugMsg("Checking that the append did not write to any uuid Bob knew about.")
+			for key, value := range userlib.DatastoreGetMap() {
+				_, ok := before[key]
+				if ok {
+					Expect(value).To(Equal(afterRevoke[key]))
+				}
+			}
+
+			userlib.DebugMsg("Alice re-encrypting the old parts of the file.")
+			err = alice.ReencryptFile(aliceFile)
+			Expect(err).To(BeNil())
+
+			data, err = charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+		})
+
+		Specify("Lazy Revocation Test: StoreFile replaces the old epochs.", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			err = alice.RevokeAccessLazy(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice overwriting and appending after the revocation.")
+			err = alice.StoreFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			err = alice.AppendToFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo + contentThree)))
+
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Lazy Revocation Test: Blobs under the old key cannot be put back after a lazy revocation.", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Remembering every blob stored under the old key while Bob has access.")
+			history := make(map[userlib.UUID][][]byte)
+			remember := func() {
+				for key, value := range userlib.DatastoreGetMap() {
+					history[key] = append(history[key], value)
+				}
+			}
+			err = alice.SetPrivacyMode(true)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			remember()
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			remember()
+
+			userlib.DebugMsg("Alice lazily revoking Bob and appending.")
+			err = alice.RevokeAccessLazy(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Putting back any older blob either fails or still gives the whole file.")
+			datastore := userlib.DatastoreGetMap()
+			for key, values := range history {
+				current, ok := datastore[key]
+				for _, value := range values {
+					if ok && string(value) == string(current) {
+						continue
+					}
+					datastore[key] = value
+					aliceLaptop, err = client.GetUser("alice", defaultPassword)
+					if err == nil {
+						data, err := aliceLaptop.LoadFile(aliceFile)
+						if err == nil {
+							Expect(string(data)).To(Equal(contentOne + contentTwo + contentThree))
+						}
+					}
+					if ok {
+						datastore[key] = current
+					} else {
+						delete(datastore, key)
+					}
+				}
+			}
+		})
+	})
+
+	Describe("Directory Tests", func() {
+
+		Specify("Directory Test: Testing Mkdir, ListDir and path based Store/Load/Append.", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice creating directories docs and docs/sub.")
+			err = alice.Mkdir("docs")
+			Expect(err).To(BeNil())
+
+			err = alice.Mkdir("docs/sub")
+			Expect(err).To(BeNil())
+
+			err = alice.Mkdir("docs")
+			Expect(err).ToNot(BeNil())
+
+			err = alice.Mkdir("missing/sub")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Alice storing files inside the directories.")
+			err = alice.StoreFile("docs/a.txt", []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile("docs/sub/b.txt", []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			err = alice.AppendToFile("docs/sub/b.txt", []byte(contentThree))
+			Expect(err).To(BeNil())
+
+			data, err := alice.LoadFile("docs/a.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			data, err = alice.LoadFile("docs/sub/b.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo + contentThree)))
+
+			userlib.DebugMsg("Overwriting a file inside a directory.")
+			err = alice.StoreFile("docs/a.txt", []byte(contentThree))
+			Expect(err).To(BeNil())
+
+			data, err = alice.LoadFile("docs/a.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentThree)))
+
+			names, err := alice.ListDir("docs")
+			Expect(err).To(BeNil())
+			Expect(names).To(Equal([]string{"a.txt", "sub/"}))
+
+			_, err = alice.LoadFile("docs")
+			Expect(err).ToNot(BeNil())
+
+			_, err = alice.LoadFile("docs/missing.txt")
+			Expect(err).ToNot(BeNil())
+
+			_, err = alice.ListDir("docs/a.txt")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("A flat filename with a / still works when it is not in a directory.")
+			err = alice.StoreFile("notadir/file.txt", []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			data, err = alice.LoadFile("notadir/file.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("Directory Test: A directory cannot take the name in front of existing flat filenames.", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice stores a flat file notadir/file.txt, so notadir cannot become a directory.")
+			err = alice.StoreFile("notadir/file.txt", []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			err = alice.Mkdir("notadir")
+			Expect(err).ToNot(BeNil())
+
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = aliceLaptop.Mkdir("notadir")
+			Expect(err).ToNot(BeNil())
+
+			data, err := aliceLaptop.LoadFile("notadir/file.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("Bob accepts a file as shared/file.txt, so shared cannot become a directory.")
+			invite, err := alice.CreateInvitation("notadir/file.txt", "bob")
+			Expect(err).To(BeNil())
+
+			err = bob.AcceptInvitation("alice", invite, "shared/file.txt")
+			Expect(err).To(BeNil())
+
+			err = bob.Mkdir("shared")
+			Expect(err).ToNot(BeNil())
+
+			data, err = bob.LoadFile("shared/file.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("Other names can still be directories.")
+			err = bob.Mkdir("docs")
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Directory Test: A directory that cannot be loaded does not turn a path into a flat filename.", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			before := make(map[uuid.UUID]bool)
+			for key := range userlib.DatastoreGetMap() {
+				before[key] = true
+			}
+			err = alice.Mkdir("docs")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Every blob Mkdir stored is broken once, storing docs/file.txt fails every time.")
+			datastore := userlib.DatastoreGetMap()
+			var stored []uuid.UUID
+			for key := range datastore {
+				if !before[key] {
+					stored = append(stored, key)
+				}
+			}
+			Expect(stored).ToNot(BeEmpty())
+			for _, key := range stored {
+				value := datastore[key]
+				broken := append([]byte{}, value...)
+				broken[len(broken)-1] ^= 1
+				datastore[key] = broken
+				err = alice.StoreFile("docs/file.txt", []byte(contentOne))
+				Expect(err).ToNot(BeNil())
+				datastore[key] = value
+			}
+
+			userlib.DebugMsg("Once the directory is back the file is stored in it.")
+			err = alice.StoreFile("docs/file.txt", []byte(contentOne))
+			Expect(err).To(BeNil())
+			names, err := alice.ListDir("docs")
+			Expect(err).To(BeNil())
+			Expect(names).To(Equal([]string{"file.txt"}))
+		})
+
+		Specify("Directory Test: Sharing a directory shares everything under it and revoking re-keys the subtree.", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.Mkdir("docs")
+			Expect(err).To(BeNil())
+
+			err = alice.Mkdir("docs/sub")
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile("docs/sub/b.txt", []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice sharing the directory with Bob and Charles.")
+			invites, err := alice.CreateInvitations("docs", []string{"bob", "charles"})
+			Expect(err).To(BeNil())
+
+			err = bob.AcceptInvitation("alice", invites["bob"], "bobDocs")
+			Expect(err).To(BeNil())
+
+			err = charles.AcceptInvitation("alice", invites["charles"], "charlesDocs")
+			Expect(err).To(BeNil())
+
+			data, err := bob.LoadFile("bobDocs/sub/b.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("Bob creating a new file in the shared directory.")
+			err = bob.StoreFile("bobDocs/sub/c.txt", []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			data, err = alice.LoadFile("docs/sub/c.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+
+			userlib.DebugMsg("Files inside a directory cannot be shared on their own.")
+			_, err = alice.CreateInvitation("docs/sub/b.txt", "bob")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Alice revoking Bob from the directory.")
+			err = alice.RevokeAccess("docs", "bob")
+			Expect(err).To(BeNil())
+
+			_, err = bob.LoadFile("bobDocs/sub/b.txt")
+			Expect(err).ToNot(BeNil())
+
+			_, err = bob.ListDir("bobDocs")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Charles keeps access to everything under the directory.")
+			err = charles.AppendToFile("charlesDocs/sub/b.txt", []byte(contentThree))
+			Expect(err).To(BeNil())
+
+			data, err = alice.LoadFile("docs/sub/b.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentThree)))
+
+			names, err := charles.ListDir("charlesDocs/sub")
+			Expect(err).To(BeNil())
+			Expect(names).To(Equal([]string{"b.txt", "c.txt"}))
+		})
+	})
+
+	Describe("Privacy Mode Tests", func() {
+
+		// Returns the lengths of the blobs that were added to the datastore since the snapshot
+		newBlobLengths := func(snapshot map[userlib.UUID]bool) []int {
+			var lengths []int
+			for key, value := range userlib.DatastoreGetMap() {
+				if !snapshot[key] {
+					lengths = append(lengths, len(value))
+				}
+			}
+			return lengths
+		}
+		takeSnapshot := func() map[userlib.UUID]bool {
+			snapshot := make(map[userlib.UUID]bool)
+			for key := range userlib.DatastoreGetMap() {
+				snapshot[key] = true
+			}
+			return snapshot
+		}
+
+		Specify("Privacy Test: Blob lengths do not depend on the content of a file.", func() {
+			userlib.DebugMsg("Initializing user Alice in privacy mode.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.SetPrivacyMode(true)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Storing a tiny file and a much bigger file.")
+			snapshot := takeSnapshot()
+			err = alice.StoreFile(aliceFile, []byte("a"))
+			Expect(err).To(BeNil())
+			tinyLengths := newBlobLengths(snapshot)
+
+			snapshot = takeSnapshot()
+			err = alice.StoreFile(bobFile, []byte(strings.Repeat(longString, 10)))
+			Expect(err).To(BeNil())
+			bigLengths := newBlobLengths(snapshot)
+
+			Expect(bigLengths).To(ConsistOf(tinyLengths))
+
+			data, err := alice.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(strings.Repeat(longString, 10))))
+		})
+
+		Specify("Privacy Test: The number of appends is hidden.", func() {
+			userlib.DebugMsg("Initializing user Alice in privacy mode.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.SetPrivacyMode(true)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Storing a file in one go.")
+			snapshot := takeSnapshot()
+			err = alice.StoreFile(aliceFile, []byte(strings.Repeat(contentOne, 10)))
+			Expect(err).To(BeNil())
+			oneGoLengths := newBlobLengths(snapshot)
+			oneGoBlobs := len(userlib.DatastoreGetMap())
+
+			userlib.DebugMsg("Storing a file of the same size with many appends.")
+			snapshot = takeSnapshot()
+			err = alice.StoreFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			for i := 0; i < 9; i++ {
+				err = alice.AppendToFile(bobFile, []byte(contentOne))
+				Expect(err).To(BeNil())
+			}
+			appendLengths := newBlobLengths(snapshot)
+
+			Expect(appendLengths).To(ConsistOf(oneGoLengths))
+			Expect(len(userlib.DatastoreGetMap()) - oneGoBlobs).To(Equal(len(oneGoLengths)))
+
+			data, err := alice.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(strings.Repeat(contentOne, 10))))
+		})
+
+		Specify("Privacy Test: Private files work across blocks and for users they are shared with.", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob, Alice in privacy mode.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.SetPrivacyMode(true)
+			Expect(err).To(BeNil())
+
+			big := strings.Repeat(longString, 30)
+			err = alice.StoreFile(aliceFile, []byte(big))
+			Expect(err).To(BeNil())
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob appending more than a block to the private file.")
+			err = bob.AppendToFile(bobFile, []byte(big))
+			Expect(err).To(BeNil())
+
+			err = bob.AppendToFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(big + big + contentOne)))
+
+			userlib.DebugMsg("Revoking Bob re-encrypts the blocks.")
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(big + big + contentOne)))
+		})
+	})
+
+	Describe("Envelope Tests", func() {
+
+		Specify("Envelope Test: Sealed objects open with the same keys and associated data only.", func() {
+			encKey := userlib.RandomBytes(16)
+			macKey := userlib.RandomBytes(16)
+
+			sealed, err := client.SealObject(encKey, macKey, []byte(contentOne), []byte("uuid-1"))
+			Expect(err).To(BeNil())
+
+			opened, err := client.OpenObject(encKey, macKey, sealed, []byte("uuid-1"))
+			Expect(err).To(BeNil())
+			Expect(opened).To(Equal([]byte(contentOne)))
+
+			_, err = client.OpenObject(encKey, macKey, sealed, []byte("uuid-2"))
+			Expect(err).ToNot(BeNil())
+
+			_, err = client.OpenObject(encKey, userlib.RandomBytes(16), sealed, []byte("uuid-1"))
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Changing the version byte makes the envelope fail.")
+			sealed[4] = 2
+			_, err = client.OpenObject(encKey, macKey, sealed, []byte("uuid-1"))
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Short and empty blobs return errors instead of panicking.")
+			for _, length := range []int{0, 1, 21, 63, 64, 79} {
+				_, err = client.OpenObject(encKey, macKey, make([]byte, length), []byte("uuid-1"))
+				Expect(err).ToNot(BeNil())
+			}
+		})
+
+		Specify("Envelope Test: Blobs from before the envelope are moved to the envelope the first time they are opened.", func() {
+			encKey := userlib.RandomBytes(16)
+			macKey := userlib.RandomBytes(16)
+
+			ciphertext := userlib.SymEnc(encKey, userlib.RandomBytes(16), []byte(contentTwo))
+			tag, err := userlib.HMACEval(macKey, ciphertext)
+			Expect(err).To(BeNil())
+			legacy := append(ciphertext, tag...)
+
+			userlib.DebugMsg("OpenObject only opens envelopes.")
+			_, err = client.OpenObject(encKey, macKey, legacy, []byte("any uuid"))
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("An old blob in the datastore is opened once and sealed in the envelope in its place.")
+			first := uuid.New()
+			userlib.DatastoreSet(first, legacy)
+			opened, err := client.RetrieveFromDatastore(first, encKey, macKey)
+			Expect(err).To(BeNil())
+			Expect(opened).To(Equal([]byte(contentTwo)))
+			stored, ok := userlib.DatastoreGet(first)
+			Expect(ok).To(BeTrue())
+			Expect(string(stored[:4])).To(Equal("P2EV"))
+			opened, err = client.RetrieveFromDatastore(first, encKey, macKey)
+			Expect(err).To(BeNil())
+			Expect(opened).To(Equal([]byte(contentTwo)))
+
+			userlib.DebugMsg("Putting the old blob back does not work once it was moved.")
+			userlib.DatastoreSet(first, legacy)
+			_, err = client.RetrieveFromDatastore(first, encKey, macKey)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("A changed old blob is not opened.")
+			second := uuid.New()
+			changed := append([]byte{}, legacy...)
+			changed[0] ^= 1
+			userlib.DatastoreSet(second, changed)
+			_, err = client.RetrieveFromDatastore(second, encKey, macKey)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Envelope Test: Truncated or swapped blobs in the datastore are detected.", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Swapping every blob with another one.")
+			datastore := userlib.DatastoreGetMap()
+			var keys []userlib.UUID
+			for key := range datastore {
+				keys = append(keys, key)
+			}
+			first := datastore[keys[0]]
+			for i := 0; i < len(keys)-1; i++ {
+				datastore[keys[i]] = datastore[keys[i+1]]
+			}
+			datastore[keys[len(keys)-1]] = first
+
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Truncating every blob.")
+			for key := range datastore {
+				datastore[key] = []byte("abc")
+			}
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+
+			_, err = client.GetUser("alice", defaultPassword)
+			Expect(err).ToNot(BeNil())
+		})
+	})
+	Describe("Key Derivation Tests", func() {
+
+		Specify("Key Derivation Test: Different labels and different splits of the same bytes give different values.", func() {
+			Expect(client.DeriveBytes("a", []byte("bc"))).ToNot(Equal(client.DeriveBytes("ab", []byte("c"))))
+			Expect(client.DeriveBytes("x", []byte("ab"), []byte("c"))).ToNot(Equal(client.DeriveBytes("x", []byte("a"), []byte("bc"))))
+			Expect(client.DeriveBytes("x", []byte("abc"))).ToNot(Equal(client.DeriveBytes("x", []byte("ab"), []byte("c"))))
+			Expect(client.DeriveBytes("x", []byte(""))).ToNot(Equal(client.DeriveBytes("x")))
+			Expect(client.DeriveBytes("x", []byte("a"))).To(Equal(client.DeriveBytes("x", []byte("a"))))
+
+			key := userlib.RandomBytes(16)
+			encKey, err := client.DeriveKey(key, "encryption", []byte("file"))
+			Expect(err).To(BeNil())
+			macKey, err := client.DeriveKey(key, "hmac", []byte("file"))
+			Expect(err).To(BeNil())
+			Expect(encKey).To(HaveLen(16))
+			Expect(encKey).ToNot(Equal(macKey))
+
+			first, err := client.DeriveUUID("uuid", []byte("bob"), []byte("kfile"))
+			Expect(err).To(BeNil())
+			second, err := client.DeriveUUID("uuid", []byte("bobk"), []byte("file"))
+			Expect(err).To(BeNil())
+			Expect(first).ToNot(Equal(second))
+		})
+
+		Specify("Key Derivation Test: Users whose usernames and passwords run into each other stay separate.", func() {
+			userlib.DebugMsg("Initializing user c with password ab and user bc with password a.")
+			alice, err = client.InitUser("c", "ab")
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bc", "a")
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = bob.StoreFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			data, err = bob.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+
+			userlib.DebugMsg("Each user can only log in with their own password.")
+			_, err = client.GetUser("c", "a")
+			Expect(err).ToNot(BeNil())
+			_, err = client.GetUser("bc", "ab")
+			Expect(err).ToNot(BeNil())
+			aliceLaptop, err = client.GetUser("c", "ab")
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Key Derivation Test: Users and files stored with the old derivation are moved over.", func() {
+			seal := func(id userlib.UUID, encKey []byte, macKey []byte, object interface{}) {
+				objectBytes, err := json.Marshal(object)
+				Expect(err).To(BeNil())
+				sealed, err := client.SealObject(encKey, macKey, objectBytes, id[:])
+				Expect(err).To(BeNil())
+				userlib.DatastoreSet(id, sealed)
+			}
+			toUUID := func(b []byte) userlib.UUID {
+				id, err := uuid.FromBytes(b[:16])
+				Expect(err).To(BeNil())
+				return id
+			}
+
+			userlib.DebugMsg("Storing alice and aliceFile the way they were stored before.")
+			pk, sk, err := userlib.PKEKeyGen()
+			Expect(err).To(BeNil())
+			signKey, verifyKey, err := userlib.DSKeyGen()
+			Expect(err).To(BeNil())
+			Expect(userlib.KeystoreSet("Public key for:alice", pk)).To(BeNil())
+			Expect(userlib.KeystoreSet("Signature key for:alice", verifyKey)).To(BeNil())
+
+			legacyPassword := userlib.Hash([]byte(defaultPassword + "alice" + "p"))
+			masterKey := userlib.Argon2Key(legacyPassword, []byte("alicek"), 16)
+			userMacKey, err := userlib.HashKDF(masterKey, []byte("HMAC key for user"))
+			Expect(err).To(BeNil())
+			userUUID := toUUID(userlib.Hash([]byte("alice")))
+			//The user struct had the password hash and private keys in it back then
+			var legacyUser struct {
+				Username              string
+				Password              []byte
+				Secret_key            userlib.PKEDecKey
+				Signature_private_key userlib.DSSignKey
+				Files_owned           map[userlib.UUID]bool
+			}
+			legacyUser.Username = "alice"
+			legacyUser.Password = legacyPassword
+			legacyUser.Secret_key = sk
+			legacyUser.Signature_private_key = signKey
+			legacyUser.Files_owned = map[userlib.UUID]bool{
+				toUUID(userlib.Hash([]byte(aliceFile))):   true,
+				toUUID(userlib.Hash([]byte(charlesFile))): true,
+			}
+			seal(userUUID, masterKey, userMacKey[:16], legacyUser)
+
+			storeLegacyFile := func(filename string, content string) userlib.UUID {
+				var referenceUUIDBytes []byte
+				referenceUUIDBytes = append(referenceUUIDBytes, userlib.Hash([]byte("alice"))...)
+				referenceUUIDBytes = append(referenceUUIDBytes, legacyPassword...)
+				referenceUUIDBytes = append(referenceUUIDBytes, userlib.Hash([]byte(filename))...)
+				referenceUUID := toUUID(userlib.Hash(referenceUUIDBytes))
+				referenceEncKey, err := userlib.HashKDF(masterKey, []byte("Encryption key for file"+filename))
+				Expect(err).To(BeNil())
+				referenceMacKey, err := userlib.HashKDF(masterKey, []byte("HMAC key for file"+filename))
+				Expect(err).To(BeNil())
+
+				var reference client.FileReferenceOwner
+				reference.Uuid_shared_with = make(map[string]userlib.UUID)
+				reference.Enc_keys_shared_with = make(map[string][]byte)
+				reference.Hmac_keys_shared_with = make(map[string][]byte)
+				reference.File_enc_key = userlib.RandomBytes(16)
+				reference.Hmac_key = userlib.RandomBytes(16)
+				reference.File_controller_pointer = uuid.New()
+				seal(referenceUUID, referenceEncKey[:16], referenceMacKey[:16], reference)
+
+				var controller client.FileController
+				controller.Start = uuid.New()
+				controller.End = uuid.New()
+				controller.Last = controller.Start
+				seal(reference.File_controller_pointer, reference.File_enc_key, reference.Hmac_key, controller)
+				seal(controller.Start, reference.File_enc_key, reference.Hmac_key, client.File{Content: []byte(content), Next_uuid: controller.End})
+				seal(controller.End, reference.File_enc_key, reference.Hmac_key, client.File{})
+				return referenceUUID
+			}
+			referenceUUID := storeLegacyFile(aliceFile, contentOne)
+			otherReferenceUUID := storeLegacyFile(charlesFile, contentThree)
+
+			userlib.DebugMsg("Logging in moves the user over.")
+			_, err = client.GetUser("alice", defaultPassword2)
+			Expect(err).ToNot(BeNil())
+			alice, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			_, ok := userlib.DatastoreGet(userUUID)
+			Expect(ok).To(BeFalse())
+
+			userlib.DebugMsg("The old file is still there and is moved over when it is used.")
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			_, ok = userlib.DatastoreGet(referenceUUID)
+			Expect(ok).To(BeFalse())
+
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice still owns the file and can share and revoke it.")
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			data, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = aliceLaptop.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			userlib.DebugMsg("A file that was not used yet is still found after the password changes.")
+			err = alice.ChangePassword(defaultPassword2)
+			Expect(err).To(BeNil())
+			_, ok = userlib.DatastoreGet(otherReferenceUUID)
+			Expect(ok).To(BeTrue())
+			aliceDesktop, err = client.GetUser("alice", defaultPassword2)
+			Expect(err).To(BeNil())
+			data, err = aliceDesktop.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentThree)))
+			_, ok = userlib.DatastoreGet(otherReferenceUUID)
+			Expect(ok).To(BeFalse())
+		})
+	})
+	Describe("Password Hashing Tests", func() {
+
+		Specify("Password Hashing Test: Every user gets a random salt and no password hash is stored.", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob with the same password.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			aliceHashing, found, err := client.LoadPasswordHashing("alice")
+			Expect(err).To(BeNil())
+			Expect(found).To(BeTrue())
+			bobHashing, found, err := client.LoadPasswordHashing("bob")
+			Expect(err).To(BeNil())
+			Expect(found).To(BeTrue())
+			Expect(aliceHashing.Salt).ToNot(Equal(bobHashing.Salt))
+			Expect(aliceHashing.Time).To(Equal(client.DefaultPasswordHashing.Time))
+
+			userlib.DebugMsg("Changing the salt of Alice is detected.")
+			hashingUUID, err := client.PasswordHashingUUID("alice")
+			Expect(err).To(BeNil())
+			signed, ok := userlib.DatastoreGet(hashingUUID)
+			Expect(ok).To(BeTrue())
+			bobUUID, err := client.PasswordHashingUUID("bob")
+			Expect(err).To(BeNil())
+			bobSigned, ok := userlib.DatastoreGet(bobUUID)
+			Expect(ok).To(BeTrue())
+			userlib.DatastoreSet(hashingUUID, bobSigned)
+			_, err = client.GetUser("alice", defaultPassword)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("A session that is already open does not hash the password again and keeps working.")
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DatastoreSet(hashingUUID, signed)
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Password Hashing Test: Raising the cost rehashes the password at the next login.", func() {
+			userlib.DebugMsg("Initializing user Alice and storing a file.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			before, _, err := client.LoadPasswordHashing("alice")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Raising the cost and logging in again.")
+			defaultHashing := client.DefaultPasswordHashing
+			defer func() { client.DefaultPasswordHashing = defaultHashing }()
+			client.DefaultPasswordHashing.Time = 2
+
+			_, err = client.GetUser("alice", defaultPassword2)
+			Expect(err).ToNot(BeNil())
+			after, _, err := client.LoadPasswordHashing("alice")
+			Expect(err).To(BeNil())
+			Expect(after).To(Equal(before))
+
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			after, _, err = client.LoadPasswordHashing("alice")
+			Expect(err).To(BeNil())
+			Expect(after.Time).To(Equal(uint32(2)))
+			Expect(after.Salt).ToNot(Equal(before.Salt))
+
+			userlib.DebugMsg("Both sessions still work and the file is still there.")
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err := aliceLaptop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			aliceDesktop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			latest, _, err := client.LoadPasswordHashing("alice")
+			Expect(err).To(BeNil())
+			Expect(latest).To(Equal(after))
+		})
+
+		Specify("Password Hashing Test: A session only hashes the password again after the salt changes.", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			_, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			hashingUUID, err := client.PasswordHashingUUID("alice")
+			Expect(err).To(BeNil())
+
+			hashingLoads := func(operation func()) (loads int) {
+				datastoreGet := userlib.DatastoreGet
+				userlib.DatastoreGet = func(key uuid.UUID) ([]byte, bool) {
+					if key == hashingUUID {
+						loads++
+					}
+					return datastoreGet(key)
+				}
+				defer func() { userlib.DatastoreGet = datastoreGet }()
+				operation()
+				return loads
+			}
+			operations := func() {
+				err = alice.StoreFile(aliceFile, []byte(contentOne))
+				Expect(err).To(BeNil())
+				err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+				Expect(err).To(BeNil())
+				data, err := alice.LoadFile(aliceFile)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+			}
+			Expect(hashingLoads(operations)).To(Equal(0))
+			Expect(hashingLoads(func() {
+				_, err = alice.CreateInvitation(aliceFile, "bob")
+				Expect(err).To(BeNil())
+			})).To(Equal(0))
+
+			userlib.DebugMsg("Another session raises the cost, Alice derives the master key once more.")
+			defaultHashing := client.DefaultPasswordHashing
+			defer func() { client.DefaultPasswordHashing = defaultHashing }()
+			client.DefaultPasswordHashing.Time = 2
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(hashingLoads(operations)).To(Equal(1))
+			Expect(hashingLoads(operations)).To(Equal(0))
+		})
+	})
+	Describe("Device Tests", func() {
+
+		Specify("Device Test: A new device can only log in after a session approves it.", func() {
+			userlib.DebugMsg("Initializing user Alice and storing a file.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			_, err = client.NewDevice("bob")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Creating a laptop for Alice.")
+			laptop, err := client.NewDevice("alice")
+			Expect(err).To(BeNil())
+			_, err = client.GetUserOnDevice(laptop)
+			Expect(err).ToNot(BeNil())
+
+			err = alice.ApproveDevice(laptop.Id, "laptop")
+			Expect(err).To(BeNil())
+			err = alice.ApproveDevice(laptop.Id, "laptop")
+			Expect(err).ToNot(BeNil())
+			err = alice.ApproveDevice("not a device", "phone")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("The laptop logs in without the password.")
+			aliceLaptop, err = client.GetUserOnDevice(laptop)
+			Expect(err).To(BeNil())
+			data, err := aliceLaptop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			err = aliceLaptop.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			devices, err := alice.ListDevices()
+			Expect(err).To(BeNil())
+			Expect(devices).To(HaveLen(1))
+			Expect(devices[0].Id).To(Equal(laptop.Id))
+			Expect(devices[0].Name).To(Equal("laptop"))
+
+			userlib.DebugMsg("The device of Alice does not open the account of Bob.")
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			_, err = client.GetUserOnDevice(&client.Device{Username: "bob", Id: laptop.Id, Private_key: laptop.Private_key})
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Device Test: A removed device is cut off without changing the password.", func() {
+			userlib.DebugMsg("Initializing user Alice with a laptop and a phone.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			laptop, err := client.NewDevice("alice")
+			Expect(err).To(BeNil())
+			phone, err := client.NewDevice("alice")
+			Expect(err).To(BeNil())
+			err = alice.ApproveDevice(laptop.Id, "laptop")
+			Expect(err).To(BeNil())
+			err = alice.ApproveDevice(phone.Id, "phone")
+			Expect(err).To(BeNil())
+			aliceLaptop, err = client.GetUserOnDevice(laptop)
+			Expect(err).To(BeNil())
+			alicePhone, err = client.GetUserOnDevice(phone)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("The phone removes the lost laptop.")
+			err = alicePhone.RemoveDevice(laptop.Id)
+			Expect(err).To(BeNil())
+			err = alicePhone.RemoveDevice(laptop.Id)
+			Expect(err).ToNot(BeNil())
+
+			_, err = aliceLaptop.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+			err = aliceLaptop.StoreFile(bobFile, []byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+			_, err = aliceLaptop.ListDevices()
+			Expect(err).ToNot(BeNil())
+			_, err = client.GetUserOnDevice(laptop)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("The phone, the old password session and the password still work.")
+			err = alicePhone.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+			aliceDesktop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			devices, err := aliceDesktop.ListDevices()
+			Expect(err).To(BeNil())
+			Expect(devices).To(HaveLen(1))
+			Expect(devices[0].Id).To(Equal(phone.Id))
+
+			userlib.DebugMsg("Approving the laptop again lets it back in.")
+			err = aliceDesktop.ApproveDevice(laptop.Id, "laptop")
+			Expect(err).To(BeNil())
+			aliceLaptop, err = client.GetUserOnDevice(laptop)
+			Expect(err).To(BeNil())
+			data, err = aliceLaptop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+		})
+
+		Specify("Device Test: A device does not open an account somebody else put in its slot.", func() {
+			userlib.DebugMsg("Initializing user Alice with a laptop.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			laptop, err := client.NewDevice("alice")
+			Expect(err).To(BeNil())
+			err = alice.ApproveDevice(laptop.Id, "laptop")
+			Expect(err).To(BeNil())
+
+			keystore := make(map[string]userlib.PublicKeyType)
+			for key, value := range userlib.KeystoreGetMap() {
+				keystore[key] = value
+			}
+			datastore := make(map[userlib.UUID][]byte)
+			for key, value := range userlib.DatastoreGetMap() {
+				datastore[key] = value
+			}
+
+			userlib.DebugMsg("An attacker builds an account of their own for the public key of the laptop.")
+			userlib.DatastoreClear()
+			userlib.KeystoreClear()
+			for key, value := range keystore {
+				if strings.Contains(key, laptop.Id) {
+					userlib.KeystoreGetMap()[key] = value
+				}
+			}
+			evil, err := client.InitUser("alice", "evil")
+			Expect(err).To(BeNil())
+			err = evil.StoreFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			err = evil.ApproveDevice(laptop.Id, "laptop")
+			Expect(err).To(BeNil())
+			forged := make(map[userlib.UUID][]byte)
+			for key, value := range userlib.DatastoreGetMap() {
+				forged[key] = value
+			}
+
+			userlib.DebugMsg("The attacker writes every blob of their account over the one of Alice.")
+			userlib.DatastoreClear()
+			userlib.KeystoreClear()
+			for key, value := range keystore {
+				userlib.KeystoreGetMap()[key] = value
+			}
+			for key, value := range datastore {
+				userlib.DatastoreGetMap()[key] = value
+			}
+			for key, value := range forged {
+				userlib.DatastoreGetMap()[key] = value
+			}
+
+			_, err = client.GetUserOnDevice(laptop)
+			Expect(err).ToNot(BeNil())
+			_, err = client.GetUser("alice", "evil")
+			Expect(err).ToNot(BeNil())
+		})
+	})
+	Describe("Recovery Tests", func() {
+
+		Specify("Recovery Test: A recovery code restores the account with a new password once.", func() {
+			userlib.DebugMsg("Initializing user Alice with three recovery codes.")
+			var codes []string
+			alice, codes, err = client.InitUserWithRecovery("alice", defaultPassword, 3)
+			Expect(err).To(BeNil())
+			Expect(codes).To(HaveLen(3))
+			Expect(codes[0]).ToNot(Equal(codes[1]))
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			laptop, err := client.NewDevice("alice")
+			Expect(err).To(BeNil())
+			err = alice.ApproveDevice(laptop.Id, "laptop")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Wrong codes do not work.")
+			_, err = client.RecoverAccount("alice", "not a code", defaultPassword2)
+			Expect(err).ToNot(BeNil())
+			_, err = client.RecoverAccount("bob", codes[0], defaultPassword2)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Alice forgot her password and uses the first code.")
+			alicePhone, err = client.RecoverAccount("alice", strings.ToUpper(codes[0]), defaultPassword2)
+			Expect(err).To(BeNil())
+			data, err := alicePhone.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			_, err = client.GetUser("alice", defaultPassword)
+			Expect(err).ToNot(BeNil())
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+			aliceDesktop, err = client.GetUser("alice", defaultPassword2)
+			Expect(err).To(BeNil())
+			err = aliceDesktop.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("The code cannot be used again, the other codes and the laptop still work.")
+			_, err = client.RecoverAccount("alice", codes[0], defaultPassword)
+			Expect(err).ToNot(BeNil())
+			aliceLaptop, err = client.GetUserOnDevice(laptop)
+			Expect(err).To(BeNil())
+			data, err = aliceLaptop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			alice, err = client.RecoverAccount("alice", codes[1], defaultPassword)
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+		})
+
+		Specify("Recovery Test: Changing the password and replacing the recovery codes.", func() {
+			userlib.DebugMsg("Initializing user Alice with two sessions.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			oldCodes, err := alice.CreateRecoveryCodes(2)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Changing the password cuts off the other password session.")
+			err = alice.ChangePassword(defaultPassword2)
+			Expect(err).To(BeNil())
+			_, err = aliceLaptop.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+			_, err = client.GetUser("alice", defaultPassword)
+			Expect(err).ToNot(BeNil())
+			aliceLaptop, err = client.GetUser("alice", defaultPassword2)
+			Expect(err).To(BeNil())
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("New recovery codes replace the old ones.")
+			newCodes, err := aliceLaptop.CreateRecoveryCodes(1)
+			Expect(err).To(BeNil())
+			_, err = client.RecoverAccount("alice", oldCodes[1], defaultPassword)
+			Expect(err).ToNot(BeNil())
+			alicePhone, err = client.RecoverAccount("alice", newCodes[0], defaultPassword)
+			Expect(err).To(BeNil())
+			data, err = alicePhone.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+	})
+	Describe("Contact Tests", func() {
+
+		Specify("Contact Test: Fingerprints can be compared and verified out of band.", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			fingerprint, verified, err := alice.GetFingerprint("bob")
+			Expect(err).To(BeNil())
+			Expect(verified).To(BeFalse())
+			bobFingerprint, err := bob.MyFingerprint()
+			Expect(err).To(BeNil())
+			Expect(fingerprint).To(Equal(bobFingerprint))
+
+			_, _, err = alice.GetFingerprint("charles")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Alice checks the fingerprint of Bob.")
+			aliceFingerprint, err := alice.MyFingerprint()
+			Expect(err).To(BeNil())
+			Expect(aliceFingerprint).ToNot(Equal(bobFingerprint))
+			err = alice.VerifyFingerprint("bob", aliceFingerprint)
+			Expect(err).ToNot(BeNil())
+			err = alice.VerifyFingerprint("bob", strings.ToUpper(bobFingerprint))
+			Expect(err).To(BeNil())
+
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			_, verified, err = aliceLaptop.GetFingerprint("bob")
+			Expect(err).To(BeNil())
+			Expect(verified).To(BeTrue())
+		})
+
+		Specify("Contact Test: Sharing fails if a pinned key changes.", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(charlesFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice shares with Bob, which pins the keys on both sides.")
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitation(charlesFile, "bob")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("The keystore now gives the public key of Charles for Bob.")
+			keystore := userlib.KeystoreGetMap()
+			keystore["Public key for:bob"] = keystore["Public key for:charles"]
+
+			_, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).ToNot(BeNil())
+			_, err = alice.CreateInvitations(charlesFile, []string{"charles", "bob"})
+			Expect(err).ToNot(BeNil())
+			_, _, err = alice.GetFingerprint("bob")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Users that did not pin anything yet are not affected.")
+			_, err = alice.CreateInvitation(charlesFile, "charles")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("The keystore now gives the signature key of Charles for Alice.")
+			keystore["Signature key for:alice"] = keystore["Signature key for:charles"]
+			err = bob.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Describe("Key Rotation Tests", func() {
+
+		Specify("Key Rotation Test: Pending invitations and pinned contacts survive a rotation.", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(charlesFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice invites Bob, then both rotate their keys.")
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, _, err = bob.GetFingerprint("alice")
+			Expect(err).To(BeNil())
+			oldFingerprint, err := alice.MyFingerprint()
+			Expect(err).To(BeNil())
+			err = alice.RotateKeys()
+			Expect(err).To(BeNil())
+			err = bob.RotateKeys()
+			Expect(err).To(BeNil())
+			newFingerprint, err := alice.MyFingerprint()
+			Expect(err).To(BeNil())
+			Expect(newFingerprint).ToNot(Equal(oldFingerprint))
+
+			userlib.DebugMsg("Bob accepts the invitation sent before the rotation.")
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			fingerprint, _, err := bob.GetFingerprint("alice")
+			Expect(err).To(BeNil())
+			Expect(fingerprint).To(Equal(newFingerprint))
+
+			userlib.DebugMsg("New invitations use the new keys and the users can still log in.")
+			invite, err = alice.CreateInvitation(charlesFile, "bob")
+			Expect(err).To(BeNil())
+			bobLaptop, err := client.GetUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = bobLaptop.ForgetOldKeys()
+			Expect(err).To(BeNil())
+			err = bobLaptop.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			data, err = aliceLaptop.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+		})
+
+		Specify("Key Rotation Test: Forgotten keys and unsigned rotations are rejected.", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob forgets his old keys before accepting.")
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = bob.RotateKeys()
+			Expect(err).To(BeNil())
+			err = bob.ForgetOldKeys()
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Alice has pinned Bob, a new version of his keys without a valid rotation is not used.")
+			fingerprint, _, err := alice.GetFingerprint("bob")
+			Expect(err).To(BeNil())
+			keystore := userlib.KeystoreGetMap()
+			keystore["Public key v3 for:bob"] = keystore["Public key for:charles"]
+			keystore["Signature key v3 for:bob"] = keystore["Signature key for:charles"]
+			invite, err = alice.CreateInvitation(bobFile, "bob")
+			Expect(err).To(BeNil())
+			pinned, _, err := alice.GetFingerprint("bob")
+			Expect(err).To(BeNil())
+			Expect(pinned).To(Equal(fingerprint))
+
+			userlib.DebugMsg("Charles sees Bob for the first time and does not pin the keys without a valid rotation either.")
+			pinned, _, err = charles.GetFingerprint("bob")
+			Expect(err).To(BeNil())
+			Expect(pinned).To(Equal(fingerprint))
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+		})
+
+		Specify("Key Rotation Test: Keys put under the next version before the user rotates are not used.", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			fingerprint, err := bob.MyFingerprint()
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Charles puts his own keys in the keystore as the next version of the keys of Bob.")
+			keystore := userlib.KeystoreGetMap()
+			keystore["Public key v2 for:bob"] = keystore["Public key for:charles"]
+			keystore["Signature key v2 for:bob"] = keystore["Signature key for:charles"]
+
+			userlib.DebugMsg("Alice sees Bob for the first time and pins the keys Bob has.")
+			pinned, _, err := alice.GetFingerprint("bob")
+			Expect(err).To(BeNil())
+			Expect(pinned).To(Equal(fingerprint))
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("Bob can still log in.")
+			bobLaptop, err := client.GetUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			_, err = bobLaptop.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("The names Charles took do not keep Bob from rotating, and Alice follows the rotation.")
+			err = bob.RotateKeys()
+			Expect(err).To(BeNil())
+			rotated, err := bob.MyFingerprint()
+			Expect(err).To(BeNil())
+			Expect(rotated).ToNot(Equal(fingerprint))
+			err = alice.StoreFile(charlesFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitation(charlesFile, "bob")
+			Expect(err).To(BeNil())
+			pinned, _, err = alice.GetFingerprint("bob")
+			Expect(err).To(BeNil())
+			Expect(pinned).To(Equal(rotated))
+			err = bobLaptop.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+			data, err = bobLaptop.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+		})
+	})
+
+	Describe("Prekey Tests", func() {
+
+		Specify("Prekey Test: A prekey is forgotten once its invitation is accepted.", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			files := []string{aliceFile, bobFile, charlesFile}
+			for _, file := range files {
+				err = alice.StoreFile(file, []byte(contentOne))
+				Expect(err).To(BeNil())
+			}
+
+			userlib.DebugMsg("Bob publishes more prekeys and Alice sends him three invitations.")
+			err = bob.PublishPrekeys(3)
+			Expect(err).To(BeNil())
+			bobBundle, err := client.PrekeyBundleUUID("bob")
+			Expect(err).To(BeNil())
+			bundleBytes, ok := userlib.DatastoreGet(bobBundle)
+			Expect(ok).To(BeTrue())
+			var bundle client.PrekeyBundle
+			err = json.Unmarshal(bundleBytes[:len(bundleBytes)-256], &bundle)
+			Expect(err).To(BeNil())
+			published := len(bundle.Prekeys)
+			Expect(published >= 3).To(BeTrue())
+			invites := make([]uuid.UUID, len(files))
+			for i, file := range files {
+				invites[i], err = alice.CreateInvitation(file, "bob")
+				Expect(err).To(BeNil())
+			}
+
+			userlib.DebugMsg("Every invitation used a different prekey, each of them can be opened once.")
+			for i, file := range files {
+				err = bob.AcceptInvitation("alice", invites[i], file)
+				Expect(err).To(BeNil())
+				data, err := bob.LoadFile(file)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(contentOne)))
+			}
+
+			bobLaptop, err := client.GetUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = bobLaptop.AcceptInvitation("alice", invites[0], "copy of "+aliceFile)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Bob made a new prekey for every one he used.")
+			bundleBytes, ok = userlib.DatastoreGet(bobBundle)
+			Expect(ok).To(BeTrue())
+			bundle = client.PrekeyBundle{}
+			err = json.Unmarshal(bundleBytes[:len(bundleBytes)-256], &bundle)
+			Expect(err).To(BeNil())
+			Expect(len(bundle.Prekeys)).To(Equal(published))
+		})
+
+		Specify("Prekey Test: Marks nobody signed and older bundles do not make the senders skip the prekeys.", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			bobBundle, err := client.PrekeyBundleUUID("bob")
+			Expect(err).To(BeNil())
+			oldBundle, ok := userlib.DatastoreGet(bobBundle)
+			Expect(ok).To(BeTrue())
+			var bundle client.PrekeyBundle
+			err = json.Unmarshal(oldBundle[:len(oldBundle)-256], &bundle)
+			Expect(err).To(BeNil())
+			counter := bundle.Counter
+
+			userlib.DebugMsg("Somebody marks every prekey of Bob as taken.")
+			for id := range bundle.Prekeys {
+				claim, err := client.DeriveUUID("prekey claim uuid", []byte("bob"), id[:])
+				Expect(err).To(BeNil())
+				userlib.DatastoreSet(claim, []byte{1})
+			}
+
+			userlib.DebugMsg("The invitation of Alice still uses a prekey, Bob publishes a new bundle when he accepts it.")
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			bundleBytes, ok := userlib.DatastoreGet(bobBundle)
+			Expect(ok).To(BeTrue())
+			bundle = client.PrekeyBundle{}
+			err = json.Unmarshal(bundleBytes[:len(bundleBytes)-256], &bundle)
+			Expect(err).To(BeNil())
+			Expect(bundle.Counter > counter).To(BeTrue())
+
+			userlib.DebugMsg("Alice has seen the new bundle, the old one or no bundle at all is rejected.")
+			err = alice.StoreFile(charlesFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			_, err = alice.CreateInvitation(charlesFile, "bob")
+			Expect(err).To(BeNil())
+			userlib.DatastoreSet(bobBundle, oldBundle)
+			_, err = alice.CreateInvitation(charlesFile, "bob")
+			Expect(err).ToNot(BeNil())
+			userlib.DatastoreDelete(bobBundle)
+			_, err = alice.CreateInvitation(charlesFile, "bob")
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Prekey Test: Prekeys that are not signed by the recipient are rejected.", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("The datastore gives the prekeys of Charles for Bob.")
+			bobBundle, err := client.PrekeyBundleUUID("bob")
+			Expect(err).To(BeNil())
+			charlesBundle, err := client.PrekeyBundleUUID("charles")
+			Expect(err).To(BeNil())
+			datastore := userlib.DatastoreGetMap()
+			datastore[bobBundle] = datastore[charlesBundle]
+			_, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Without a bundle the invitation only uses the long term key.")
+			delete(datastore, bobBundle)
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+	})
+
+	Describe("Logout Tests", func() {
+
+		Specify("Logout Test: A session cannot be used after logging out.", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice logs out, her other session keeps working.")
+			alice.Logout()
+			Expect(alice.Root_key).To(BeNil())
+			Expect(alice.Wrapped_keys).To(BeNil())
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+			data, err := aliceLaptop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("Logging in again works.")
+			alice, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("Logout Test: The private keys are not in the user struct in the clear.", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userBytes, err := json.Marshal(alice)
+			Expect(err).To(BeNil())
+			Expect(strings.Contains(string(userBytes), "Secret_key")).To(BeFalse())
+			Expect(strings.Contains(string(userBytes), "Signature_private_key")).To(BeFalse())
+			Expect(strings.Contains(string(userBytes), "\"Password\"")).To(BeFalse())
+			Expect(alice.Wrapped_keys).ToNot(BeNil())
+		})
+	})
+
+	Describe("Deduplication Tests", func() {
+
+		datastoreSize := func() (size int) {
+			for _, value := range userlib.DatastoreGetMap() {
+				size += len(value)
+			}
+			return size
+		}
+
+		Specify("Deduplication Test: Storing the same content again costs almost no storage.", func() {
+			userlib.DebugMsg("Initializing user Alice with deduplication.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.SetDeduplication(true)
+			Expect(err).To(BeNil())
+
+			content := userlib.RandomBytes(256 * 1024)
+			before := datastoreSize()
+			err = alice.StoreFile(aliceFile, content)
+			Expect(err).To(BeNil())
+			firstCopy := datastoreSize() - before
+
+			userlib.DebugMsg("A copy and a copy with a few bytes in front share most chunks.")
+			before = datastoreSize()
+			err = alice.StoreFile(bobFile, content)
+			Expect(err).To(BeNil())
+			edited := append([]byte("a few new bytes"), content...)
+			err = alice.StoreFile(charlesFile, edited)
+			Expect(err).To(BeNil())
+			Expect(datastoreSize() - before).To(BeNumerically("<", firstCopy/4))
+
+			data, err := alice.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(content))
+			data, err = alice.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(edited))
+
+			userlib.DebugMsg("Shared files can be read and appended to by users without deduplication.")
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(append(append([]byte{}, content...), contentOne...)))
+
+			userlib.DebugMsg("Chunks are deleted once no file points to them.")
+			before = datastoreSize()
+			for _, file := range []string{aliceFile, bobFile, charlesFile} {
+				err = alice.StoreFile(file, []byte(contentTwo))
+				Expect(err).To(BeNil())
+			}
+			Expect(before - datastoreSize()).To(BeNumerically(">", len(content)))
+		})
+
+		Specify("Deduplication Test: Sensitive files are never deduplicated.", func() {
+			userlib.DebugMsg("Initializing user Alice with deduplication.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.SetDeduplication(true)
+			Expect(err).To(BeNil())
+
+			content := userlib.RandomBytes(64 * 1024)
+			err = alice.StoreFile(aliceFile, content)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.SetSensitive(bobFile, true)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Storing the same content in the sensitive file stores all of it again.")
+			//The old content of the file is deleted, so count what is written instead of the size of the datastore
+			written := 0
+			datastoreSet := userlib.DatastoreSet
+			userlib.DatastoreSet = func(key userlib.UUID, value []byte) {
+				written += len(value)
+				datastoreSet(key, value)
+			}
+			err = alice.StoreFile(bobFile, content)
+			userlib.DatastoreSet = datastoreSet
+			Expect(err).To(BeNil())
+			Expect(written).To(BeNumerically(">", len(content)))
+
+			userlib.DebugMsg("Marking a deduplicated file as sensitive moves its content back into the file.")
+			err = alice.SetSensitive(aliceFile, true)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(charlesFile, content)
+			Expect(err).To(BeNil())
+			err = alice.SetSensitive(charlesFile, true)
+			Expect(err).To(BeNil())
+			for _, file := range []string{aliceFile, bobFile, charlesFile} {
+				data, err := alice.LoadFile(file)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal(content))
+			}
+		})
+	})
+
+	Describe("Compression Tests", func() {
+
+		measureBandwidth := func(probe func()) (bandwidth int) {
+			before := userlib.DatastoreGetBandwidth()
+			probe()
+			after := userlib.DatastoreGetBandwidth()
+			return after - before
+		}
+
+		Specify("Compression Test: File content is not inflated by its encoding.", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("The bandwidth of storing nothing is what every call costs anyway.")
+			err = alice.StoreFile(aliceFile, []byte{})
+			Expect(err).To(BeNil())
+			overhead := measureBandwidth(func() {
+				err = alice.StoreFile(aliceFile, []byte{})
+				Expect(err).To(BeNil())
+			})
+			content := userlib.RandomBytes(64 * 1024)
+			bandwidth := measureBandwidth(func() {
+				err = alice.StoreFile(aliceFile, content)
+				Expect(err).To(BeNil())
+			})
+			userlib.DebugMsg("Storing %d random bytes used %d bytes of bandwidth more than storing nothing.", len(content), bandwidth-overhead)
+			Expect(bandwidth - overhead).To(BeNumerically("<", len(content)*11/10))
+
+			overhead = measureBandwidth(func() {
+				err = alice.AppendToFile(aliceFile, []byte{})
+				Expect(err).To(BeNil())
+			})
+			bandwidth = measureBandwidth(func() {
+				err = alice.AppendToFile(aliceFile, content)
+				Expect(err).To(BeNil())
+			})
+			Expect(bandwidth - overhead).To(BeNumerically("<", len(content)*11/10))
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(append(append([]byte{}, content...), content...)))
+		})
+
+		Specify("Compression Test: Compressed files use less storage and stay readable for everyone.", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			content := []byte(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 2000))
+			plain := measureBandwidth(func() {
+				err = alice.StoreFile(aliceFile, content)
+				Expect(err).To(BeNil())
+			})
+			err = alice.SetCompression(aliceFile, true)
+			Expect(err).To(BeNil())
+			compressed := measureBandwidth(func() {
+				err = alice.StoreFile(aliceFile, content)
+				Expect(err).To(BeNil())
+			})
+			userlib.DebugMsg("Storing %d bytes of text used %d bytes uncompressed and %d bytes compressed.", len(content), plain, compressed)
+			Expect(compressed).To(BeNumerically("<", plain/4))
+
+			userlib.DebugMsg("Bob appends to the compressed file and both can read it.")
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			expected := append(append([]byte{}, content...), contentOne...)
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected))
+
+			userlib.DebugMsg("Turning compression off keeps the content.")
+			err = bob.SetCompression(bobFile, false)
+			Expect(err).To(BeNil())
+			data, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected))
+
+			userlib.DebugMsg("Private files are not compressed.")
+			err = alice.SetPrivacyMode(true)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(charlesFile, content)
+			Expect(err).To(BeNil())
+			err = alice.SetCompression(charlesFile, true)
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Describe("Encoding Tests", func() {
+
+		Specify("Encoding Test: Stored structs round trip through the binary encoding and JSON.", func() {
+			var reference client.FileReferenceOwner
+			reference.Is_directory = true
+			reference.File_enc_key = userlib.RandomBytes(16)
+			reference.Hmac_key = userlib.RandomBytes(16)
+			reference.File_controller_pointer = uuid.New()
+			reference.Uuid_shared_with = map[string]uuid.UUID{"bob": uuid.New(), "charles": uuid.New()}
+			reference.Enc_keys_shared_with = map[string][]byte{"bob": userlib.RandomBytes(16), "charles": userlib.RandomBytes(16)}
+			reference.Hmac_keys_shared_with = map[string][]byte{"bob": userlib.RandomBytes(16), "charles": userlib.RandomBytes(16)}
+			reference.Invitations_shared_with = map[string]uuid.UUID{"charles": uuid.New()}
+
+			binaryBytes, err := client.MarshalObject(reference)
+			Expect(err).To(BeNil())
+			jsonBytes, err := json.Marshal(reference)
+			Expect(err).To(BeNil())
+			Expect(len(binaryBytes)).To(BeNumerically("<", len(jsonBytes)/2))
+
+			for _, encoded := range [][]byte{binaryBytes, jsonBytes} {
+				var decoded client.FileReferenceOwner
+				err = client.UnmarshalObject(encoded, &decoded)
+				Expect(err).To(BeNil())
+				Expect(decoded).To(Equal(reference))
+			}
+
+			controller := client.FileController{Start: uuid.New(), End: uuid.New(), Last: uuid.New(), Epoch: 2, Private: true,
+				Old_enc_keys: [][]byte{userlib.RandomBytes(16)}, Old_hmac_keys: [][]byte{userlib.RandomBytes(16)}}
+			controllerBytes, err := client.MarshalObject(controller)
+			Expect(err).To(BeNil())
+			var decodedController client.FileController
+			err = client.UnmarshalObject(controllerBytes, &decodedController)
+			Expect(err).To(BeNil())
+			Expect(decodedController).To(Equal(controller))
+
+			userlib.DebugMsg("Users are stored in the binary encoding and still work.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			data, err := aliceLaptop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			userBytes, err := client.MarshalObject(aliceLaptop)
+			Expect(err).To(BeNil())
+			var decodedUser client.User
+			err = client.UnmarshalObject(userBytes, &decodedUser)
+			Expect(err).To(BeNil())
+			Expect(decodedUser.Username).To(Equal("alice"))
+			Expect(decodedUser.Root_key).To(Equal(aliceLaptop.Root_key))
+			Expect(decodedUser.Files_owned).To(Equal(aliceLaptop.Files_owned))
+		})
+
+		Specify("Encoding Test: Broken records are rejected.", func() {
+			invitation := client.Invitation{FRPdk: userlib.RandomBytes(16), FRPhmk: userlib.RandomBytes(16)}
+			encoded, err := client.MarshalObject(invitation)
+			Expect(err).To(BeNil())
+			var decoded client.Invitation
+
+			userlib.DebugMsg("Truncated, with bytes left over and as another struct.")
+			err = client.UnmarshalObject(encoded[:len(encoded)-1], &decoded)
+			Expect(err).ToNot(BeNil())
+			err = client.UnmarshalObject(append(append([]byte{}, encoded...), 0), &decoded)
+			Expect(err).ToNot(BeNil())
+			var secondary client.FileReferenceSecondary
+			err = client.UnmarshalObject(encoded, &secondary)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("A length that is longer than the record.")
+			broken := append([]byte{}, encoded...)
+			broken[2] = 0xff
+			err = client.UnmarshalObject(broken, &decoded)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Records that end before their last fields.")
+			controller := client.FileController{Start: uuid.New(), End: uuid.New(), Last: uuid.New()}
+			controllerBytes, err := client.MarshalObject(controller)
+			Expect(err).To(BeNil())
+			var decodedController client.FileController
+			err = client.UnmarshalObject(controllerBytes[:len(controllerBytes)-4], &decodedController)
+			Expect(err).ToNot(BeNil())
+			err = client.UnmarshalObject(controllerBytes[:len(controllerBytes)-12], &decodedController)
+			Expect(err).ToNot(BeNil())
+			reference := client.FileReferenceOwner{File_controller_pointer: uuid.New()}
+			referenceBytes, err := client.MarshalObject(reference)
+			Expect(err).To(BeNil())
+			var decodedReference client.FileReferenceOwner
+			err = client.UnmarshalObject(referenceBytes[:len(referenceBytes)-4], &decodedReference)
+			Expect(err).ToNot(BeNil())
+
+			err = client.UnmarshalObject(encoded, &decoded)
+			Expect(err).To(BeNil())
+			Expect(decoded).To(Equal(invitation))
+		})
+	})
+
+	Describe("Garbage Collection Tests", func() {
+
+		Specify("Garbage Collection Test: Overwriting a file deletes the old content.", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			stored := len(userlib.DatastoreGetMap())
+
+			userlib.DebugMsg("Appending and overwriting many times does not leave anything behind.")
+			for i := 0; i < 5; i++ {
+				for j := 0; j < 3; j++ {
+					err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+					Expect(err).To(BeNil())
+				}
+				Expect(len(userlib.DatastoreGetMap())).To(Equal(stored + 3))
+				err = alice.StoreFile(aliceFile, []byte(contentOne))
+				Expect(err).To(BeNil())
+				Expect(len(userlib.DatastoreGetMap())).To(Equal(stored))
+			}
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("Garbage Collection Test: Invitations and references are deleted once they are not needed.", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, Charles and Doris.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("An accepted invitation is deleted by the recipient.")
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			_, ok := userlib.DatastoreGetMap()[invite]
+			Expect(ok).To(BeFalse())
+
+			userlib.DebugMsg("Revoking a user that did not accept yet deletes the invitation.")
+			invite, err = alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = alice.RevokeAccess(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			_, ok = userlib.DatastoreGetMap()[invite]
+			Expect(ok).To(BeFalse())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Sharing that fails part of the way leaves nothing behind.")
+			stored := len(userlib.DatastoreGetMap())
+			bundle, err := client.PrekeyBundleUUID("doris")
+			Expect(err).To(BeNil())
+			userlib.DatastoreSet(bundle, []byte("not a prekey bundle"))
+			_, err = alice.CreateInvitations(aliceFile, []string{"charles", "doris"})
+			Expect(err).ToNot(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(stored))
+
+			userlib.DebugMsg("Charles can still be shared with afterwards.")
+			invite, err = alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+			data, err := charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+	})
+
+	Describe("Compaction Tests", func() {
+
+		measureBandwidth := func(probe func()) (bandwidth int) {
+			before := userlib.DatastoreGetBandwidth()
+			probe()
+			after := userlib.DatastoreGetBandwidth()
+			return after - before
+		}
+
+		//The bandwidth of loading a file beyond what loading the same content stored in one go costs
+		loadOverhead := func(user *client.User, filename string, expected []byte) (overhead int) {
+			err := user.StoreFile("baseline.txt", expected)
+			Expect(err).To(BeNil())
+			baseline := measureBandwidth(func() {
+				data, err := user.LoadFile("baseline.txt")
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal(expected))
+			})
+			loaded := measureBandwidth(func() {
+				data, err := user.LoadFile(filename)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal(expected))
+			})
+			return loaded - baseline
+		}
+
+		Specify("Compaction Test: Compacting a file makes loading it cheaper and keeps it shared.", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice and Bob append to the file many times.")
+			expected := []byte(contentOne)
+			for i := 0; i < 25; i++ {
+				err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+				Expect(err).To(BeNil())
+				err = bob.AppendToFile(bobFile, []byte(contentThree))
+				Expect(err).To(BeNil())
+				expected = append(expected, contentTwo+contentThree...)
+			}
+			uncompacted := loadOverhead(bob, bobFile, expected)
+
+			userlib.DebugMsg("Alice compacts the file, which deletes the old list.")
+			stored := len(userlib.DatastoreGetMap())
+			err = alice.CompactFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(BeNumerically("<=", stored-50))
+
+			userlib.DebugMsg("Loading the compacted file costs about as much as loading the content stored in one go.")
+			compacted := loadOverhead(bob, bobFile, expected)
+			Expect(compacted).To(BeNumerically("<", uncompacted/10))
+
+			userlib.DebugMsg("Both can keep appending to the compacted file.")
+			err = bob.AppendToFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			expected = append(expected, contentOne+contentTwo...)
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected))
+
+			err = alice.Mkdir("folder")
+			Expect(err).To(BeNil())
+			err = alice.CompactFile("folder")
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Compaction Test: Files appended to many times are compacted when they are loaded.", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			expected := []byte(contentOne)
+			for i := 0; i < 100; i++ {
+				err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+				Expect(err).To(BeNil())
+				expected = append(expected, contentTwo...)
+			}
+
+			userlib.DebugMsg("The first load compacts the file, the next load is much cheaper.")
+			first := loadOverhead(alice, aliceFile, expected)
+			second := loadOverhead(alice, aliceFile, expected)
+			Expect(second).To(BeNumerically("<", first/10))
+
+			userlib.DebugMsg("A few appends do not compact the file.")
+			for i := 0; i < 3; i++ {
+				err = alice.AppendToFile(aliceFile, []byte(contentThree))
+				Expect(err).To(BeNil())
+			}
+			stored := len(userlib.DatastoreGetMap())
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(stored))
+
+			userlib.DebugMsg("Private files are never compacted, loading one stores nothing however often it was appended to.")
+			err = alice.SetPrivacyMode(true)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			expected = []byte(contentOne)
+			for i := 0; i < 100; i++ {
+				err = alice.AppendToFile(bobFile, []byte(contentTwo))
+				Expect(err).To(BeNil())
+				expected = append(expected, contentTwo...)
+			}
+			datastoreSet := userlib.DatastoreSet
+			sets := 0
+			userlib.DatastoreSet = func(key uuid.UUID, value []byte) {
+				sets++
+				datastoreSet(key, value)
+			}
+			data, err := alice.LoadFile(bobFile)
+			userlib.DatastoreSet = datastoreSet
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected))
+			Expect(sets).To(Equal(0))
+		})
+	})
+
+	Describe("Bandwidth Tests", func() {
+
+		measureBandwidth := func(probe func()) (bandwidth int) {
+			before := userlib.DatastoreGetBandwidth()
+			probe()
+			after := userlib.DatastoreGetBandwidth()
+			return after - before
+		}
+
+		Specify("Bandwidth Test: Appending does not get more expensive with every share.", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			appendBandwidth := func(user *client.User, filename string) int {
+				return measureBandwidth(func() {
+					err = user.AppendToFile(filename, []byte(contentTwo))
+					Expect(err).To(BeNil())
+				})
+			}
+			owner := appendBandwidth(alice, aliceFile)
+			recipient := appendBandwidth(bob, bobFile)
+
+			userlib.DebugMsg("Alice shares the file with ten more users.")
+			recipients := []string{"user0", "user1", "user2", "user3", "user4", "user5", "user6", "user7", "user8", "user9"}
+			for _, username := range recipients {
+				_, err = client.InitUser(username, defaultPassword)
+				Expect(err).To(BeNil())
+			}
+			_, err = alice.CreateInvitations(aliceFile, recipients)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Appending costs exactly as much as before for the owner and for Bob.")
+			Expect(appendBandwidth(alice, aliceFile)).To(Equal(owner))
+			Expect(appendBandwidth(bob, bobFile)).To(Equal(recipient))
+
+			userlib.DebugMsg("Revoking still finds everyone the file is shared with.")
+			err = alice.RevokeMany(aliceFile, recipients[:5])
+			Expect(err).To(BeNil())
+			Expect(appendBandwidth(alice, aliceFile)).To(Equal(owner))
+			err = alice.RevokeAccess(aliceFile, "user0")
+			Expect(err).ToNot(BeNil())
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Describe("Parallel Loading Tests", func() {
+
+		Specify("Parallel Loading Test: The files of a list are put back together in order.", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice stores a normal, a private and a deduplicated file and shares them.")
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.SetPrivacyMode(true)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.SetPrivacyMode(false)
+			Expect(err).To(BeNil())
+			err = alice.SetDeduplication(true)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(charlesFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			files := []string{aliceFile, bobFile, charlesFile}
+			for _, file := range files {
+				for _, recipient := range []*client.User{bob, charles} {
+					invite, err := alice.CreateInvitation(file, recipient.Username)
+					Expect(err).To(BeNil())
+					err = recipient.AcceptInvitation("alice", invite, "shared_"+file)
+					Expect(err).To(BeNil())
+				}
+			}
+
+			userlib.DebugMsg("Everyone appends, and Charles is revoked lazily half way.")
+			expected := []byte(contentOne)
+			for i := 0; i < 20; i++ {
+				appended := append([]byte(contentTwo), userlib.RandomBytes(i*300)...)
+				for _, file := range files {
+					if i%2 == 0 {
+						err = alice.AppendToFile(file, appended)
+					} else {
+						err = bob.AppendToFile("shared_"+file, appended)
+					}
+					Expect(err).To(BeNil())
+					if i == 10 {
+						err = alice.RevokeAccessLazy(file, "charles")
+						Expect(err).To(BeNil())
+					}
+				}
+				expected = append(expected, appended...)
+			}
+			for _, file := range files {
+				data, err := alice.LoadFile(file)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal(expected))
+				data, err = bob.LoadFile("shared_" + file)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal(expected))
+				_, err = charles.LoadFile("shared_" + file)
+				Expect(err).ToNot(BeNil())
+			}
+		})
+
+		Specify("Parallel Loading Test: Files of a list that are swapped are noticed.", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Every append adds a new empty tail to the list.")
+			newKeys := func(append_content string) (added []uuid.UUID) {
+				before := userlib.DatastoreGetMap()
+				keys := make(map[uuid.UUID]bool)
+				for key := range before {
+					keys[key] = true
+				}
+				err = alice.AppendToFile(aliceFile, []byte(append_content))
+				Expect(err).To(BeNil())
+				for key := range userlib.DatastoreGetMap() {
+					if !keys[key] {
+						added = append(added, key)
+					}
+				}
+				return added
+			}
+			first := newKeys(contentTwo)
+			Expect(first).To(HaveLen(1))
+			second := newKeys(contentThree)
+			Expect(second).To(HaveLen(1))
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+
+			userlib.DebugMsg("Swapping the file with contentThree and the empty tail, a new session has nothing cached.")
+			datastore := userlib.DatastoreGetMap()
+			firstValue := datastore[first[0]]
+			userlib.DatastoreSet(first[0], datastore[second[0]])
+			userlib.DatastoreSet(second[0], firstValue)
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			_, err = aliceLaptop.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Describe("Cache Tests", func() {
+
+		countGets := func(probe func()) (gets int) {
+			datastoreGet := userlib.DatastoreGet
+			userlib.DatastoreGet = func(key uuid.UUID) ([]byte, bool) {
+				gets++
+				return datastoreGet(key)
+			}
+			defer func() { userlib.DatastoreGet = datastoreGet }()
+			probe()
+			return gets
+		}
+
+		Specify("Cache Test: Loading a file again does not load what has not changed.", func() {
+			userlib.DebugMsg("Initializing user Alice with a long file.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(strings.Repeat(longString, 64)))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			loadGets := func(filename string) int {
+				return countGets(func() {
+					_, err = alice.LoadFile(filename)
+					Expect(err).To(BeNil())
+				})
+			}
+			cold := loadGets(aliceFile)
+			warm := loadGets(aliceFile)
+			Expect(warm).To(BeNumerically("<", cold))
+
+			userlib.DebugMsg("Loading again costs the same for a long list of appends as for a short file.")
+			for i := 0; i < 10; i++ {
+				err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+				Expect(err).To(BeNil())
+			}
+			loadGets(aliceFile)
+			loadGets(bobFile)
+			Expect(loadGets(aliceFile)).To(Equal(loadGets(bobFile)))
+		})
+
+		Specify("Cache Test: Changes made by other sessions and users are seen.", func() {
+			userlib.DebugMsg("Initializing users Alice (aliceDesktop, aliceLaptop) and Bob.")
+			aliceDesktop, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = aliceDesktop.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := aliceDesktop.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			expectContent := func(user *client.User, filename string, content string) {
+				data, err := user.LoadFile(filename)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(content)))
+			}
+			expectContent(aliceDesktop, aliceFile, contentOne)
+			expectContent(bob, bobFile, contentOne)
+
+			userlib.DebugMsg("aliceLaptop appends, Bob and aliceDesktop see it.")
+			err = aliceLaptop.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			expectContent(aliceDesktop, aliceFile, contentOne+contentTwo)
+			expectContent(bob, bobFile, contentOne+contentTwo)
+
+			userlib.DebugMsg("Bob overwrites with content of the same length.")
+			err = bob.StoreFile(bobFile, []byte(strings.ToUpper(contentOne+contentTwo)))
+			Expect(err).To(BeNil())
+			expectContent(aliceDesktop, aliceFile, strings.ToUpper(contentOne+contentTwo))
+			expectContent(aliceLaptop, aliceFile, strings.ToUpper(contentOne+contentTwo))
+
+			userlib.DebugMsg("Changing what is returned does not change the cache.")
+			data, err := aliceDesktop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			data[0] = 'x'
+			expectContent(aliceDesktop, aliceFile, strings.ToUpper(contentOne+contentTwo))
+
+			userlib.DebugMsg("aliceLaptop revokes Bob, the file is encrypted again and aliceDesktop still loads it.")
+			err = aliceLaptop.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = aliceLaptop.AppendToFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			expectContent(aliceDesktop, aliceFile, strings.ToUpper(contentOne+contentTwo)+contentThree)
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Describe("Concurrency Tests", func() {
+
+		//Runs every operation in a goroutine of its own and gives the errors of all of them
+		runConcurrently := func(operations []func() error) (errs []error) {
+			results := make(chan error)
+			for _, operation := range operations {
+				go func(operation func() error) {
+					results <- operation()
+				}(operation)
+			}
+			for range operations {
+				errs = append(errs, <-results)
+			}
+			return errs
+		}
+
+		Specify("Concurrency Test: One session stores, appends and loads from many goroutines, run with -race.", func() {
+			userlib.DebugMsg("Initializing user Alice with a file every goroutine appends to.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Every goroutine stores a file of its own, appends to the shared one and loads both.")
+			const goroutines = 8
+			filenames := make([]string, goroutines)
+			loaded := make([][]byte, goroutines)
+			var operations []func() error
+			for i := 0; i < goroutines; i++ {
+				i := i
+				filenames[i] = "file" + string(rune('a'+i))
+				operations = append(operations, func() (err error) {
+					err = alice.StoreFile(filenames[i], []byte(filenames[i]))
+					if err != nil {
+						return err
+					}
+					err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+					if err != nil {
+						return err
+					}
+					loaded[i], err = alice.LoadFile(filenames[i])
+					if err != nil {
+						return err
+					}
+					_, err = alice.LoadFile(aliceFile)
+					return err
+				})
+			}
+			for _, err := range runConcurrently(operations) {
+				Expect(err).To(BeNil())
+			}
+			for i, filename := range filenames {
+				Expect(loaded[i]).To(Equal([]byte(filename)))
+			}
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + strings.Repeat(contentTwo, goroutines))))
+
+			userlib.DebugMsg("Logging out while the other goroutines keep going makes them fail cleanly.")
+			operations = []func() error{func() error {
+				alice.Logout()
+				return nil
+			}}
+			for i := 0; i < goroutines; i++ {
+				operations = append(operations, func() error {
+					_, err := alice.LoadFile(aliceFile)
+					if err != nil && !strings.Contains(err.Error(), "logged out") {
+						return err
+					}
+					return nil
+				})
+			}
+			for _, err := range runConcurrently(operations) {
+				Expect(err).To(BeNil())
+			}
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Concurrency Test: Users are created and log in from many goroutines at once, run with -race.", func() {
+			userlib.DebugMsg("Every goroutine creates a user, logs in again and on a new device, and shares with Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			const goroutines = 4
+			names := make([]string, goroutines)
+			var operations []func() error
+			for i := 0; i < goroutines; i++ {
+				i := i
+				names[i] = "user" + string(rune('a'+i))
+				operations = append(operations, func() error {
+					user, err := client.InitUser(names[i], defaultPassword)
+					if err != nil {
+						return err
+					}
+					err = user.StoreFile(aliceFile, []byte(names[i]))
+					if err != nil {
+						return err
+					}
+					laptop, err := client.NewDevice(names[i])
+					if err != nil {
+						return err
+					}
+					err = user.ApproveDevice(laptop.Id, "laptop")
+					if err != nil {
+						return err
+					}
+					userLaptop, err := client.GetUserOnDevice(laptop)
+					if err != nil {
+						return err
+					}
+					_, err = userLaptop.LoadFile(aliceFile)
+					if err != nil {
+						return err
+					}
+					userDesktop, err := client.GetUser(names[i], defaultPassword)
+					if err != nil {
+						return err
+					}
+					_, err = userDesktop.CreateInvitation(aliceFile, "alice")
+					return err
+				})
+			}
+			for _, err := range runConcurrently(operations) {
+				Expect(err).To(BeNil())
+			}
+			for _, name := range names {
+				user, err := client.GetUser(name, defaultPassword)
+				Expect(err).To(BeNil())
+				data, err := user.LoadFile(aliceFile)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(name)))
+			}
+		})
+	})
+
+	Describe("Concurrent Session Tests", func() {
+
+		//Records what another session does to the datastore and takes it back, so it can be put back
+		//later as if the session did it on another device at that moment
+		recordChanges := func(other func()) (changes map[uuid.UUID][]byte) {
+			datastore := userlib.DatastoreGetMap()
+			before := make(map[uuid.UUID][]byte)
+			for key, value := range datastore {
+				before[key] = value
+			}
+			other()
+			changes = make(map[uuid.UUID][]byte)
+			for key, value := range datastore {
+				if string(before[key]) != string(value) {
+					changes[key] = value
+				}
+			}
+			for key, value := range before {
+				if _, ok := datastore[key]; !ok {
+					changes[key] = nil
+				}
+				datastore[key] = value
+			}
+			for key := range changes {
+				if before[key] == nil {
+					delete(datastore, key)
+				}
+			}
+			return changes
+		}
+
+		//Runs operation and puts the changes back right before its n-th read from the datastore, which is when the
+		//other session got to do all of it. That can only happen until operation writes something the other session
+		//changed too, gives false if operation did not read that often before then
+		interleave := func(changes map[uuid.UUID][]byte, n int, operation func()) (interleaved bool) {
+			datastoreGet, datastoreSet, datastoreDelete := userlib.DatastoreGet, userlib.DatastoreSet, userlib.DatastoreDelete
+			defer func() {
+				userlib.DatastoreGet, userlib.DatastoreSet, userlib.DatastoreDelete = datastoreGet, datastoreSet, datastoreDelete
+			}()
+			gets, written := 0, false
+			userlib.DatastoreGet = func(key uuid.UUID) ([]byte, bool) {
+				gets++
+				if gets == n && !written {
+					datastore := userlib.DatastoreGetMap()
+					for changed, value := range changes {
+						if value == nil {
+							delete(datastore, changed)
+						} else {
+							datastore[changed] = value
+						}
+					}
+					interleaved = true
+				}
+				return datastoreGet(key)
+			}
+			userlib.DatastoreSet = func(key uuid.UUID, value []byte) {
+				_, changed := changes[key]
+				written = written || changed
+				datastoreSet(key, value)
+			}
+			userlib.DatastoreDelete = func(key uuid.UUID) {
+				_, changed := changes[key]
+				written = written || changed
+				datastoreDelete(key)
+			}
+			operation()
+			return interleaved
+		}
+
+		//Lets another session do all of other at every moment of operation before operation writes what other
+		//changes and checks the content of the file afterwards every time
+		everyInterleaving := func(filename string, setup func(), other func(), operation func(), expected ...string) {
+			interleavings := 0
+			for n := 1; ; n++ {
+				setup()
+				changes := recordChanges(other)
+				if !interleave(changes, n, operation) {
+					break
+				}
+				interleavings++
+				data, err := aliceLaptop.LoadFile(filename)
+				Expect(err).To(BeNil())
+				Expect(string(data)).To(BeElementOf(expected))
+			}
+			Expect(interleavings).To(BeNumerically(">", 1))
+		}
+
+		BeforeEach(func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Concurrent Session Test: Two sessions append to the same file at the same time.", func() {
+			appendBoth := func(filename string) {
+				everyInterleaving(filename, func() {
+					err = alice.StoreFile(filename, []byte(contentOne))
+					Expect(err).To(BeNil())
+				}, func() {
+					err = aliceLaptop.AppendToFile(filename, []byte(contentTwo))
+					Expect(err).To(BeNil())
+				}, func() {
+					err = alice.AppendToFile(filename, []byte(contentThree))
+					Expect(err).To(BeNil())
+				}, contentOne+contentTwo+contentThree, contentOne+contentThree+contentTwo)
+			}
+			userlib.DebugMsg("A normal file.")
+			appendBoth(aliceFile)
+
+			userlib.DebugMsg("A deduplicated file.")
+			err = alice.SetDeduplication(true)
+			Expect(err).To(BeNil())
+			appendBoth(bobFile)
+
+			userlib.DebugMsg("A private file.")
+			err = alice.SetPrivacyMode(true)
+			Expect(err).To(BeNil())
+			appendBoth(charlesFile)
+		})
+
+		Specify("Concurrent Session Test: A session stores a file while another appends to it.", func() {
+			userlib.DebugMsg("The store of the other session comes first, the append is made after it.")
+			everyInterleaving(aliceFile, func() {
+				err = alice.StoreFile(aliceFile, []byte(contentOne))
+				Expect(err).To(BeNil())
+			}, func() {
+				err = aliceLaptop.StoreFile(aliceFile, []byte(contentTwo))
+				Expect(err).To(BeNil())
+			}, func() {
+				err = alice.AppendToFile(aliceFile, []byte(contentThree))
+				Expect(err).To(BeNil())
+			}, contentTwo+contentThree)
+
+			userlib.DebugMsg("The append of the other session comes first, the store replaces it.")
+			everyInterleaving(aliceFile, func() {
+				err = alice.StoreFile(aliceFile, []byte(contentOne))
+				Expect(err).To(BeNil())
+			}, func() {
+				err = aliceLaptop.AppendToFile(aliceFile, []byte(contentTwo))
+				Expect(err).To(BeNil())
+			}, func() {
+				err = alice.StoreFile(aliceFile, []byte(contentThree))
+				Expect(err).To(BeNil())
+			}, contentThree)
+		})
+
+		Specify("Concurrent Session Test: Changing the settings of a file does not lose an append of another session.", func() {
+			//The content is stored again with every setting, so the append of the other session has to be in it
+			changeWhileAppending := func(filename string, change func()) {
+				everyInterleaving(filename, func() {
+					err = alice.StoreFile(filename, []byte(contentOne))
+					Expect(err).To(BeNil())
+				}, func() {
+					err = aliceLaptop.AppendToFile(filename, []byte(contentThree))
+					Expect(err).To(BeNil())
+				}, change, contentOne+contentThree)
+			}
+
+			userlib.DebugMsg("Alice turns compression on and off.")
+			changeWhileAppending(aliceFile, func() {
+				err = alice.SetCompression(aliceFile, true)
+				Expect(err).To(BeNil())
+			})
+			changeWhileAppending(aliceFile, func() {
+				err = alice.SetCompression(aliceFile, false)
+				Expect(err).To(BeNil())
+			})
+
+			userlib.DebugMsg("Alice marks a deduplicated file as sensitive and back.")
+			err = alice.SetDeduplication(true)
+			Expect(err).To(BeNil())
+			err = aliceLaptop.SetDeduplication(true)
+			Expect(err).To(BeNil())
+			changeWhileAppending(bobFile, func() {
+				err = alice.SetSensitive(bobFile, true)
+				Expect(err).To(BeNil())
+			})
+			changeWhileAppending(bobFile, func() {
+				err = alice.SetSensitive(bobFile, false)
+				Expect(err).To(BeNil())
+			})
+		})
+
+		Specify("Concurrent Session Test: Re-encrypting a file does not lose an append of another session.", func() {
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			shares := 0
+			everyInterleaving(aliceFile, func() {
+				//Every time the file is shared with Bob and revoked lazily again, so there is something to re-encrypt
+				err = alice.StoreFile(aliceFile, []byte(contentOne))
+				Expect(err).To(BeNil())
+				invite, err := alice.CreateInvitation(aliceFile, "bob")
+				Expect(err).To(BeNil())
+				shares++
+				err = bob.AcceptInvitation("alice", invite, bobFile+strings.Repeat("I", shares))
+				Expect(err).To(BeNil())
+				err = alice.RevokeAccessLazy(aliceFile, "bob")
+				Expect(err).To(BeNil())
+			}, func() {
+				err = aliceLaptop.AppendToFile(aliceFile, []byte(contentThree))
+				Expect(err).To(BeNil())
+			}, func() {
+				err = alice.ReencryptFile(aliceFile)
+				Expect(err).To(BeNil())
+			}, contentOne+contentThree)
+		})
+		Specify("Concurrent Session Test: A file locked by another session while a user changes it is not changed.", func() {
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			//The lease is taken before Bob commits his change every time, so Bob has to find it and
+			//the file is never changed. Only the last time without the lease his change goes through
+			changeWhileLocking := func(change func() error) {
+				locked := false
+				everyInterleaving(aliceFile, func() {
+					if locked {
+						err = alice.UnlockFile(aliceFile)
+						Expect(err).To(BeNil())
+					}
+					err = alice.StoreFile(aliceFile, []byte(contentOne))
+					Expect(err).To(BeNil())
+				}, func() {
+					err = aliceLaptop.LockFile(aliceFile, 60*1000*1000*1000)
+					Expect(err).To(BeNil())
+				}, func() {
+					locked = true
+					err = change()
+					if err != nil {
+						_, ok := err.(*client.ErrLocked)
+						Expect(ok).To(BeTrue())
+					}
+				}, contentOne)
+			}
+
+			userlib.DebugMsg("Bob appends to the file.")
+			changeWhileLocking(func() error {
+				return bob.AppendToFile(bobFile, []byte(contentTwo))
+			})
+
+			userlib.DebugMsg("Bob stores the file.")
+			changeWhileLocking(func() error {
+				return bob.StoreFile(bobFile, []byte(contentTwo))
+			})
+		})
+
+		Specify("Concurrent Session Test: Two sessions store new files at the same time.", func() {
+			//Runs other in the other session at every moment of operation and checks that the files of
+			//both sessions can be loaded afterwards from both
+			storeBoth := func(other func(n int) (string, string), operation func(n int) (string, string)) {
+				interleavings := 0
+				for n := 1; ; n++ {
+					var otherFile, otherContent, file, content string
+					changes := recordChanges(func() {
+						otherFile, otherContent = other(n)
+					})
+					if !interleave(changes, n, func() {
+						file, content = operation(n)
+					}) {
+						break
+					}
+					interleavings++
+					for _, session := range []*client.User{alice, aliceLaptop} {
+						data, err := session.LoadFile(file)
+						Expect(err).To(BeNil())
+						Expect(string(data)).To(Equal(content))
+						if otherFile != file {
+							data, err = session.LoadFile(otherFile)
+							Expect(err).To(BeNil())
+							Expect(string(data)).To(Equal(otherContent))
+						}
+					}
+				}
+				Expect(interleavings).To(BeNumerically(">", 1))
+			}
+
+			userlib.DebugMsg("Files of their own, both stay owned by Alice.")
+			storeBoth(func(n int) (string, string) {
+				filename := bobFile + strings.Repeat("I", n)
+				err = aliceLaptop.StoreFile(filename, []byte(contentTwo))
+				Expect(err).To(BeNil())
+				return filename, contentTwo
+			}, func(n int) (string, string) {
+				filename := aliceFile + strings.Repeat("I", n)
+				err = alice.StoreFile(filename, []byte(contentOne))
+				Expect(err).To(BeNil())
+				return filename, contentOne
+			})
+
+			userlib.DebugMsg("Files in the same directory, both are in it.")
+			err = alice.Mkdir("docs")
+			Expect(err).To(BeNil())
+			storeBoth(func(n int) (string, string) {
+				filename := "docs/" + bobFile + strings.Repeat("I", n)
+				err = aliceLaptop.StoreFile(filename, []byte(contentTwo))
+				Expect(err).To(BeNil())
+				return filename, contentTwo
+			}, func(n int) (string, string) {
+				filename := "docs/" + aliceFile + strings.Repeat("I", n)
+				err = alice.StoreFile(filename, []byte(contentOne))
+				Expect(err).To(BeNil())
+				return filename, contentOne
+			})
+
+			userlib.DebugMsg("The same new name in the directory, the later store wins.")
+			storeBoth(func(n int) (string, string) {
+				filename := "docs/" + charlesFile + strings.Repeat("I", n)
+				err = aliceLaptop.StoreFile(filename, []byte(contentTwo))
+				Expect(err).To(BeNil())
+				return filename, contentTwo
+			}, func(n int) (string, string) {
+				filename := "docs/" + charlesFile + strings.Repeat("I", n)
+				err = alice.StoreFile(filename, []byte(contentThree))
+				Expect(err).To(BeNil())
+				return filename, contentThree
+			})
+		})
+
+		Specify("Concurrent Session Test: Pinning a contact while another session stores the user loses nothing.", func() {
+			userlib.DebugMsg("Alice already has a contact book.")
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(charlesFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			_, err = alice.CreateInvitation(charlesFile, "charles")
+			Expect(err).To(BeNil())
+			for n := 1; ; n++ {
+				//Every time Alice pins a user she has not seen yet
+				recipient := "bob" + strings.Repeat("I", n)
+				_, err = client.InitUser(recipient, defaultPassword)
+				Expect(err).To(BeNil())
+				filename := aliceFile + strings.Repeat("I", n)
+				err = alice.StoreFile(filename, []byte(contentOne))
+				Expect(err).To(BeNil())
+				changes := recordChanges(func() {
+					_, err = aliceLaptop.CreateInvitation(filename, recipient)
+					Expect(err).To(BeNil())
+				})
+				if !interleave(changes, n, func() {
+					err = alice.StoreFile(filename+"new", []byte(contentTwo))
+					Expect(err).To(BeNil())
+				}) {
+					break
+				}
+
+				userlib.DebugMsg("Both sessions can still share with the pinned user.")
+				err = alice.StoreFile(filename+"shared", []byte(contentOne))
+				Expect(err).To(BeNil())
+				_, err = alice.CreateInvitation(filename+"shared", recipient)
+				Expect(err).To(BeNil())
+				pinned, _, err := aliceLaptop.GetFingerprint(recipient)
+				Expect(err).To(BeNil())
+				recipientLaptop, err := client.GetUser(recipient, defaultPassword)
+				Expect(err).To(BeNil())
+				fingerprint, err := recipientLaptop.MyFingerprint()
+				Expect(err).To(BeNil())
+				Expect(pinned).To(Equal(fingerprint))
+			}
+		})
+
+		Specify("Concurrent Session Test: Two sessions share the same file with different users at the same time.", func() {
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			interleavings := 0
+			for n := 1; ; n++ {
+				filename := aliceFile + strings.Repeat("I", n)
+				err = alice.StoreFile(filename, []byte(contentOne))
+				Expect(err).To(BeNil())
+				var charlesInvite uuid.UUID
+				changes := recordChanges(func() {
+					charlesInvite, err = aliceLaptop.CreateInvitation(filename, "charles")
+					Expect(err).To(BeNil())
+				})
+				var bobInvite uuid.UUID
+				if !interleave(changes, n, func() {
+					bobInvite, err = alice.CreateInvitation(filename, "bob")
+					Expect(err).To(BeNil())
+				}) {
+					break
+				}
+				interleavings++
+
+				userlib.DebugMsg("Both of them have access and both of them can be revoked.")
+				err = bob.AcceptInvitation("alice", bobInvite, filename)
+				Expect(err).To(BeNil())
+				err = charles.AcceptInvitation("alice", charlesInvite, filename)
+				Expect(err).To(BeNil())
+				err = alice.RevokeAccess(filename, "bob")
+				Expect(err).To(BeNil())
+				_, err = bob.LoadFile(filename)
+				Expect(err).ToNot(BeNil())
+				data, err := charles.LoadFile(filename)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(contentOne)))
+				err = aliceLaptop.RevokeAccess(filename, "charles")
+				Expect(err).To(BeNil())
+				_, err = charles.LoadFile(filename)
+				Expect(err).ToNot(BeNil())
+			}
+			Expect(interleavings).To(BeNumerically(">", 1))
+		})
+	})
+
+	Describe("Lock Tests", func() {
+
+		//Long enough for the lease to outlast every test, a time.Duration in nanoseconds
+		const leaseTTL = 60 * 1000 * 1000 * 1000
+
+		//Shares aliceFile of Alice with Bob as bobFile
+		shareWithBob := func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+		}
+
+		Specify("Lock Test: Only the holder of a lease can change the file until it is unlocked.", func() {
+			shareWithBob()
+
+			userlib.DebugMsg("Alice locks the file, Bob can no longer store or append to it.")
+			err = alice.LockFile(aliceFile, leaseTTL)
+			Expect(err).To(BeNil())
+			err = bob.StoreFile(bobFile, []byte(contentTwo))
+			locked, ok := err.(*client.ErrLocked)
+			Expect(ok).To(BeTrue())
+			Expect(locked.Holder).To(Equal("alice"))
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			_, ok = err.(*client.ErrLocked)
+			Expect(ok).To(BeTrue())
+			err = bob.LockFile(bobFile, leaseTTL)
+			_, ok = err.(*client.ErrLocked)
+			Expect(ok).To(BeTrue())
+			err = bob.UnlockFile(bobFile)
+			_, ok = err.(*client.ErrLocked)
+			Expect(ok).To(BeTrue())
+
+			userlib.DebugMsg("Bob can still read it, Alice can still change it from any session.")
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = aliceLaptop.StoreFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("After Alice unlocks the file Bob can change it again.")
+			err = alice.UnlockFile(aliceFile)
+			Expect(err).To(BeNil())
+			err = alice.UnlockFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentThree + contentTwo)))
+		})
+
+		Specify("Lock Test: An expired lease is broken by the next user.", func() {
+			shareWithBob()
+
+			userlib.DebugMsg("Alice takes a lease that expires right away, Bob can take the file over.")
+			err = alice.LockFile(aliceFile, 1)
+			Expect(err).To(BeNil())
+			err = bob.StoreFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = bob.LockFile(bobFile, leaseTTL)
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentThree))
+			locked, ok := err.(*client.ErrLocked)
+			Expect(ok).To(BeTrue())
+			Expect(locked.Holder).To(Equal("bob"))
+
+			userlib.DebugMsg("Bob renews his lease with one that expires right away, then Alice can lock it.")
+			err = bob.LockFile(bobFile, 1)
+			Expect(err).To(BeNil())
+			err = alice.LockFile(aliceFile, leaseTTL)
+			Expect(err).To(BeNil())
+			err = alice.LockFile(aliceFile, 0)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Lock Test: The lease moves with the file on revocation and is dropped with a revoked holder.", func() {
+			shareWithBob()
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice keeps her lease when she revokes Charles.")
+			err = alice.LockFile(aliceFile, leaseTTL)
+			Expect(err).To(BeNil())
+			err = alice.RevokeAccess(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			_, ok := err.(*client.ErrLocked)
+			Expect(ok).To(BeTrue())
+
+			userlib.DebugMsg("The lease of Bob is gone once Alice revokes him.")
+			err = alice.UnlockFile(aliceFile)
+			Expect(err).To(BeNil())
+			err = bob.LockFile(bobFile, leaseTTL)
+			Expect(err).To(BeNil())
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Lock Test: Other users cannot change the settings of a locked file, compact it or re-encrypt it.", func() {
+			shareWithBob()
+			expectLocked := func() {
+				_, ok := err.(*client.ErrLocked)
+				Expect(ok).To(BeTrue())
+			}
+
+			userlib.DebugMsg("Alice locks the file, everything of Bob that stores it again fails.")
+			err = alice.LockFile(aliceFile, leaseTTL)
+			Expect(err).To(BeNil())
+			err = bob.SetCompression(bobFile, true)
+			expectLocked()
+			err = bob.SetSensitive(bobFile, true)
+			expectLocked()
+			err = bob.CompactFile(bobFile)
+			expectLocked()
+			err = bob.ReencryptFile(bobFile)
+			expectLocked()
+
+			userlib.DebugMsg("Alice can still do all of it.")
+			err = alice.SetCompression(aliceFile, true)
+			Expect(err).To(BeNil())
+			err = alice.SetSensitive(aliceFile, true)
+			Expect(err).To(BeNil())
+			err = alice.CompactFile(aliceFile)
+			Expect(err).To(BeNil())
+			err = alice.ReencryptFile(aliceFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("After Alice unlocks the file Bob can too.")
+			err = alice.UnlockFile(aliceFile)
+			Expect(err).To(BeNil())
+			err = bob.SetCompression(bobFile, false)
+			Expect(err).To(BeNil())
+			err = bob.CompactFile(bobFile)
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("Lock Test: Leases on the files in a directory move with them when the directory is revoked.", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.Mkdir("docs")
+			Expect(err).To(BeNil())
+			err = alice.Mkdir("docs/sub")
+			Expect(err).To(BeNil())
+			err = alice.StoreFile("docs/a.txt", []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile("docs/sub/b.txt", []byte(contentOne))
+			Expect(err).To(BeNil())
+			invites, err := alice.CreateInvitations("docs", []string{"bob", "charles"})
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invites["bob"], "bobDocs")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invites["charles"], "charlesDocs")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice locks a file in the directory, Charles one in the directory under it.")
+			err = alice.LockFile("docs/a.txt", leaseTTL)
+			Expect(err).To(BeNil())
+			err = charles.LockFile("charlesDocs/sub/b.txt", leaseTTL)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice revokes Charles, her lease stays and the lease of Charles is gone.")
+			err = alice.RevokeAccess("docs", "charles")
+			Expect(err).To(BeNil())
+			err = bob.AppendToFile("bobDocs/a.txt", []byte(contentTwo))
+			locked, ok := err.(*client.ErrLocked)
+			Expect(ok).To(BeTrue())
+			Expect(locked.Holder).To(Equal("alice"))
+			err = bob.AppendToFile("bobDocs/sub/b.txt", []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = bob.LockFile("bobDocs/sub/b.txt", leaseTTL)
+			Expect(err).To(BeNil())
+			err = alice.UnlockFile("docs/a.txt")
+			Expect(err).To(BeNil())
+		})
+	})
 })
+
+// Benchmarks the bandwidth of appending to a file shared with more and more users, run with
+// go test -bench AppendToFile. The bytes/op should be the same for every number of shares
+func BenchmarkAppendToFile(b *testing.B) {
+	benchmarks := []struct {
+		name   string
+		shares int
+	}{{"shares=0", 0}, {"shares=1", 1}, {"shares=8", 8}, {"shares=32", 32}}
+	for _, benchmark := range benchmarks {
+		b.Run(benchmark.name, func(b *testing.B) {
+			userlib.DatastoreClear()
+			userlib.KeystoreClear()
+			filename := "aliceFile.txt"
+			owner, err := client.InitUser("alice", defaultPassword)
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = owner.StoreFile(filename, []byte(contentOne))
+			if err != nil {
+				b.Fatal(err)
+			}
+			var recipients []string
+			for len(recipients) < benchmark.shares {
+				recipient := "user" + string(rune('a'+len(recipients)%26)) + string(rune('a'+len(recipients)/26))
+				_, err = client.InitUser(recipient, defaultPassword)
+				if err != nil {
+					b.Fatal(err)
+				}
+				recipients = append(recipients, recipient)
+			}
+			if len(recipients) > 0 {
+				_, err = owner.CreateInvitations(filename, recipients)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ResetTimer()
+			userlib.DatastoreResetBandwidth()
+			for i := 0; i < b.N; i++ {
+				err = owner.AppendToFile(filename, []byte(contentTwo))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(userlib.DatastoreGetBandwidth())/float64(b.N), "bytes/op")
+		})
+	}
+}
+
+// Benchmarks the datastore round trips of loading a file, run with go test -bench LoadFile. A session that
+// has loaded the file before only loads the metadata again, and after an append only the new part of the list
+func BenchmarkLoadFile(b *testing.B) {
+	benchmarks := []struct {
+		name   string
+		warm   bool
+		append bool
+	}{{"cold", false, false}, {"warm", true, false}, {"warm+append", true, true}}
+	for _, benchmark := range benchmarks {
+		b.Run(benchmark.name, func(b *testing.B) {
+			userlib.DatastoreClear()
+			userlib.KeystoreClear()
+			filename := "aliceFile.txt"
+			owner, err := client.InitUser("alice", defaultPassword)
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = owner.StoreFile(filename, []byte(strings.Repeat(longString, 64)))
+			if err != nil {
+				b.Fatal(err)
+			}
+			for i := 0; i < 16; i++ {
+				err = owner.AppendToFile(filename, []byte(contentTwo))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			gets, loadGets := 0, 0
+			datastoreGet := userlib.DatastoreGet
+			userlib.DatastoreGet = func(key uuid.UUID) ([]byte, bool) {
+				gets++
+				return datastoreGet(key)
+			}
+			defer func() { userlib.DatastoreGet = datastoreGet }()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				if !benchmark.warm {
+					owner, err = client.GetUser("alice", defaultPassword)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				if benchmark.append {
+					err = owner.AppendToFile(filename, []byte(contentTwo))
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				before := gets
+				b.StartTimer()
+				_, err = owner.LoadFile(filename)
+				if err != nil {
+					b.Fatal(err)
+				}
+				loadGets += gets - before
+			}
+			b.ReportMetric(float64(loadGets)/float64(b.N), "gets/op")
+		})
+	}
+}
+
+// Benchmarks an operation of a session against logging in for it, run with go test -bench Session.
+// A session derives the master key with Argon2 once, so only logging in pays for it
+func BenchmarkSession(b *testing.B) {
+	benchmarks := []struct {
+		name  string
+		login bool
+	}{{"session", false}, {"login", true}}
+	for _, benchmark := range benchmarks {
+		b.Run(benchmark.name, func(b *testing.B) {
+			userlib.DatastoreClear()
+			userlib.KeystoreClear()
+			filename := "aliceFile.txt"
+			owner, err := client.InitUser("alice", defaultPassword)
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = owner.StoreFile(filename, []byte(contentOne))
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if benchmark.login {
+					owner, err = client.GetUser("alice", defaultPassword)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				_, err = owner.LoadFile(filename)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}